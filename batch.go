@@ -0,0 +1,54 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import "sync"
+
+// batching accumulates the events for `Context.BatchHandle`
+type batching struct {
+	mutex  sync.Mutex
+	open   bool
+	events []EventInfo
+}
+
+// beginBatch starts accumulating the delivered events until endBatch
+func (w *watcher) beginBatch() {
+	if w.context.BatchHandle == nil {
+		return
+	}
+	b := &w.batch
+	b.mutex.Lock()
+	b.open = true
+	b.mutex.Unlock()
+}
+
+// endBatch passes the events accumulated since beginBatch to `Context.BatchHandle`
+func (w *watcher) endBatch() {
+	if w.context.BatchHandle == nil {
+		return
+	}
+	b := &w.batch
+	b.mutex.Lock()
+	events := b.events
+	b.events, b.open = nil, false
+	b.mutex.Unlock()
+	if len(events) > 0 {
+		w.context.BatchHandle(events)
+	}
+}
+
+// batchEvent adds e to the open batch or passes it to `Context.BatchHandle` alone,
+// if it is delivered outside of a run loop iteration by Load or a timer
+func (w *watcher) batchEvent(e EventInfo) {
+	b := &w.batch
+	b.mutex.Lock()
+	if b.open {
+		b.events = append(b.events, e)
+		b.mutex.Unlock()
+		return
+	}
+	b.mutex.Unlock()
+	w.context.BatchHandle([]EventInfo{e})
+}
@@ -0,0 +1,129 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// bulkWindow is the time events for a root are held back when `Context.CoalesceBulk` is set
+var bulkWindow = 50 * time.Millisecond
+
+// bulkThreshold is the number of distinct changed paths within the window
+// that are coalesced into a single `BulkChange`
+var bulkThreshold = 16
+
+// BulkChange is the FileInfo of a directory passed with a coalesced Modify
+// when `Context.CoalesceBulk` is set.
+type BulkChange struct {
+	FileInfo
+	changed []string
+}
+
+// Changed returns the paths below the directory that changed within the window
+func (b *BulkChange) Changed() []string {
+	return b.changed
+}
+
+// heldEvent is an event held back for later delivery
+type heldEvent struct {
+	event Event
+	info  *info
+	as    FileInfo
+	stamp stamp
+}
+
+// bulkCoalesce collects the events per loaded root
+type bulkCoalesce struct {
+	mutex   sync.Mutex
+	pending map[string][]heldEvent
+}
+
+// coalesceBulk holds back the event for fi until the window of its loaded root ends.
+// It returns false if fi has no loaded root and the event should be delivered directly.
+func (w *watcher) coalesceBulk(event Event, fi *info, as FileInfo, s stamp) bool {
+	w.mutex.RLock()
+	anc := w.tree.ancestor(fi.path, explicit)
+	w.mutex.RUnlock()
+	if anc == nil {
+		return false
+	}
+	root := anc.path
+	b := &w.bulk
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.pending == nil {
+		b.pending = make(map[string][]heldEvent)
+	}
+	list, ok := b.pending[root]
+	b.pending[root] = append(list, heldEvent{event, fi, as, s})
+	if !ok {
+		w.afterFunc(bulkWindow, func() {
+			w.flushBulk(root)
+		})
+	}
+	return true
+}
+
+// flushBulk delivers the collected events for root, either as they are
+// or as a single Modify of the directory containing all changes
+func (w *watcher) flushBulk(root string) {
+	b := &w.bulk
+	b.mutex.Lock()
+	list := b.pending[root]
+	delete(b.pending, root)
+	b.mutex.Unlock()
+	var changed []string
+	seen := make(map[string]bool)
+	for _, e := range list {
+		if !seen[e.info.path] {
+			seen[e.info.path] = true
+			changed = append(changed, e.info.path)
+		}
+	}
+	var nfo *info
+	if len(changed) >= bulkThreshold {
+		dir := commonDir(changed)
+		if !within(dir, root) {
+			dir = root
+		}
+		w.mutex.RLock()
+		nfo = w.tree.ancestor(dir, 0)
+		w.mutex.RUnlock()
+	}
+	if nfo == nil || !within(nfo.path, root) {
+		// too few changes or the root was deleted in the meantime
+		for _, e := range list {
+			w.debounce(e.event, e.info, e.as, e.stamp)
+		}
+		return
+	}
+	// the bulk change was observed with its first event
+	w.deliver(Modify, &BulkChange{nfo, changed}, list[0].stamp)
+}
+
+// within returns whether path is dir or below dir
+func within(path, dir string) bool {
+	return path == dir || len(path) > len(dir) && path[:len(dir)] == dir &&
+		(path[len(dir)] == os.PathSeparator || dir[len(dir)-1] == os.PathSeparator)
+}
+
+// commonDir returns the deepest directory containing all paths
+func commonDir(paths []string) string {
+	dir := filepath.Dir(paths[0])
+	for _, path := range paths[1:] {
+		for !within(path, dir) {
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				break
+			}
+			dir = parent
+		}
+	}
+	return dir
+}
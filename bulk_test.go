@@ -0,0 +1,83 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCoalesceBulk(t *testing.T) {
+	requireUnclocked(t)
+	var changes []*BulkChange
+	var env *testenv
+	env = newtestenvWith(t, &Context{
+		Handle: func(e Event, fi FileInfo) {
+			env.handle(e, fi)
+			if bc, ok := fi.(*BulkChange); ok {
+				env.Lock()
+				changes = append(changes, bc)
+				env.Unlock()
+			}
+		},
+		CoalesceBulk: true,
+	})
+	root, w := env.root, env.watcher
+	c := &fakeClock{t: time.Unix(0, 0)}
+	w.setClock(c)
+	defer env.close()
+	sub := filepath.Join(root, "sub")
+	err := os.Mkdir(sub, 0700)
+	if err != nil {
+		t.Fatal("failed to mkdir.", err)
+	}
+	env.load(root, true)
+	// held returns the number of distinct paths held back for the root
+	held := func() int {
+		b := &w.bulk
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		paths := make(map[string]bool)
+		for _, h := range b.pending[root] {
+			paths[h.info.path] = true
+		}
+		return len(paths)
+	}
+	// few changes are delivered as they are
+	env.mkdir(root, "dir")
+	env.waitUntil(func() bool { return held() == 1 })
+	c.advance(bulkWindow)
+	env.check()
+	for i := 0; i < bulkThreshold; i++ {
+		env.writeClose(os.Create(filepath.Join(sub, fmt.Sprint(i))))
+	}
+	env.waitUntil(func() bool { return held() == bulkThreshold })
+	c.advance(bulkWindow)
+	env.expect = append(env.expect, record{Modify, sub, false})
+	env.check()
+	env.Lock()
+	defer env.Unlock()
+	if len(changes) != 1 || len(changes[0].Changed()) != bulkThreshold {
+		t.Fatalf("expected one bulk change with %d paths got %v", bulkThreshold, changes)
+	}
+}
+
+func TestCloseDropsBulk(t *testing.T) {
+	env := newtestenvWith(t, &Context{CoalesceBulk: true})
+	root, w := env.root, env.watcher
+	defer env.close()
+	env.load(root, true)
+	env.writeClose(os.Create(filepath.Join(root, "file")))
+	time.Sleep(bulkWindow / 2)
+	if err := (Watcher{w}).Close(); err != nil {
+		t.Fatal("failed to close", err)
+	}
+	time.Sleep(bulkWindow + waitfor)
+	// the collected events are not delivered after close
+	env.check()
+}
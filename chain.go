@@ -0,0 +1,140 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// chained is a Create or Rename held back for `Context.RenameWindow`
+type chained struct {
+	heldEvent
+	timer timer
+}
+
+// chains holds the Create and Rename events of files that may be renamed again by path
+type chains struct {
+	mutex   sync.Mutex
+	pending map[string]*chained
+}
+
+// chain holds back the Create of a file for `Context.RenameWindow`. Backends that cannot
+// correlate both paths report a rename as the Delete of the old and the Create of the new
+// path, so the Delete of a held file is a rename within the window and drops both events.
+// Other events of a held file are absorbed, because the Create is delivered with the final
+// state of the file. The events of another file at the path deliver the held event first.
+// It returns whether the event was held back or dropped.
+func (w *watcher) chain(event Event, fi *info, as FileInfo, s stamp) bool {
+	if r, ok := as.(*RenameChange); ok && event == Rename && !fi.IsDir() {
+		return w.chainRename(fi, r, s)
+	}
+	c := &w.chains
+	c.mutex.Lock()
+	e := c.pending[fi.path]
+	switch {
+	case e != nil && e.info == fi && e.event == Create && event == Delete:
+		e.timer.Stop()
+		delete(c.pending, fi.path)
+		c.mutex.Unlock()
+		return true
+	case e != nil && e.info == fi && e.event == Create && (event == Create || event == Modify):
+		c.mutex.Unlock()
+		return true
+	case e == nil && event == Create && !fi.IsDir():
+		w.hold(fi.path, heldEvent{Create, fi, as, s})
+		c.mutex.Unlock()
+		return true
+	}
+	c.mutex.Unlock()
+	if e == nil {
+		return false
+	}
+	w.unchain(fi.path, e)
+	return w.chain(event, fi, as, s)
+}
+
+// chainRename holds back the Rename of a file for `Context.RenameWindow`. A held Create
+// or Rename of the file at the old path is replaced, so a chain of renames is delivered
+// as a single Rename from the first old path to the last new path and a chain back to
+// the first path is dropped. A held Create moves with the file.
+// The files of a renamed directory are not held back.
+func (w *watcher) chainRename(fi *info, r *RenameChange, s stamp) bool {
+	old := r.OldPath()
+	w.mutex.RLock()
+	moved := w.tree.get(filepath.Dir(old)) == nil
+	w.mutex.RUnlock()
+	c := &w.chains
+	c.mutex.Lock()
+	e := c.pending[old]
+	if e != nil && e.info == fi {
+		delete(c.pending, old)
+		e.timer.Stop()
+		switch {
+		case e.event == Create:
+			w.hold(fi.path, e.heldEvent)
+		case e.as.(*RenameChange).OldPath() != fi.path:
+			first := e.as.(*RenameChange).OldPath()
+			w.hold(fi.path, heldEvent{Rename, fi, &RenameChange{fi, first}, e.stamp})
+		}
+		c.mutex.Unlock()
+		return true
+	}
+	c.mutex.Unlock()
+	if e != nil {
+		w.unchain(old, e)
+	}
+	if moved {
+		return false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.pending[fi.path] != nil {
+		return false
+	}
+	w.hold(fi.path, heldEvent{Rename, fi, r, s})
+	return true
+}
+
+// hold holds back the event h at path for `Context.RenameWindow`.
+// It expects the chains mutex to be held.
+func (w *watcher) hold(path string, h heldEvent) {
+	c := &w.chains
+	if c.pending == nil {
+		c.pending = make(map[string]*chained)
+	}
+	e := &chained{heldEvent: h}
+	e.timer = w.afterFunc(w.context.RenameWindow, func() {
+		w.unchain(path, e)
+	})
+	c.pending[path] = e
+}
+
+// unchain delivers the held event e at path unless it was dropped
+func (w *watcher) unchain(path string, e *chained) {
+	c := &w.chains
+	c.mutex.Lock()
+	if c.pending[path] != e {
+		c.mutex.Unlock()
+		return
+	}
+	delete(c.pending, path)
+	e.timer.Stop()
+	c.mutex.Unlock()
+	w.deliver(e.event, e.as, e.stamp)
+}
+
+// dropChains drops the held events of the files for which gone returns true
+func (w *watcher) dropChains(gone func(fi *info) bool) {
+	c := &w.chains
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for path, e := range c.pending {
+		if gone(e.info) {
+			e.timer.Stop()
+			delete(c.pending, path)
+		}
+	}
+}
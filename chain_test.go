@@ -0,0 +1,99 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRenameChain(t *testing.T) {
+	renames := make(chan string, 4)
+	var env *testenv
+	env = newtestenvWith(t, &Context{
+		Handle: func(e Event, fi FileInfo) {
+			env.handle(e, fi)
+			if r, ok := fi.(*RenameChange); ok {
+				renames <- r.OldPath()
+			}
+		},
+		RenameWindow: 4 * waitfor,
+	})
+	root := env.root
+	defer env.close()
+	env.load(root, true)
+	a := filepath.Join(root, "a")
+	env.writeClose(os.Create(a))
+	// the held create absorbs the write
+	time.Sleep(6 * waitfor)
+	env.expect = append(env.expect, record{Create, a, false})
+	env.check()
+	rename := func(paths ...string) {
+		for i := 1; i < len(paths); i++ {
+			if err := os.Rename(paths[i-1], paths[i]); err != nil {
+				t.Fatal("failed to rename.", err)
+			}
+			env.sleep()
+		}
+	}
+	b, c := filepath.Join(root, "b"), filepath.Join(root, "c")
+	rename(a, b, c)
+	if !backend.ReportsRename {
+		// only the delete of the first path is delivered while the file is renamed
+		env.expect = append(env.expect, record{Delete, a, false})
+		env.check()
+		time.Sleep(5 * waitfor)
+		env.expect = append(env.expect, record{Create, c, false})
+		env.check()
+	} else {
+		// nothing is delivered while the file is renamed
+		env.check()
+		time.Sleep(5 * waitfor)
+		env.expect = append(env.expect, record{Rename, c, false})
+		env.check()
+		select {
+		case old := <-renames:
+			if old != a {
+				t.Errorf("expected a rename from %s got %s", a, old)
+			}
+		default:
+			t.Error("expected a rename")
+		}
+		// a chain back to the first path is dropped
+		rename(c, b, c)
+		time.Sleep(6 * waitfor)
+		env.check()
+	}
+	// a created file that is renamed is reported as created
+	tmp := filepath.Join(root, "tmp")
+	env.writeClose(os.Create(tmp))
+	rename(tmp, a)
+	time.Sleep(6 * waitfor)
+	env.expect = append(env.expect, record{Create, a, false})
+	env.check()
+	// a created file that is removed within the window is not reported
+	env.writeClose(os.Create(tmp))
+	env.remove(tmp)
+	env.expect = env.expect[:len(env.expect)-1]
+	time.Sleep(6 * waitfor)
+	env.check()
+}
+
+func TestUnloadDropsChain(t *testing.T) {
+	env := newtestenvWith(t, &Context{RenameWindow: 4 * waitfor})
+	root, w := env.root, env.watcher
+	defer env.close()
+	env.load(root, true)
+	env.writeClose(os.Create(filepath.Join(root, "file")))
+	env.sleep()
+	if err := (Watcher{w}).Unload(root, true); err != nil {
+		t.Fatal("failed to unload", err)
+	}
+	time.Sleep(5 * waitfor)
+	// the held create of the unloaded file is dropped
+	env.check()
+}
@@ -0,0 +1,169 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultEventBuffer is the channel capacity used if `Context.EventBuffer` is zero
+const defaultEventBuffer = 64
+
+// EventInfo is an event received from `Watcher.Events` or `Context.HandleInfo`
+type EventInfo struct {
+	Event Event
+	Info  FileInfo
+	// Seq numbers the events of a watcher in the order they were observed, starting at one.
+	// Dropped events leave gaps and held back events keep their number.
+	Seq uint64
+	// Time is the time the watcher observed the event
+	Time time.Time
+	raw  uint32
+}
+
+// Raw returns the platform specific flags of the last notification for the file of the event,
+// the inotify mask, kqueue fflags or windows file action, or zero if unknown.
+// It is zero for files created by the event and for the polling backend.
+func (e EventInfo) Raw() uint32 {
+	return e.raw
+}
+
+// OldPath returns the path before the rename for a Rename event or an empty string
+func (e EventInfo) OldPath() string {
+	if r, ok := e.Info.(*RenameChange); ok {
+		return r.OldPath()
+	}
+	return ""
+}
+
+// channels holds the event and error channels of a watcher.
+// The channels are created with the watcher, so that requesting them never waits for
+// a sender blocked on a full channel. They only receive values once requested.
+type channels struct {
+	// senders hold the read lock while sending, close holds the write lock
+	mutex  sync.RWMutex
+	events chan EventInfo
+	errors chan error
+	quit   chan struct{}
+	closed bool
+	once   sync.Once
+	size   int
+	drop   bool
+	// listen registers the events listener once
+	listen sync.Once
+	// wantErrors is set atomically once the errors channel was requested
+	wantErrors int32
+}
+
+// Events returns a channel that receives all events after the context handlers.
+// The channel buffers `Context.EventBuffer` events. If it is full the watcher blocks
+// or drops the event if `Context.DropEvents` is set. Close closes the channel.
+func (w Watcher) Events() <-chan EventInfo {
+	c := &w.chans
+	events := c.events
+	c.listen.Do(func() {
+		w.listen(func(e EventInfo) {
+			sent := c.send(func(quit chan struct{}, wait bool) bool {
+				if !wait {
+					select {
+					case events <- e:
+						return true
+					default:
+						return false
+					}
+				}
+				select {
+				case events <- e:
+				case <-quit:
+				}
+				return true
+			})
+			if !sent {
+				w.stats.dropped()
+			}
+		})
+	})
+	return events
+}
+
+// Errors returns a channel that receives all errors after `Context.Error`.
+// It buffers and blocks or drops like the channel returned by Events.
+// Close closes the channel.
+func (w Watcher) Errors() <-chan error {
+	c := &w.chans
+	atomic.StoreInt32(&c.wantErrors, 1)
+	return c.errors
+}
+
+// init prepares the channels and wraps the error handler of the context c
+func (c *channels) init(ctx *Context) {
+	c.size, c.drop = ctx.EventBuffer, ctx.DropEvents
+	if c.size <= 0 {
+		c.size = defaultEventBuffer
+	}
+	c.quit = make(chan struct{})
+	c.events = make(chan EventInfo, c.size)
+	c.errors = make(chan error, c.size)
+	handle := ctx.Error
+	ctx.Error = func(err error) {
+		handle(err)
+		c.sendError(err)
+	}
+}
+
+// send calls try without waiting and, if that failed and events are not dropped,
+// again with waiting while holding the read lock, unless the channels are closed.
+// It returns false if the value was dropped.
+func (c *channels) send(try func(quit chan struct{}, wait bool) bool) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.closed {
+		return true
+	}
+	if try(c.quit, false) {
+		return true
+	}
+	return !c.drop && try(c.quit, true)
+}
+
+// sendError passes err to the errors channel if it was requested
+func (c *channels) sendError(err error) {
+	if atomic.LoadInt32(&c.wantErrors) == 0 {
+		return
+	}
+	errors := c.errors
+	c.send(func(quit chan struct{}, wait bool) bool {
+		if !wait {
+			select {
+			case errors <- err:
+				return true
+			default:
+				return false
+			}
+		}
+		select {
+		case errors <- err:
+		case <-quit:
+		}
+		return true
+	})
+}
+
+// close unblocks waiting senders and closes the channels
+func (c *channels) close() {
+	c.once.Do(func() {
+		close(c.quit)
+	})
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.events)
+	close(c.errors)
+}
@@ -0,0 +1,228 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	env := newtestenv(t)
+	defer os.RemoveAll(env.root)
+	w := Watcher{env.watcher}
+	events, errs := w.Events(), w.Errors()
+	dir := env.mkdir(env.root, "dir")
+	select {
+	case e := <-events:
+		if e.Event != Create || e.Info.Path() != dir {
+			t.Errorf("expected %s got %s", record{Create, dir, false}, record{e.Event, e.Info.Path(), false})
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected an event")
+	}
+	env.watcher.context.Error(errors.New("test"))
+	select {
+	case err := <-errs:
+		if err.Error() != "test" {
+			t.Errorf("expected test error got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected an error")
+	}
+	env.Lock()
+	env.errors = nil
+	env.Unlock()
+	env.check()
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for range events {
+	}
+	for range errs {
+	}
+	if _, ok := <-w.Events(); ok {
+		t.Error("expected closed events channel")
+	}
+}
+
+func TestHandleInfo(t *testing.T) {
+	var infos []EventInfo
+	var env *testenv
+	env = newtestenvWith(t, &Context{
+		HandleInfo: func(e EventInfo) {
+			env.Lock()
+			infos = append(infos, e)
+			env.Unlock()
+		},
+	})
+	root := env.root
+	defer env.close()
+	env.load(root, true)
+	for _, name := range []string{"a", "b", "c"} {
+		env.mkdir(env.root, name)
+	}
+	env.sleep()
+	env.check()
+	env.Lock()
+	defer env.Unlock()
+	if len(infos) != len(env.events) {
+		t.Fatalf("expected %d infos got %d", len(env.events), len(infos))
+	}
+	for i, e := range infos {
+		if e.Seq != uint64(i+1) || e.Info.Path() != env.events[i].path {
+			t.Errorf("expected %d %s got %d %s", i+1, env.events[i].path, e.Seq, e.Info.Path())
+		}
+		if i > 0 && e.Time.Before(infos[i-1].Time) {
+			t.Errorf("expected increasing times got %v before %v", e.Time, infos[i-1].Time)
+		}
+	}
+}
+
+func TestHandleInfoHeld(t *testing.T) {
+	var infos []EventInfo
+	var env *testenv
+	env = newtestenvWith(t, &Context{
+		Debounce: 4 * waitfor,
+		HandleInfo: func(e EventInfo) {
+			env.Lock()
+			infos = append(infos, e)
+			env.Unlock()
+		},
+	})
+	root := env.root
+	defer env.close()
+	env.load(root, true)
+	file := filepath.Join(root, "file")
+	env.writeClose(os.Create(file))
+	env.sleep()
+	dir := env.mkdir(root, "dir")
+	time.Sleep(5 * waitfor)
+	env.expect = []record{{Create, dir, false}, {Create, file, false}}
+	env.check()
+	env.Lock()
+	defer env.Unlock()
+	if len(infos) != 2 {
+		t.Fatalf("expected 2 infos got %d", len(infos))
+	}
+	// the held create keeps the number and time it was observed with
+	if infos[1].Seq >= infos[0].Seq || !infos[1].Time.Before(infos[0].Time) {
+		t.Errorf("expected the create of the file observed first got %d %v and %d %v",
+			infos[1].Seq, infos[1].Time, infos[0].Seq, infos[0].Time)
+	}
+}
+
+func TestBatchHandle(t *testing.T) {
+	batches := 0
+	var env *testenv
+	env = newtestenvWith(t, &Context{
+		Handle: func(Event, FileInfo) {
+			t.Error("expected no call of Handle with BatchHandle")
+		},
+		BatchHandle: func(list []EventInfo) {
+			if len(list) == 0 {
+				t.Error("expected a batch with events")
+			}
+			env.Lock()
+			batches++
+			env.Unlock()
+			for _, e := range list {
+				env.handle(e.Event, e.Info)
+			}
+		},
+	})
+	root := env.root
+	defer env.close()
+	env.load(root, true)
+	dir := env.mkdir(env.root, "dir")
+	for _, name := range []string{"a", "b", "c"} {
+		env.createWriteClose(dir, name)
+	}
+	env.sleep()
+	env.check()
+	env.Lock()
+	defer env.Unlock()
+	if batches == 0 || batches > len(env.events) {
+		t.Errorf("expected at most %d batches got %d", len(env.events), batches)
+	}
+}
+
+func TestDropEvents(t *testing.T) {
+	env := newtestenvWith(t, &Context{EventBuffer: 1, DropEvents: true})
+	root := env.root
+	defer env.close()
+	w := Watcher{env.watcher}
+	events := w.Events()
+	if err := w.Load(root, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		env.mkdir(env.root, name)
+	}
+	env.sleep()
+	// the watcher must not block on the full channel
+	env.check()
+	if n := len(events); n != 1 {
+		t.Errorf("expected one buffered event got %d", n)
+	}
+	if n := w.Stats().Dropped; n != 2 {
+		t.Errorf("expected two dropped events got %d", n)
+	}
+}
+
+func TestBlockedEvents(t *testing.T) {
+	env := newtestenvWith(t, &Context{EventBuffer: 1})
+	root := env.root
+	defer env.close()
+	w := Watcher{env.watcher}
+	events := w.Events()
+	if err := w.Load(root, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		env.mkdir(env.root, name)
+	}
+	// the run loop blocks on the full channel and cannot scan again for the poll backend
+	time.Sleep(waitfor)
+	// the watcher blocks on the full channel, requesting the channels must not
+	done := make(chan struct{})
+	go func() {
+		w.Events()
+		w.Errors()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("requesting the channels blocked")
+	}
+	for range env.expect {
+		<-events
+	}
+	env.check()
+}
+
+func TestRaw(t *testing.T) {
+	requireNative(t)
+	env := newtestenv(t)
+	defer env.close()
+	w := Watcher{env.watcher}
+	events := w.Events()
+	file := env.createWriteClose(env.root, "file")
+	env.sleep()
+	env.remove(file)
+	env.sleep()
+	env.check()
+	var last EventInfo
+	for len(events) > 0 {
+		last = <-events
+	}
+	if last.Event != Delete || last.Raw() == 0 {
+		t.Errorf("expected delete with raw flags got %s %x", last.Event, last.Raw())
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"sync"
+	"time"
+)
+
+// clock tells the time and schedules the timers of the time based features,
+// like debouncing, throttling and the windows of creates and moves.
+// Tests replace the real clock with setClock to run them without sleeping.
+type clock interface {
+	now() time.Time
+	afterFunc(d time.Duration, f func()) timer
+}
+
+// timer is a timer started by a clock and implemented by `*time.Timer`
+type timer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// realClock is the default clock using the time package
+type realClock struct{}
+
+func (realClock) now() time.Time {
+	return time.Now()
+}
+
+func (realClock) afterFunc(d time.Duration, f func()) timer {
+	return time.AfterFunc(d, f)
+}
+
+// setClock replaces the clock of the watcher and restarts the running tickers on it.
+// It must be called before the watcher handles events.
+func (s *shared) setClock(c clock) {
+	s.tickers.mutex.Lock()
+	defer s.tickers.mutex.Unlock()
+	s.clock = c
+	for _, t := range s.tickers.list {
+		t.start(c)
+	}
+}
+
+// ticker sends the time on C every interval of its clock like `time.Ticker`
+type ticker struct {
+	C     <-chan time.Time
+	c     chan time.Time
+	d     time.Duration
+	mutex sync.Mutex
+	timer timer
+	// gen is increased by start and stop to ignore the ticks of a replaced timer
+	gen int
+}
+
+// tickers holds the running tickers of a watcher
+type tickers struct {
+	mutex sync.Mutex
+	list  []*ticker
+}
+
+// newTicker returns a running ticker with the interval d on the clock of the watcher
+func (s *shared) newTicker(d time.Duration) *ticker {
+	c := make(chan time.Time, 1)
+	t := &ticker{C: c, c: c, d: d}
+	s.tickers.mutex.Lock()
+	defer s.tickers.mutex.Unlock()
+	s.tickers.list = append(s.tickers.list, t)
+	t.start(s.clock)
+	return t
+}
+
+// stopTicker stops t and forgets it
+func (s *shared) stopTicker(t *ticker) {
+	s.tickers.mutex.Lock()
+	defer s.tickers.mutex.Unlock()
+	for i, o := range s.tickers.list {
+		if o == t {
+			s.tickers.list = append(s.tickers.list[:i], s.tickers.list[i+1:]...)
+			break
+		}
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.gen++
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+// start schedules the ticks of t on the clock c and stops the previous timer
+func (t *ticker) start(c clock) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.gen++
+	gen := t.gen
+	var tick func()
+	tick = func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		if t.gen != gen {
+			return
+		}
+		// drop the tick if the last one was not received yet
+		select {
+		case t.c <- c.now():
+		default:
+		}
+		t.timer = c.afterFunc(t.d, tick)
+	}
+	t.timer = c.afterFunc(t.d, tick)
+}
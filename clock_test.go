@@ -0,0 +1,145 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only advances when told and runs the due timers
+type fakeClock struct {
+	sync.Mutex
+	t      time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	c      *fakeClock
+	at     time.Time
+	f      func()
+	active bool
+}
+
+func (c *fakeClock) now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) afterFunc(d time.Duration, f func()) timer {
+	c.Lock()
+	defer c.Unlock()
+	t := &fakeTimer{c, c.t.Add(d), f, true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.c.Lock()
+	defer t.c.Unlock()
+	active := t.active
+	t.active = false
+	return active
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.c.Lock()
+	defer t.c.Unlock()
+	active := t.active
+	t.at, t.active = t.c.t.Add(d), true
+	return active
+}
+
+// advance moves the clock forward by d and runs the due timers in order
+func (c *fakeClock) advance(d time.Duration) {
+	c.Lock()
+	end := c.t.Add(d)
+	for {
+		var next *fakeTimer
+		for _, t := range c.timers {
+			if t.active && !t.at.After(end) && (next == nil || t.at.Before(next.at)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+		c.t, next.active = next.at, false
+		c.Unlock()
+		next.f()
+		c.Lock()
+	}
+	c.t = end
+	c.Unlock()
+}
+
+// requireUnclocked skips tests that wait for events with a fake clock,
+// because the fake clock also stops the scans of the polling backend
+func requireUnclocked(t *testing.T) {
+	if backend.Name == "poll" {
+		t.Skip("the fake clock stops the poll scans")
+	}
+}
+
+func TestClock(t *testing.T) {
+	requireUnclocked(t)
+	env := newtestenvWith(t, &Context{Debounce: time.Minute})
+	root, w := env.root, env.watcher
+	c := &fakeClock{t: time.Unix(0, 0)}
+	w.setClock(c)
+	defer env.close()
+	env.load(root, true)
+	file := filepath.Join(root, "file")
+	env.writeClose(os.Create(file))
+	env.sleep()
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	env.writeClose(f, err)
+	env.sleep()
+	// the debounce window only passes with the clock
+	c.advance(time.Minute - time.Millisecond)
+	env.check()
+	c.advance(time.Millisecond)
+	env.expect = append(env.expect, record{Create, file, false})
+	env.check()
+	if last, ok := (Watcher{w}).LastEvent(file); !ok || last.After(c.now()) {
+		t.Errorf("expected the last event by the clock got %v", last)
+	}
+}
+
+func TestTicker(t *testing.T) {
+	var s shared
+	s.clock = realClock{}
+	tick := s.newTicker(time.Second)
+	defer s.stopTicker(tick)
+	// the running ticker moves to the new clock
+	c := &fakeClock{t: time.Unix(0, 0)}
+	s.setClock(c)
+	c.advance(time.Second - time.Millisecond)
+	select {
+	case <-tick.C:
+		t.Fatal("unexpected tick before the interval")
+	default:
+	}
+	c.advance(time.Millisecond)
+	select {
+	case now := <-tick.C:
+		if !now.Equal(time.Unix(1, 0)) {
+			t.Errorf("expected the tick at the clock time got %v", now)
+		}
+	default:
+		t.Fatal("expected a tick after the interval")
+	}
+	s.stopTicker(tick)
+	c.advance(time.Minute)
+	select {
+	case <-tick.C:
+		t.Error("unexpected tick after stop")
+	default:
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Count walks the directory at `path` like Load without watching or caching anything.
+// It applies `Context.Filter` and returns the number of directories Load would watch
+// and the number of other files it would cache. On Linux dirs can be compared with
+// `/proc/sys/fs/inotify/max_user_watches`, kqueue needs a watch for every file.
+// Errors of unreadable directories are returned as `LoadErrors` with the counts.
+func (w Watcher) Count(path string, recursive bool) (dirs int, files int, err error) {
+	root := filepath.Clean(path)
+	w.mutex.RLock()
+	scope := w.pathOptions(root)
+	w.mutex.RUnlock()
+	fi, err := os.Lstat(root)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !fi.IsDir() {
+		return 0, 0, ErrNotDir
+	}
+	if !w.accept(newInfo(root, fi)) {
+		return 0, 0, nil
+	}
+	var errs LoadErrors
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if !os.IsNotExist(err) {
+				errs = append(errs, &LoadError{path, err})
+			}
+			return nil
+		}
+		f := newInfo(path, fi)
+		if path != root && (scope.excluded(path) || !w.accept(f)) {
+			if fi.IsDir() {
+				return SkipDir
+			}
+			return nil
+		}
+		switch {
+		case !fi.IsDir():
+			files++
+		case w.watches(f) && (path == root || !scope.unwatched(path)):
+			dirs++
+		}
+		if fi.IsDir() && path != root && !recursive {
+			return SkipDir
+		}
+		return nil
+	})
+	if err == nil && len(errs) > 0 {
+		err = errs
+	}
+	return dirs, files, err
+}
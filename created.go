@@ -0,0 +1,118 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"sync"
+	"time"
+)
+
+// createWindow is the default of `Context.CreateWindow`
+var createWindow = 10 * time.Millisecond
+
+// creations holds the recently created files
+type creations struct {
+	mutex sync.Mutex
+	files map[*info]creation
+	// order holds the creates in the order they were reported to expire them
+	order []createdAt
+	// expiring is whether the expiry of the oldest create is scheduled
+	expiring bool
+}
+
+// creation is the time and the state of a file when its Create was reported
+type creation struct {
+	time time.Time
+	size int64
+	modt time.Time
+}
+
+// createdAt is a reported Create in the expiry order of creations
+type createdAt struct {
+	info *info
+	time time.Time
+}
+
+// creationWindow returns the window of `Context.CreateWindow`, negative if disabled
+func (w *watcher) creationWindow() time.Duration {
+	window := w.context.CreateWindow
+	if window == 0 {
+		window = createWindow
+	}
+	return window
+}
+
+// created records the Create of fi and returns true for a Modify of fi
+// within `Context.CreateWindow` after its Create, that did not change the file.
+func (w *watcher) created(event Event, fi *info) bool {
+	window := w.creationWindow()
+	if window < 0 {
+		return false
+	}
+	c := &w.creations
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := w.clock.now()
+	switch event {
+	case Create:
+		if fi.IsDir() {
+			return false
+		}
+		if c.files == nil {
+			c.files = make(map[*info]creation)
+		}
+		fi.mutex.RLock()
+		c.files[fi] = creation{now, fi.size, fi.modt}
+		fi.mutex.RUnlock()
+		c.order = append(c.order, createdAt{fi, now})
+		if !c.expiring {
+			c.expiring = true
+			w.afterFunc(window, w.expireCreates)
+		}
+	case Modify:
+		cr, ok := c.files[fi]
+		if !ok || now.Sub(cr.time) > window {
+			return false
+		}
+		fi.mutex.RLock()
+		same := fi.size == cr.size && fi.modt.Equal(cr.modt)
+		fi.mutex.RUnlock()
+		if !same {
+			// a real write is reported and later ones are compared to it
+			delete(c.files, fi)
+		}
+		return same
+	default:
+		delete(c.files, fi)
+	}
+	return false
+}
+
+// expireCreates forgets the creates whose window closed and checks the
+// remaining ones again after another window
+func (w *watcher) expireCreates() {
+	window := w.creationWindow()
+	c := &w.creations
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := w.clock.now()
+	n := 0
+	for _, at := range c.order {
+		if now.Sub(at.time) < window {
+			break
+		}
+		// a later Create of the same file keeps its own entry
+		if cr, ok := c.files[at.info]; ok && cr.time.Equal(at.time) {
+			delete(c.files, at.info)
+		}
+		n++
+	}
+	c.order = c.order[n:]
+	if len(c.order) == 0 {
+		c.order, c.expiring = nil, false
+		return
+	}
+	w.afterFunc(window, w.expireCreates)
+}
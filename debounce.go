@@ -0,0 +1,101 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DirChange is the FileInfo of a directory passed with a debounced Modify
+// when `Context.DebounceByDir` is set.
+type DirChange struct {
+	FileInfo
+	changed []string
+}
+
+// Changed returns the paths of the children that changed within the debounce window
+func (d *DirChange) Changed() []string {
+	return d.changed
+}
+
+// dirDebounce collects the changed children per directory
+type dirDebounce struct {
+	mutex   sync.Mutex
+	pending map[string][]string
+	// stamps holds the stamp of the first change per directory
+	stamps map[string]stamp
+	// nanos is the debounce window and accessed atomically
+	nanos int64
+}
+
+func (d *dirDebounce) window() time.Duration {
+	return time.Duration(atomic.LoadInt64(&d.nanos))
+}
+
+func (d *dirDebounce) setWindow(t time.Duration) {
+	atomic.StoreInt64(&d.nanos, int64(t))
+}
+
+// SetDebounceByDir changes the window of `Context.DebounceByDir` at runtime.
+// Directories already waiting keep their window, later ones use the new one.
+// Zero disables the debouncing for subsequent events. `Context.Debounce` is changed
+// by SetDebounce.
+func (w Watcher) SetDebounceByDir(d time.Duration) {
+	w.dirs.setWindow(d)
+}
+
+// debounceDir queues the event for fi to be delivered as a Modify of its parent directory.
+// It returns false if the parent is not cached and the event should be delivered directly.
+func (w *watcher) debounceDir(fi *info, s stamp) bool {
+	dir := filepath.Dir(fi.path)
+	w.mutex.RLock()
+	cached := w.tree.get(dir) != nil
+	w.mutex.RUnlock()
+	if !cached {
+		return false
+	}
+	d := &w.dirs
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.pending == nil {
+		d.pending = make(map[string][]string)
+		d.stamps = make(map[string]stamp)
+	}
+	changed, ok := d.pending[dir]
+	for _, path := range changed {
+		if path == fi.path {
+			return true
+		}
+	}
+	d.pending[dir] = append(changed, fi.path)
+	if !ok {
+		d.stamps[dir] = s
+		w.afterFunc(d.window(), func() {
+			w.flushDir(dir)
+		})
+	}
+	return true
+}
+
+// flushDir delivers the collected changes for dir
+func (w *watcher) flushDir(dir string) {
+	d := &w.dirs
+	d.mutex.Lock()
+	changed, s := d.pending[dir], d.stamps[dir]
+	delete(d.pending, dir)
+	delete(d.stamps, dir)
+	d.mutex.Unlock()
+	w.mutex.RLock()
+	nfo := w.tree.get(dir)
+	w.mutex.RUnlock()
+	if nfo == nil {
+		// the directory was deleted in the meantime
+		return
+	}
+	w.deliver(Modify, &DirChange{nfo, changed}, s)
+}
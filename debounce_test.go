@@ -0,0 +1,85 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDebounceByDir(t *testing.T) {
+	var changes []*DirChange
+	var env *testenv
+	env = newtestenvWith(t, &Context{
+		Handle: func(e Event, fi FileInfo) {
+			env.handle(e, fi)
+			if dc, ok := fi.(*DirChange); ok {
+				env.Lock()
+				changes = append(changes, dc)
+				env.Unlock()
+			}
+		},
+		DebounceByDir: 2 * waitfor,
+	})
+	root := env.root
+	defer env.close()
+	env.load(root, true)
+	for _, name := range []string{"a", "b", "c"} {
+		env.writeClose(os.Create(filepath.Join(root, name)))
+	}
+	time.Sleep(4 * waitfor)
+	env.expect = []record{{Modify, root, false}}
+	env.check()
+	env.Lock()
+	defer env.Unlock()
+	if len(changes) != 1 || len(changes[0].Changed()) != 3 {
+		t.Fatalf("expected one change with three children got %v", changes)
+	}
+}
+
+func TestCloseDropsDirChange(t *testing.T) {
+	requireUnclocked(t)
+	env := newtestenvWith(t, &Context{DebounceByDir: time.Minute})
+	root, w := env.root, env.watcher
+	c := &fakeClock{t: time.Unix(0, 0)}
+	w.setClock(c)
+	defer env.close()
+	env.load(root, true)
+	env.writeClose(os.Create(filepath.Join(root, "file")))
+	env.waitUntil(func() bool {
+		w.dirs.mutex.Lock()
+		defer w.dirs.mutex.Unlock()
+		return len(w.dirs.pending[root]) > 0
+	})
+	if err := (Watcher{w}).Close(); err != nil {
+		t.Fatal("failed to close", err)
+	}
+	<-w.done
+	c.advance(time.Minute)
+	// the collected change is not delivered after close
+	env.check()
+}
+
+func TestSetDebounceByDir(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	w := Watcher{env.watcher}
+	w.SetDebounceByDir(2 * waitfor)
+	if d := w.EffectiveContext().DebounceByDir; d != 2*waitfor {
+		t.Errorf("expected window %v got %v", 2*waitfor, d)
+	}
+	for _, name := range []string{"a", "b"} {
+		env.writeClose(os.Create(filepath.Join(env.root, name)))
+	}
+	time.Sleep(4 * waitfor)
+	env.expect = []record{{Modify, env.root, false}}
+	env.check()
+	w.SetDebounceByDir(0)
+	env.createWriteClose(env.root, "c")
+	env.sleep()
+	env.check()
+}
@@ -0,0 +1,325 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SetFilter replaces `Context.Filter` at runtime, nil accepts all files. The swap is atomic,
+// a load or event handled concurrently uses either the old or the new filter, and later
+// ones use the new filter. If recheck is `true` the cached files below the loaded roots
+// are filtered again: newly ignored files are marked ignored and their watches and
+// cached descendants dropped, newly accepted files are loaded and watched.
+// No events are reported for the changes of the cache.
+func (w Watcher) SetFilter(filter func(FileInfo) bool, recheck bool) error {
+	if filter == nil {
+		filter = func(FileInfo) bool { return true }
+	}
+	w.filter.Store(filter)
+	if !recheck {
+		return nil
+	}
+	var list []*info
+	w.mutex.RLock()
+	w.tree.each(func(nfo *info) {
+		list = append(list, nfo)
+	})
+	w.mutex.RUnlock()
+	var errs LoadErrors
+	for _, nfo := range list {
+		// the descendants of newly ignored files are not cached anymore
+		if nfo.has(explicit) || !w.cached(nfo) {
+			continue
+		}
+		var err error
+		switch accept, ignored := filter(nfo), nfo.Ignored(); {
+		case !accept && !ignored:
+			err = w.ignore(nfo)
+		case accept && ignored:
+			err = w.include(nfo)
+		}
+		if err != nil {
+			errs = append(errs, &LoadError{nfo.path, err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// accept returns whether fi passes the current filter
+func (w *watcher) accept(fi FileInfo) bool {
+	return w.filter.Load().(func(FileInfo) bool)(fi)
+}
+
+// ignore marks the cached nfo as ignored and drops its watch and cached descendants
+func (w *watcher) ignore(nfo *info) error {
+	var list []*info
+	w.mutex.RLock()
+	w.tree.walk(nfo.path, func(fi FileInfo) error {
+		list = append(list, fi.(*info))
+		return nil
+	})
+	w.mutex.RUnlock()
+	err := w.unwatch(list)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.tree.get(nfo.path) == nfo {
+		w.tree.deleteAll(nfo.path, w.forget)
+		nfo.mutex.Lock()
+		nfo.flags |= ignored
+		nfo.mutex.Unlock()
+		w.tree.insert(nfo)
+	}
+	return err
+}
+
+// include replaces the ignored nfo with a newly loaded entry without reporting it
+func (w *watcher) include(nfo *info) error {
+	var flags uint
+	w.mutex.Lock()
+	if anc := w.tree.ancestor(nfo.path, explicit); anc != nil {
+		anc.mutex.RLock()
+		flags = anc.flags & recurse
+		anc.mutex.RUnlock()
+	}
+	w.tree.deleteAll(nfo.path, w.forget)
+	w.mutex.Unlock()
+	err := w.loadImpl(nfo.path, flags, 0, w.flags, w.flags, nil)
+	if err == SkipDir || os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// ignoreRecheck is the minimum time between two checks of an ignore file for changes
+var ignoreRecheck = time.Second
+
+// GitIgnoreFilter returns a filter for `Context.Filter` that ignores the `.git` directories
+// and the files matched by the `.gitignore` files of root and its subdirectories.
+// Patterns match the path relative to the directory of their ignore file like git does,
+// with negation by a leading `!`, directory-only patterns with a trailing slash and `**`.
+// An ignore file is read when a path below its directory is filtered first. It is read
+// again if it changed when it is filtered itself or at most a second after the last check.
+// Paths outside of root are not ignored.
+func GitIgnoreFilter(root string) (func(FileInfo) bool, error) {
+	g := &gitIgnore{root: filepath.Clean(root), dirs: make(map[string]*ignoreFile)}
+	if _, err := g.file("", false); err != nil {
+		return nil, err
+	}
+	return g.filter, nil
+}
+
+// ignoreRule is a parsed pattern of an ignore file
+type ignoreRule struct {
+	// parts are the slash separated elements of the pattern
+	parts  []string
+	negate bool
+	dir    bool
+}
+
+// ignoreFile holds the rules of an ignore file and the state they were read from
+type ignoreFile struct {
+	rules   []ignoreRule
+	modt    time.Time
+	size    int64
+	checked time.Time
+}
+
+// gitIgnore holds the ignore files below root
+type gitIgnore struct {
+	mutex sync.Mutex
+	root  string
+	// dirs holds the ignore files by their slash separated directory relative to root
+	dirs map[string]*ignoreFile
+}
+
+// filter returns false if fi is ignored
+func (g *gitIgnore) filter(fi FileInfo) bool {
+	rel, err := filepath.Rel(g.root, fi.Path())
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return true
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	last := len(parts) - 1
+	if parts[last] == ".git" && fi.IsDir() {
+		return false
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	ignored := false
+	for i := range parts {
+		// a changed ignore file is usually filtered as it is created or replaced
+		f, err := g.file(strings.Join(parts[:i], "/"), i == last && parts[last] == ".gitignore")
+		if err != nil {
+			continue
+		}
+		for _, r := range f.rules {
+			if r.dir && !fi.IsDir() {
+				continue
+			}
+			if matchParts(r.parts, parts[i:]) {
+				ignored = !r.negate
+			}
+		}
+	}
+	return !ignored
+}
+
+// file returns the ignore file of dir and reads it if it changed since it was checked.
+// Unless force is set, the file is checked at most once per `ignoreRecheck`.
+// It expects the mutex to be held.
+func (g *gitIgnore) file(dir string, force bool) (*ignoreFile, error) {
+	f := g.dirs[dir]
+	now := time.Now()
+	if f != nil && !force && now.Sub(f.checked) < ignoreRecheck {
+		return f, nil
+	}
+	name := filepath.Join(g.root, filepath.FromSlash(dir), ".gitignore")
+	fi, err := os.Stat(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return f, err
+		}
+		f = &ignoreFile{checked: now}
+		g.dirs[dir] = f
+		return f, nil
+	}
+	if f != nil && f.modt.Equal(fi.ModTime()) && f.size == fi.Size() {
+		f.checked = now
+		return f, nil
+	}
+	rules, err := readIgnore(name)
+	if err != nil {
+		return f, err
+	}
+	f = &ignoreFile{rules: rules, modt: fi.ModTime(), size: fi.Size(), checked: now}
+	g.dirs[dir] = f
+	return f, nil
+}
+
+// readIgnore returns the rules of the ignore file at name
+func readIgnore(name string) ([]ignoreRule, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if r, ok := parseIgnore(scanner.Text()); ok {
+			rules = append(rules, r)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// parseIgnore returns the rule for a line of an ignore file
+// or false if the line is blank or a comment
+func parseIgnore(line string) (r ignoreRule, ok bool) {
+	line = strings.TrimRight(line, "\r")
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || line[0] == '#' {
+		return r, false
+	}
+	if line[0] == '!' {
+		r.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\#") || strings.HasPrefix(line, "\\!") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dir = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return r, false
+	}
+	if strings.Contains(line, "/") {
+		// patterns with a slash are relative to the directory of the ignore file
+		line = strings.TrimPrefix(line, "/")
+	} else {
+		line = "**/" + line
+	}
+	r.parts = strings.Split(line, "/")
+	return r, true
+}
+
+// matchParts returns whether the pattern elements match the path elements.
+// The element `**` matches any number of path elements, but at least one at the end.
+func matchParts(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			if len(rest) == 0 {
+				return len(parts) > 0
+			}
+			for i := range parts {
+				if matchParts(rest, parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], parts[0]); !ok {
+			return false
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
+
+// MatchFilter returns a filter for `Context.Filter` that ignores the files matching an exclude
+// pattern and, unless include is empty, the files not matching any include pattern.
+// Patterns are `path.Match` patterns with slashes as separator and `**` for any number of
+// path elements. Patterns with a separator are matched against `FileInfo.Path`, all others
+// against the name. Directories are only excluded, which prunes their whole subtree.
+func MatchFilter(include, exclude []string) func(FileInfo) bool {
+	inc, exc := splitPatterns(include), splitPatterns(exclude)
+	return func(fi FileInfo) bool {
+		parts := strings.Split(filepath.ToSlash(fi.Path()), "/")
+		if matchAny(exc, parts) {
+			return false
+		}
+		return fi.IsDir() || len(inc) == 0 || matchAny(inc, parts)
+	}
+}
+
+// splitPatterns returns the patterns split into their elements
+func splitPatterns(patterns []string) [][]string {
+	res := make([][]string, 0, len(patterns))
+	for _, p := range patterns {
+		p = filepath.ToSlash(p)
+		if !strings.Contains(p, "/") {
+			p = "**/" + p
+		}
+		res = append(res, strings.Split(p, "/"))
+	}
+	return res
+}
+
+// matchAny returns whether any of the split patterns match the path elements
+func matchAny(patterns [][]string, parts []string) bool {
+	for _, p := range patterns {
+		if matchParts(p, parts) {
+			return true
+		}
+	}
+	return false
+}
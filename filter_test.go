@@ -0,0 +1,128 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGitIgnoreFilter(t *testing.T) {
+	root, err := ioutil.TempDir("", "watchfs")
+	if err != nil {
+		t.Fatal("failed to setup test environment", err)
+	}
+	defer os.RemoveAll(root)
+	write := func(name, data string) {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(".gitignore", "# comment\nbuild/\n*.log\n!keep.log\n/top.txt\ndoc/**/*.tmp\n")
+	write("sub/.gitignore", "x\n")
+	for _, name := range []string{"build/out", "a.log", "keep.log", "top.txt", "x",
+		"sub/a.log", "sub/top.txt", "sub/x", "sub/build", "doc/a/b/c.tmp", "doc/c.tmp", ".git/HEAD"} {
+		write(name, "")
+	}
+	filter, err := GitIgnoreFilter(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(name string, want bool) {
+		path := filepath.Join(root, name)
+		fi, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := filter(newInfo(path, fi)); got != want {
+			t.Errorf("expected filter %s to return %v", name, want)
+		}
+	}
+	check("build", false)
+	check("a.log", false)
+	check("keep.log", true)
+	check("top.txt", false)
+	check("x", true)
+	check("sub", true)
+	check("sub/a.log", false)
+	check("sub/top.txt", true)
+	check("sub/x", false)
+	// build is not a directory in sub
+	check("sub/build", true)
+	check("doc/a/b/c.tmp", false)
+	check("doc/c.tmp", false)
+	check(".git", false)
+	// a changed ignore file is read again when it is filtered
+	write(".gitignore", "x\n")
+	check(".gitignore", true)
+	check("a.log", true)
+	check("top.txt", true)
+	check("x", false)
+}
+
+func TestMatchFilter(t *testing.T) {
+	env := newtestenvWith(t, &Context{})
+	defer env.close()
+	root, w := env.root, env.watcher
+	for _, name := range []string{"vendor/a.go", "src/a.go", "src/a_test.go", "src/a.txt", "b.go"} {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		env.writeClose(os.Create(path))
+	}
+	Watcher{w}.SetFilter(MatchFilter([]string{"*.go"}, []string{"vendor", filepath.Join(root, "**", "*_test.go")}), false)
+	env.load(root, true)
+	vendor := filepath.Join(root, "vendor")
+	if fi := w.tree.get(vendor); fi == nil || !fi.Ignored() {
+		t.Errorf("expected ignored vendor got %v", fi)
+	}
+	if fi := w.tree.get(filepath.Join(vendor, "a.go")); fi != nil {
+		t.Errorf("expected vendor subtree to be pruned got %v", fi)
+	}
+	for name, want := range map[string]bool{"src": true, "src/a.go": true, "src/a_test.go": false, "src/a.txt": false, "b.go": true} {
+		if got := (Watcher{w}).Get(filepath.Join(root, name)) != nil; got != want {
+			t.Errorf("expected %s cached %v got %v", name, want, got)
+		}
+	}
+}
+
+func TestSetFilter(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	w := Watcher{env.watcher}
+	build := env.mkdir(env.root, "build")
+	file := env.createWriteClose(build, "file")
+	env.sleep()
+	env.check()
+	err := w.SetFilter(func(fi FileInfo) bool {
+		return fi.Name() != "build"
+	}, true)
+	if err != nil {
+		t.Fatal("failed to set filter.", err)
+	}
+	if w.Get(build) != nil || env.watcher.tree.get(file) != nil {
+		t.Error("expected build to be ignored")
+	}
+	// build is not watched anymore
+	env.writeClose(os.Create(filepath.Join(build, "ignored")))
+	env.sleep()
+	env.check()
+	if err := w.SetFilter(nil, true); err != nil {
+		t.Fatal("failed to set filter.", err)
+	}
+	if w.Get(build) == nil || w.Get(file) == nil {
+		t.Error("expected build to be cached again")
+	}
+	env.createWriteClose(build, "other")
+	env.sleep()
+	env.check()
+}
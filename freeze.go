@@ -0,0 +1,90 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Freeze stops watching the directory at `path` and its direct children, or all
+// descendents if recursive is `true`, but keeps their FileInfos cached for Get and
+// Traverse. Frozen entries are neither updated nor reported as modified.
+// Thaw or a later Load of path watches them again and updates the cache without events.
+func (w Watcher) Freeze(path string, recursive bool) error {
+	path = filepath.Clean(path)
+	var list []*info
+	w.mutex.RLock()
+	err := w.tree.walk(path, func(fi FileInfo) error {
+		nfo := fi.(*info)
+		nfo.mutex.Lock()
+		nfo.flags |= stale
+		nfo.mutex.Unlock()
+		list = append(list, nfo)
+		if fi.IsDir() && !recursive && nfo.path != path {
+			return SkipDir
+		}
+		return nil
+	})
+	w.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	return w.unwatch(list)
+}
+
+// Thaw watches the frozen directory at `path` and its frozen direct children, or all frozen
+// descendents if recursive is `true`, again. Like Load it updates their cached FileInfos
+// with the current state, caches new files and drops deleted files without reporting
+// the changes. It does nothing if path is not frozen.
+func (w Watcher) Thaw(path string, recursive bool) error {
+	path = filepath.Clean(path)
+	w.mutex.RLock()
+	nfo := w.tree.get(path)
+	w.mutex.RUnlock()
+	if nfo == nil {
+		return &os.PathError{Op: "thaw", Path: path, Err: os.ErrNotExist}
+	}
+	if !nfo.has(stale) {
+		return nil
+	}
+	var flags uint
+	if recursive {
+		flags = recurse
+	}
+	err := w.loadImpl(path, flags, 0, w.flags, w.flags, nil)
+	if os.IsNotExist(err) {
+		w.dropStale(path)
+		return nil
+	}
+	if err == SkipDir {
+		return nil
+	}
+	return err
+}
+
+// dropStale removes the frozen entries below root that no longer exist
+// from the cache without reporting them
+func (w *watcher) dropStale(root string) {
+	var list []*info
+	w.mutex.RLock()
+	w.tree.walk(root, func(fi FileInfo) error {
+		if nfo := fi.(*info); nfo.has(stale) {
+			list = append(list, nfo)
+		}
+		return nil
+	})
+	w.mutex.RUnlock()
+	for _, nfo := range list {
+		if _, err := os.Lstat(nfo.path); !os.IsNotExist(err) {
+			continue
+		}
+		w.mutex.Lock()
+		if w.tree.get(nfo.path) == nfo {
+			w.tree.deleteAll(nfo.path, w.forget)
+		}
+		w.mutex.Unlock()
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFreeze(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	dir := env.mkdir(env.root, "dir")
+	file := env.createWriteClose(dir, "file")
+	gone := env.createWriteClose(dir, "gone")
+	env.sleep()
+	env.check()
+	w := Watcher{env.watcher}
+	err := w.Freeze(dir, true)
+	if err != nil {
+		t.Fatal("failed to freeze.", err)
+	}
+	for _, path := range w.Descriptors() {
+		if path == dir {
+			t.Error("expected frozen dir not to be watched")
+		}
+	}
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	env.writeClose(f, err)
+	created := filepath.Join(dir, "new")
+	env.writeClose(os.Create(created))
+	env.sleep()
+	env.check()
+	if fi := w.Get(file); fi == nil || fi.Size() != 12 {
+		t.Fatalf("expected frozen file with old size got %v", fi)
+	}
+	err = os.Remove(gone)
+	if err != nil {
+		t.Fatal("failed to remove.", err)
+	}
+	err = w.Load(dir, true)
+	if err != nil {
+		t.Fatal("failed to load.", err)
+	}
+	env.sleep()
+	env.check()
+	if fi := w.Get(file); fi == nil || fi.Size() != 24 {
+		t.Errorf("expected reloaded file with new size got %v", fi)
+	}
+	if w.Get(created) == nil || w.Get(gone) != nil {
+		t.Error("expected load to reconcile the frozen entries")
+	}
+	env.writeClose(os.Create(file))
+	env.expect = append(env.expect, record{Modify, file, false})
+	env.sleep()
+	env.check()
+}
+
+func TestThaw(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	dir := env.mkdir(env.root, "dir")
+	gone := env.createWriteClose(dir, "gone")
+	sub := env.mkdir(dir, "sub")
+	file := env.createWriteClose(sub, "file")
+	env.sleep()
+	env.check()
+	env.Lock()
+	env.events, env.expect = nil, nil
+	env.Unlock()
+	w := Watcher{env.watcher}
+	if err := w.Thaw(dir, true); err != nil {
+		t.Fatal("failed to thaw a watched dir.", err)
+	}
+	if err := w.Freeze(dir, true); err != nil {
+		t.Fatal("failed to freeze.", err)
+	}
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	env.writeClose(f, err)
+	created := filepath.Join(sub, "new")
+	env.writeClose(os.Create(created))
+	err = os.Remove(gone)
+	if err != nil {
+		t.Fatal("failed to remove.", err)
+	}
+	env.sleep()
+	env.check()
+	if err := w.Thaw(dir, true); err != nil {
+		t.Fatal("failed to thaw.", err)
+	}
+	env.sleep()
+	env.check()
+	watched := make(map[string]bool)
+	for _, path := range w.Descriptors() {
+		watched[path] = true
+	}
+	if !watched[dir] || !watched[sub] {
+		t.Errorf("expected thawed dirs to be watched got %v", w.Descriptors())
+	}
+	if fi := w.Get(file); fi == nil || fi.Size() != 24 {
+		t.Errorf("expected thawed file with new size got %v", fi)
+	}
+	if w.Get(created) == nil || w.Get(gone) != nil {
+		t.Error("expected thaw to reconcile the frozen entries")
+	}
+	f, err = os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	env.writeClose(f, err)
+	env.expect = append(env.expect, record{Modify, file, false})
+	env.sleep()
+	env.check()
+}
+
+func TestFreezeInfo(t *testing.T) {
+	fi := newInfo("/file", &frozen{path: "/file", size: 1})
+	// the changes wrapping a cached info are frozen as well
+	for _, c := range []FileInfo{fi, &ContentChange{FileInfo: fi}, &DirChange{FileInfo: &RenameChange{FileInfo: fi}}} {
+		got := FreezeInfo(c)
+		fi.update(&frozen{path: "/file", size: 2})
+		if _, ok := got.(*frozen); !ok || got.Size() != 1 {
+			t.Errorf("expected a frozen copy of size 1 got %v", got)
+		}
+		fi.update(&frozen{path: "/file", size: 1})
+	}
+}
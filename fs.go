@@ -0,0 +1,179 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// FS returns a read-only `fs.FS` view of the cached tree. It is rooted at the
+// loaded root if only one root is loaded when it is called. Otherwise it is rooted
+// at the file system root, where the names are the absolute slash separated paths
+// without the leading slash and only the cached files exist, so `fs.Sub` is needed
+// to walk one of the roots. Stat and ReadDir are served from the cache.
+// Reading a file opens the live file.
+func (w Watcher) FS() fs.FS {
+	var roots []string
+	w.mutex.RLock()
+	w.tree.iter(func(nfo *info) bool {
+		if w.tree.get(filepath.Dir(nfo.path)) == nil {
+			roots = append(roots, nfo.path)
+		}
+		return len(roots) < 2
+	})
+	w.mutex.RUnlock()
+	if len(roots) == 1 {
+		return cacheFS{w, roots[0]}
+	}
+	return cacheFS{w, ""}
+}
+
+// FSAt returns a read-only `fs.FS` view of the cached files at root like `FS`.
+func (w Watcher) FSAt(root string) fs.FS {
+	return cacheFS{w, filepath.Clean(root)}
+}
+
+// cacheFS implements `fs.StatFS` and `fs.ReadDirFS` backed by the watcher tree
+type cacheFS struct {
+	w Watcher
+	// root is empty for a view rooted at the file system root
+	root string
+}
+
+// path returns the file path of the valid slash separated name
+func (c cacheFS) path(name string) string {
+	if c.root != "" {
+		return filepath.Join(c.root, filepath.FromSlash(name))
+	}
+	path := filepath.FromSlash(name)
+	if !filepath.IsAbs(path) {
+		// the volume name of windows paths is part of the name
+		path = string(filepath.Separator) + path
+	}
+	return filepath.Clean(path)
+}
+
+// lookup returns the cached info for the slash separated name or an `fs.PathError`
+func (c cacheFS) lookup(op, name string) (FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	fi := c.w.Get(c.path(name))
+	if fi == nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return fi, nil
+}
+
+func (c cacheFS) Open(name string) (fs.File, error) {
+	fi, err := c.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return &cacheFile{fsys: c, name: name, info: fi}, nil
+}
+
+func (c cacheFS) Stat(name string) (fs.FileInfo, error) {
+	fi, err := c.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return fi, nil
+}
+
+func (c cacheFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	fi, err := c.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return c.readDir(fi)
+}
+
+// readDir returns the cached direct children of dir in traversal order
+func (c cacheFS) readDir(dir FileInfo) ([]fs.DirEntry, error) {
+	if !dir.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: dir.Path(), Err: ErrNotDir}
+	}
+	var list []fs.DirEntry
+	err := c.w.Traverse(dir.Path(), func(fi FileInfo) error {
+		if fi == dir {
+			return nil
+		}
+		list = append(list, fs.FileInfoToDirEntry(fi))
+		if fi.IsDir() {
+			return SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// cacheFile is a file opened from a cacheFS.
+// It opens the live file on the first read.
+type cacheFile struct {
+	fsys cacheFS
+	name string
+	info FileInfo
+	file *os.File
+	dirs []fs.DirEntry
+	read bool
+}
+
+func (f *cacheFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *cacheFile) Read(b []byte) (int, error) {
+	if f.info.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if f.file == nil {
+		file, err := os.Open(f.info.Path())
+		if err != nil {
+			return 0, err
+		}
+		f.file = file
+	}
+	return f.file.Read(b)
+}
+
+func (f *cacheFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.read {
+		list, err := f.fsys.readDir(f.info)
+		if err != nil {
+			return nil, err
+		}
+		f.dirs, f.read = list, true
+	}
+	if n <= 0 {
+		list := f.dirs
+		f.dirs = nil
+		return list, nil
+	}
+	if len(f.dirs) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.dirs) {
+		n = len(f.dirs)
+	}
+	list := f.dirs[:n]
+	f.dirs = f.dirs[n:]
+	return list, nil
+}
+
+func (f *cacheFile) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
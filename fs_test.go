@@ -0,0 +1,84 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFS(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	dir := env.mkdir(env.root, "dir")
+	env.createWriteClose(dir, "file1")
+	env.createWriteClose(env.root, "file2")
+	w := Watcher{env.watcher}
+	err := w.Load(env.root, true)
+	if err != nil {
+		t.Fatal("failed to load.", err)
+	}
+	fsys := w.FS()
+	err = fstest.TestFS(fsys, "dir", "dir/file1", "file2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := fs.ReadFile(fsys, "dir/file1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello world\n" {
+		t.Errorf("expected hello world got %q", data)
+	}
+	_, err = fs.Stat(fsys, "none")
+	if err == nil {
+		t.Error("expected not exist error")
+	}
+}
+
+func TestFSRoots(t *testing.T) {
+	env := newtestenvWith(t, &Context{})
+	defer env.close()
+	dir1 := env.mkdir(env.root, "dir1")
+	dir2 := env.mkdir(env.root, "dir2")
+	env.createWriteClose(dir1, "file1")
+	env.createWriteClose(dir2, "file2")
+	w := Watcher{env.watcher}
+	for _, dir := range []string{dir1, dir2} {
+		err := w.Load(dir, true)
+		if err != nil {
+			t.Fatal("failed to load.", err)
+		}
+	}
+	err := fstest.TestFS(w.FSAt(dir2), "file2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := w.FS()
+	name := strings.TrimPrefix(filepath.ToSlash(dir1), "/")
+	sub, err := fs.Sub(fsys, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fstest.TestFS(sub, "file1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.Stat(fsys, path.Dir(name))
+	if err == nil {
+		t.Error("expected not exist error for the parent of the roots")
+	}
+	fi, err := fs.Stat(fsys, strings.TrimPrefix(filepath.ToSlash(dir2), "/")+"/file2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Name() != "file2" {
+		t.Errorf("expected file2 got %s", fi.Name())
+	}
+}
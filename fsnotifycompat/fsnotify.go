@@ -0,0 +1,247 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package fsnotifycompat provides a watcher with the API of github.com/fsnotify/fsnotify
+// backed by fswatch.
+package fsnotifycompat
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/mb0/fswatch"
+)
+
+// Op describes a set of file operations like the fsnotify type
+type Op uint32
+
+// The operations in the order of fsnotify
+const (
+	Create Op = 1 << iota
+	Write
+	Remove
+	Rename
+	Chmod
+)
+
+var opNames = []string{"CREATE", "WRITE", "REMOVE", "RENAME", "CHMOD"}
+
+func (op Op) String() string {
+	var names []string
+	for i, name := range opNames {
+		if op&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "[no events]"
+	}
+	return strings.Join(names, "|")
+}
+
+// Event represents a file change like the fsnotify type
+type Event struct {
+	// Name is the path of the file
+	Name string
+	Op   Op
+}
+
+// Has returns whether the event has the operation op
+func (e Event) Has(op Op) bool {
+	return e.Op&op == op
+}
+
+func (e Event) String() string {
+	return fmt.Sprintf("%-13s %q", e.Op, e.Name)
+}
+
+// Watcher forwards the events of a fswatch watcher to its channels.
+// Events and Errors must be received from until Close returns.
+type Watcher struct {
+	Events chan Event
+	Errors chan error
+	w      fswatch.Watcher
+	quit   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+	err    error
+	mutex  sync.Mutex
+	// files holds the added files, they are watched in their directory
+	files map[string]bool
+	// dirs holds the added directories
+	dirs map[string]bool
+}
+
+// NewWatcher returns a new watcher without any watched paths
+func NewWatcher() (*Watcher, error) {
+	w, err := fswatch.New(&fswatch.Context{
+		// errors are received from the errors channel
+		Error: func(error) {},
+	})
+	if err != nil {
+		return nil, err
+	}
+	c := &Watcher{
+		Events: make(chan Event),
+		Errors: make(chan error),
+		w:      w,
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go c.run(w.Events(), w.Errors())
+	return c, nil
+}
+
+// Add starts watching the file or directory at name.
+// The events of a directory and its direct children are reported.
+// A file is watched in its directory and only its events are reported.
+func (w *Watcher) Add(name string) error {
+	name = filepath.Clean(name)
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		if err := w.w.Load(name, false); err != nil {
+			return err
+		}
+		w.addDir(name)
+		return nil
+	}
+	if err := w.w.WatchFile(name); err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.files == nil {
+		w.files = make(map[string]bool)
+	}
+	w.files[name] = true
+	return nil
+}
+
+// AddRecursive starts watching the directory at name and all its descendents,
+// which fsnotify does not support.
+func (w *Watcher) AddRecursive(name string) error {
+	name = filepath.Clean(name)
+	if err := w.w.Load(name, true); err != nil {
+		return err
+	}
+	w.addDir(name)
+	return nil
+}
+
+// addDir records the added directory at name
+func (w *Watcher) addDir(name string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.dirs == nil {
+		w.dirs = make(map[string]bool)
+	}
+	w.dirs[name] = true
+}
+
+// Remove stops watching the file or directory at name.
+// The directory of a file is unloaded with its last added file, unless it was added
+// itself. Removing a directory also removes the files added in it.
+func (w *Watcher) Remove(name string) error {
+	name = filepath.Clean(name)
+	w.mutex.Lock()
+	if !w.files[name] {
+		delete(w.dirs, name)
+		for file := range w.files {
+			if filepath.Dir(file) == name {
+				delete(w.files, file)
+			}
+		}
+		w.mutex.Unlock()
+		return w.w.Unload(name, false)
+	}
+	delete(w.files, name)
+	dir := filepath.Dir(name)
+	if w.dirs[dir] {
+		w.mutex.Unlock()
+		return nil
+	}
+	for file := range w.files {
+		if filepath.Dir(file) == dir {
+			w.mutex.Unlock()
+			return nil
+		}
+	}
+	w.mutex.Unlock()
+	return w.w.Unload(dir, false)
+}
+
+// WatchList returns the watched paths
+func (w *Watcher) WatchList() []string {
+	return w.w.List()
+}
+
+// Close stops the watcher and closes the channels. Only the first call has an effect.
+func (w *Watcher) Close() error {
+	w.once.Do(func() {
+		close(w.quit)
+		w.err = w.w.Close()
+		<-w.done
+	})
+	return w.err
+}
+
+// run forwards the events and errors until the channels are closed or the watcher quit
+func (w *Watcher) run(events <-chan fswatch.EventInfo, errs <-chan error) {
+	defer close(w.done)
+	defer close(w.Errors)
+	defer close(w.Events)
+	for events != nil || errs != nil {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			for _, ev := range convert(e) {
+				select {
+				case w.Events <- ev:
+				case <-w.quit:
+					return
+				}
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			select {
+			case w.Errors <- err:
+			case <-w.quit:
+				return
+			}
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+// convert returns the fsnotify events for e.
+// A rename is reported as Rename of the old path followed by Create of the new path.
+func convert(e fswatch.EventInfo) []Event {
+	path := e.Info.Path()
+	switch e.Event {
+	case fswatch.Create:
+		return []Event{{path, Create}}
+	case fswatch.Modify:
+		return []Event{{path, Write}}
+	case fswatch.Delete:
+		return []Event{{path, Remove}}
+	case fswatch.Chmod:
+		return []Event{{path, Chmod}}
+	case fswatch.Rename:
+		return []Event{{e.OldPath(), Rename}, {path, Create}}
+	}
+	return nil
+}
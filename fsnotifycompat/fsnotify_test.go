@@ -0,0 +1,167 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fsnotifycompat
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	root, err := ioutil.TempDir("", "fsnotifycompat")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(root)
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal("failed to create watcher", err)
+	}
+	defer w.Close()
+	if err := w.AddRecursive(root); err != nil {
+		t.Fatal("failed to add.", err)
+	}
+	dir := filepath.Join(root, "dir")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal("failed to mkdir.", err)
+	}
+	expect := func(name string, op Op) {
+		for {
+			select {
+			case e := <-w.Events:
+				if e.Op == Write && op != Write {
+					// writes may follow a create
+					continue
+				}
+				if e.Name != name || !e.Has(op) {
+					t.Errorf("expected %s got %s", Event{name, op}, e)
+				}
+			case err := <-w.Errors:
+				t.Fatal("unexpected error", err)
+			case <-time.After(3 * time.Second):
+				// the polling backend scans once a second
+				t.Fatalf("expected %s got nothing", Event{name, op})
+			}
+			return
+		}
+	}
+	expect(dir, Create)
+	// the new directory is watched recursively
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal("failed to create.", err)
+	}
+	expect(file, Create)
+	if err := os.Remove(file); err != nil {
+		t.Fatal("failed to remove.", err)
+	}
+	expect(file, Remove)
+	if err := w.Close(); err != nil {
+		t.Fatal("failed to close.", err)
+	}
+	if _, ok := <-w.Events; ok {
+		t.Error("expected closed events channel")
+	}
+	if err := w.Close(); err != nil {
+		t.Error("expected repeated close to succeed", err)
+	}
+}
+
+func TestAddFile(t *testing.T) {
+	root, err := ioutil.TempDir("", "fsnotifycompat")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(root)
+	file := filepath.Join(root, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal("failed to create.", err)
+	}
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal("failed to create watcher", err)
+	}
+	defer w.Close()
+	if err := w.Add(file); err != nil {
+		t.Fatal("failed to add file.", err)
+	}
+	// the siblings of the file are not reported
+	if err := ioutil.WriteFile(filepath.Join(root, "other"), nil, 0600); err != nil {
+		t.Fatal("failed to create.", err)
+	}
+	if err := ioutil.WriteFile(file, []byte("hello"), 0600); err != nil {
+		t.Fatal("failed to write.", err)
+	}
+	select {
+	case e := <-w.Events:
+		if e.Name != file || !e.Has(Write) {
+			t.Errorf("expected %s got %s", Event{file, Write}, e)
+		}
+	case err := <-w.Errors:
+		t.Fatal("unexpected error", err)
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expected %s got nothing", Event{file, Write})
+	}
+	if err := w.Remove(file); err != nil {
+		t.Error("failed to remove.", err)
+	}
+	if list := w.WatchList(); len(list) != 0 {
+		t.Errorf("expected no watches got %v", list)
+	}
+}
+
+func TestRemoveAddedDir(t *testing.T) {
+	root, err := ioutil.TempDir("", "fsnotifycompat")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(root)
+	file := filepath.Join(root, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal("failed to create.", err)
+	}
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal("failed to create watcher", err)
+	}
+	defer w.Close()
+	if err := w.Add(root); err != nil {
+		t.Fatal("failed to add dir.", err)
+	}
+	if err := w.Add(file); err != nil {
+		t.Fatal("failed to add file.", err)
+	}
+	// the added directory stays watched without its added file
+	if err := w.Remove(file); err != nil {
+		t.Error("failed to remove file.", err)
+	}
+	if list := w.WatchList(); len(list) != 1 || list[0] != root {
+		t.Errorf("expected watch of %s got %v", root, list)
+	}
+	if err := w.Add(file); err != nil {
+		t.Fatal("failed to add file.", err)
+	}
+	// the added files are removed with their directory
+	if err := w.Remove(root); err != nil {
+		t.Error("failed to remove dir.", err)
+	}
+	if list := w.WatchList(); len(list) != 0 {
+		t.Errorf("expected no watches got %v", list)
+	}
+	w.mutex.Lock()
+	if len(w.files) != 0 || len(w.dirs) != 0 {
+		t.Errorf("expected no added paths got %v and %v", w.files, w.dirs)
+	}
+	w.mutex.Unlock()
+}
+
+func TestOpString(t *testing.T) {
+	if s := (Create | Write).String(); s != "CREATE|WRITE" {
+		t.Errorf("expected CREATE|WRITE got %s", s)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package fswatchtest provides utilities to test code using fswatch.
+package fswatchtest
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mb0/fswatch"
+)
+
+// Record represents an event received by a Recorder
+type Record struct {
+	Event fswatch.Event
+	Path  string
+}
+
+func (r Record) String() string {
+	return fmt.Sprintf("%s %q", r.Event, r.Path)
+}
+
+// Recorder records the events and errors of a watcher.
+// The zero value is an empty recorder. It is safe for concurrent use.
+type Recorder struct {
+	mutex  sync.Mutex
+	events []Record
+	errors []error
+	// changed is closed by the next record and created by Wait
+	changed chan struct{}
+}
+
+// NewRecorder returns a new empty recorder
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Context returns a watcher context that records all events and errors
+func (r *Recorder) Context() *fswatch.Context {
+	return &fswatch.Context{Handle: r.Handle, Error: r.Error}
+}
+
+// Handle records an event. It can be used as `Context.Handle`.
+func (r *Recorder) Handle(e fswatch.Event, fi fswatch.FileInfo) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, Record{e, fi.Path()})
+	r.notify()
+}
+
+// Error records an error. It can be used as `Context.Error`.
+func (r *Recorder) Error(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.errors = append(r.errors, err)
+	r.notify()
+}
+
+// notify wakes up all waiting calls. It expects the mutex to be held.
+func (r *Recorder) notify() {
+	if r.changed != nil {
+		close(r.changed)
+		r.changed = nil
+	}
+}
+
+// Events returns a copy of the recorded events
+func (r *Recorder) Events() []Record {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]Record(nil), r.events...)
+}
+
+// Errors returns a copy of the recorded errors
+func (r *Recorder) Errors() []error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]error(nil), r.errors...)
+}
+
+// Reset removes all recorded events and errors
+func (r *Recorder) Reset() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events, r.errors = nil, nil
+}
+
+// Wait blocks until at least n events were recorded or the timeout expired.
+// It returns whether n events were recorded.
+func (r *Recorder) Wait(n int, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		r.mutex.Lock()
+		if len(r.events) >= n {
+			r.mutex.Unlock()
+			return true
+		}
+		if r.changed == nil {
+			r.changed = make(chan struct{})
+		}
+		changed := r.changed
+		r.mutex.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+			return false
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatchtest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mb0/fswatch"
+)
+
+func TestRecorder(t *testing.T) {
+	root, err := ioutil.TempDir("", "fswatchtest")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(root)
+	rec := NewRecorder()
+	ctx := rec.Context()
+	// scan often enough to report the change within the wait with the poll tag
+	ctx.PollInterval = 50 * time.Millisecond
+	w, err := fswatch.New(ctx)
+	if err != nil {
+		t.Fatal("failed to create watcher", err)
+	}
+	defer w.Close()
+	err = w.Load(root, true)
+	if err != nil {
+		t.Fatal("failed to load.", err)
+	}
+	dir := filepath.Join(root, "dir")
+	err = os.Mkdir(dir, 0700)
+	if err != nil {
+		t.Fatal("failed to mkdir.", err)
+	}
+	if !rec.Wait(1, time.Second) {
+		t.Fatal("expected an event")
+	}
+	events := rec.Events()
+	if events[0] != (Record{fswatch.Create, dir}) {
+		t.Errorf("expected Create %q got %s", dir, events[0])
+	}
+	if errs := rec.Errors(); len(errs) != 0 {
+		t.Errorf("unexpected errors %v", errs)
+	}
+}
+
+// pathInfo is a FileInfo that only knows its path
+type pathInfo struct {
+	fswatch.FileInfo
+	path string
+}
+
+func (p pathInfo) Path() string {
+	return p.path
+}
+
+func TestZeroRecorder(t *testing.T) {
+	var rec Recorder
+	if rec.Wait(1, 10*time.Millisecond) {
+		t.Fatal("expected no event")
+	}
+	rec.Error(os.ErrNotExist)
+	go rec.Handle(fswatch.Create, pathInfo{path: "file"})
+	if !rec.Wait(1, time.Second) {
+		t.Fatal("expected an event")
+	}
+	if events := rec.Events(); events[0] != (Record{fswatch.Create, "file"}) {
+		t.Errorf("expected Create \"file\" got %s", events[0])
+	}
+}
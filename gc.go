@@ -0,0 +1,52 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// GC removes cached files that no longer exist on disk and are not covered by a watch
+// that would report their deletion. It returns the number of removed entries.
+func (w Watcher) GC() int {
+	var list []*info
+	w.mutex.RLock()
+	w.tree.each(func(nfo *info) {
+		if !w.covered(nfo) {
+			list = append(list, nfo)
+		}
+	})
+	w.mutex.RUnlock()
+	var stale []*info
+	for _, nfo := range list {
+		if _, err := os.Lstat(nfo.path); os.IsNotExist(err) {
+			stale = append(stale, nfo)
+		}
+	}
+	var n int
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, nfo := range stale {
+		if w.tree.get(nfo.path) != nfo {
+			continue
+		}
+		w.tree.deleteAll(nfo.path, func(fi *info) {
+			w.forget(fi)
+			n++
+		})
+	}
+	return n
+}
+
+// covered returns whether nfo, its parent directory or an ancestor with a subtree watch
+// is watched. It expects the watcher mutex to be held.
+func (w *watcher) covered(nfo *info) bool {
+	if nfo.watch != nil || w.inSubtree(nfo.path) {
+		return true
+	}
+	parent := w.tree.get(filepath.Dir(nfo.path))
+	return parent != nil && parent != nfo && parent.watch != nil
+}
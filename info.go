@@ -5,6 +5,8 @@
 package fswatch
 
 import (
+	"encoding/binary"
+	"hash/fnv"
 	"os"
 	"path/filepath"
 	"sync"
@@ -14,7 +16,14 @@ import (
 const (
 	ignored = 1 << iota
 	explicit
+	initial
 	recurse
+	persisted
+	paused
+	unreadable
+	stale
+	followed
+	oneshot
 )
 
 type info struct {
@@ -24,28 +33,50 @@ type info struct {
 	mode  os.FileMode
 	modt  time.Time
 	size  int64
+	nlink uint64
+	dev   uint64
+	ino   uint64
 	flags uint
+	sys   interface{}
+	opts  *loadOptions
+	// last is the time of the last event of the file or one of its children
+	last time.Time
+	// key is the file key the info is indexed by in the tree, guarded by the tree
+	key fileKey
 }
 
 func newInfo(path string, fi os.FileInfo) *info {
-	return &info{
+	i := &info{
 		path: path,
 		mode: fi.Mode(),
 		modt: fi.ModTime(),
 		size: fi.Size(),
 	}
+	i.dev, i.ino, i.nlink = statIDs(fi)
+	return i
 }
 
+// Path returns the current path of the file. It locks the info,
+// because a rename moves the info to its new path.
 func (i *info) Path() string {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
 	return i.path
 }
 
 func (i *info) Name() string {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
 	return filepath.Base(i.path)
 }
 
+// Sys returns backend specific data about the last event or nil.
+// The linux, BSD and windows backends return the raw inotify mask, kqueue fflags
+// or windows file action as uint32.
 func (i *info) Sys() interface{} {
-	return nil
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return i.sys
 }
 
 func (i *info) Size() int64 {
@@ -72,16 +103,278 @@ func (i *info) IsDir() bool {
 	return i.mode&os.ModeDir != 0
 }
 
+// Links returns the number of hard links of the file or zero if unknown
+func (i *info) Links() uint64 {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return i.nlink
+}
+
+// FileID returns a stable identity of the file that does not change when the file
+// is renamed, or zero if unknown. It is derived from the device and inode number.
+func (i *info) FileID() uint64 {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.ino == 0 {
+		i.dev, i.ino = lazyID(i.path)
+	}
+	if i.ino == 0 {
+		return 0
+	}
+	var buf [16]byte
+	binary.LittleEndian.PutUint64(buf[:8], i.dev)
+	binary.LittleEndian.PutUint64(buf[8:], i.ino)
+	h := fnv.New64a()
+	h.Write(buf[:])
+	return h.Sum64()
+}
+
 func (i *info) Ignored() bool {
 	i.mutex.RLock()
 	defer i.mutex.RUnlock()
 	return i.flags&ignored != 0
 }
 
+func (i *info) Watched() bool {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return i.watch != nil
+}
+
+// setWatch sets the watch of i or clears it if w is nil
+func (i *info) setWatch(w *watch) {
+	i.mutex.Lock()
+	i.watch = w
+	i.mutex.Unlock()
+}
+
+// Freeze returns an immutable snapshot of the cached file information
+func (i *info) Freeze() os.FileInfo {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return &frozen{
+		path: i.path,
+		mode: i.mode,
+		modt: i.modt,
+		size: i.size,
+		sys:  i.sys,
+	}
+}
+
+func (i *info) setSys(sys interface{}) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.sys = sys
+}
+
+// move changes the path of i to path and returns a copy with the old path
+func (i *info) move(path string) *info {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	old := i.copy()
+	i.path = path
+	return old
+}
+
+// snapshot returns an unwatched copy of i
+func (i *info) snapshot() *info {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return i.copy()
+}
+
+// copy returns an unwatched copy of i. It expects the info mutex to be held.
+func (i *info) copy() *info {
+	return &info{
+		path:  i.path,
+		mode:  i.mode,
+		modt:  i.modt,
+		size:  i.size,
+		nlink: i.nlink,
+		dev:   i.dev,
+		ino:   i.ino,
+		flags: i.flags,
+		sys:   i.sys,
+	}
+}
+
 func (i *info) update(fi os.FileInfo) {
 	i.mutex.Lock()
 	defer i.mutex.Unlock()
 	i.mode = fi.Mode()
 	i.modt = fi.ModTime()
 	i.size = fi.Size()
+	i.dev, i.ino, i.nlink = statIDs(fi)
+}
+
+// touch records t as the time of the last event
+func (i *info) touch(t time.Time) {
+	i.mutex.Lock()
+	i.last = t
+	i.mutex.Unlock()
+}
+
+// has returns whether all flags are set on i
+func (i *info) has(flags uint) bool {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return i.flags&flags == flags
+}
+
+// stat returns the current state of the file at the path of i.
+// It follows the symlink of a followed link to its target directory.
+func (i *info) stat() (os.FileInfo, error) {
+	if i.has(followed) {
+		return os.Stat(i.path)
+	}
+	return os.Lstat(i.path)
+}
+
+// thaw updates the stale info i with fi and returns whether i was stale
+func (i *info) thaw(fi os.FileInfo) bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.flags&stale == 0 {
+		return false
+	}
+	i.flags &^= stale
+	i.mode = fi.Mode()
+	i.modt = fi.ModTime()
+	i.size = fi.Size()
+	i.dev, i.ino, i.nlink = statIDs(fi)
+	return true
+}
+
+// sameFile returns whether i and o are links to the same file
+func (i *info) sameFile(o *info) bool {
+	i.mutex.RLock()
+	dev, ino := i.dev, i.ino
+	i.mutex.RUnlock()
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	return ino != 0 && dev == o.dev && ino == o.ino
+}
+
+// LinkChange is the FileInfo passed with a Modify when only the number
+// of hard links of the file changed.
+type LinkChange struct {
+	FileInfo
+	// Old is the previous number of links
+	Old uint64
+}
+
+// ContentChange is the FileInfo passed with a Modify of a changed file.
+// It has the size before and after the change, so a truncation can be told
+// from an append without another stat.
+type ContentChange struct {
+	FileInfo
+	OldSize int64
+	NewSize int64
+	// OldModTime is the previous modification time
+	OldModTime time.Time
+}
+
+// RenameChange is the FileInfo passed with a Rename. It has the new path.
+type RenameChange struct {
+	FileInfo
+	old string
+}
+
+// OldPath returns the path of the file before the rename
+func (r *RenameChange) OldPath() string {
+	return r.old
+}
+
+// FreezeInfo returns an immutable snapshot of the current file information of fi.
+// A FileInfo without a Freeze method is returned as is.
+func FreezeInfo(fi FileInfo) os.FileInfo {
+	if f, ok := unwrap(fi).(interface {
+		Freeze() os.FileInfo
+	}); ok {
+		return f.Freeze()
+	}
+	return fi
+}
+
+// Links returns the number of hard links of the file fi or zero if unknown
+func Links(fi FileInfo) uint64 {
+	if l, ok := unwrap(fi).(interface {
+		Links() uint64
+	}); ok {
+		return l.Links()
+	}
+	return 0
+}
+
+// FileID returns a stable identity of the file fi across renames or zero if unknown
+func FileID(fi FileInfo) uint64 {
+	if f, ok := unwrap(fi).(interface {
+		FileID() uint64
+	}); ok {
+		return f.FileID()
+	}
+	return 0
+}
+
+// Watched returns whether the watcher holds a watch for the file fi. All backends
+// watch directories, only kqueue watches files. The changes of an unwatched file
+// are reported by the watch of its directory, see `Watcher.TraverseWatched`.
+func Watched(fi FileInfo) bool {
+	w, ok := unwrap(fi).(interface {
+		Watched() bool
+	})
+	return ok && w.Watched()
+}
+
+// unwrap returns the FileInfo wrapped by the change fi or fi itself
+func unwrap(fi FileInfo) FileInfo {
+	for {
+		switch c := fi.(type) {
+		case *LinkChange:
+			fi = c.FileInfo
+		case *ContentChange:
+			fi = c.FileInfo
+		case *RenameChange:
+			fi = c.FileInfo
+		case *DirChange:
+			fi = c.FileInfo
+		case *BulkChange:
+			fi = c.FileInfo
+		default:
+			return fi
+		}
+	}
+}
+
+// frozen is an immutable copy of an info returned by `info.Freeze`
+type frozen struct {
+	path string
+	mode os.FileMode
+	modt time.Time
+	size int64
+	sys  interface{}
+}
+
+func (f *frozen) Name() string {
+	return filepath.Base(f.path)
+}
+
+func (f *frozen) Size() int64 {
+	return f.size
+}
+
+func (f *frozen) Mode() os.FileMode {
+	return f.mode
+}
+
+func (f *frozen) ModTime() time.Time {
+	return f.modt
+}
+
+func (f *frozen) IsDir() bool {
+	return f.mode&os.ModeDir != 0
+}
+
+func (f *frozen) Sys() interface{} {
+	return f.sys
 }
@@ -0,0 +1,19 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !freebsd,!openbsd,!netbsd,!darwin,!linux,!windows
+
+package fswatch
+
+import "os"
+
+// statIDs returns zeros because the file identity is unknown on this platform
+func statIDs(fi os.FileInfo) (dev, ino, nlink uint64) {
+	return 0, 0, 0
+}
+
+// lazyID returns zeros because the file identity is unknown on this platform
+func lazyID(path string) (dev, ino uint64) {
+	return 0, 0
+}
@@ -0,0 +1,25 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build freebsd openbsd netbsd darwin linux
+
+package fswatch
+
+import (
+	"os"
+	"syscall"
+)
+
+// statIDs returns the device, inode and number of hard links from the raw stat of fi
+func statIDs(fi os.FileInfo) (dev, ino, nlink uint64) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev), uint64(st.Ino), uint64(st.Nlink)
+	}
+	return 0, 0, 0
+}
+
+// lazyID returns zeros because the identity is part of the stat
+func lazyID(path string) (dev, ino uint64) {
+	return 0, 0
+}
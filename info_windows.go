@@ -0,0 +1,37 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package fswatch
+
+import (
+	"os"
+	"syscall"
+)
+
+// statIDs returns zeros because the file identity is not part of the stat on windows
+func statIDs(fi os.FileInfo) (dev, ino, nlink uint64) {
+	return 0, 0, 0
+}
+
+// lazyID returns the volume serial number and file index of the file at path
+func lazyID(path string) (dev, ino uint64) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0
+	}
+	h, err := syscall.CreateFile(p, 0, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
+		nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS|syscall.FILE_FLAG_OPEN_REPARSE_POINT, 0)
+	if err != nil {
+		return 0, 0
+	}
+	defer syscall.CloseHandle(h)
+	var d syscall.ByHandleFileInformation
+	err = syscall.GetFileInformationByHandle(h, &d)
+	if err != nil {
+		return 0, 0
+	}
+	return uint64(d.VolumeSerialNumber), uint64(d.FileIndexHigh)<<32 | uint64(d.FileIndexLow)
+}
@@ -0,0 +1,78 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Inject updates the cache for an event at `path` from a source other than the kernel
+// and dispatches it like a kernel event. Create, Modify and Chmod stat the file, Delete removes
+// it and its descendents from the cache. The path must be cached or directly below
+// a cached directory, otherwise `ErrNotWatched` is returned.
+func (w Watcher) Inject(event Event, path string) error {
+	path = filepath.Clean(path)
+	w.mutex.RLock()
+	fi := w.tree.get(path)
+	dir := w.tree.get(filepath.Dir(path))
+	w.mutex.RUnlock()
+	if fi == nil && (dir == nil || !dir.IsDir()) {
+		return ErrNotWatched
+	}
+	switch event {
+	case Create, Modify, Chmod:
+		if fi == nil {
+			err := w.loadImpl(path, dir.flags&recurse, Create, w.flags, w.flags, nil)
+			if err == SkipDir {
+				return nil
+			}
+			return err
+		}
+		nfi, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		if event == Chmod {
+			w.chattr(fi, nfi)
+		} else {
+			w.modify(fi, nfi)
+		}
+	case Delete:
+		if fi == nil {
+			return nil
+		}
+		var list []*info
+		w.mutex.Lock()
+		w.tree.deleteAll(path, func(fi *info) {
+			w.forget(fi)
+			list = append(list, fi)
+		})
+		w.mutex.Unlock()
+		for _, fi = range list {
+			w.dispatch(Delete, fi)
+		}
+	default:
+		return fmt.Errorf("cannot inject unknown event %v", event)
+	}
+	return nil
+}
+
+// Sync reconciles the cached files at `path` with the disk after events may have been
+// missed and reports every difference as Create, Modify or Delete event. Watches are
+// added and removed like for kernel events. Descendent directories are compared if
+// path was loaded recursively. The path must be cached, otherwise `ErrNotWatched`
+// is returned.
+func (w Watcher) Sync(path string) error {
+	path = filepath.Clean(path)
+	w.mutex.RLock()
+	fi := w.tree.get(path)
+	w.mutex.RUnlock()
+	if fi == nil || fi.Ignored() {
+		return ErrNotWatched
+	}
+	return w.reconcile(fi)
+}
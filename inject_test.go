@@ -0,0 +1,100 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInject(t *testing.T) {
+	requireNative(t)
+	env := newtestenvWith(t, &Context{})
+	root, nw := env.root, env.watcher
+	defer env.close()
+	sub := filepath.Join(root, "sub")
+	err := os.Mkdir(sub, 0700)
+	if err != nil {
+		t.Fatal("failed to mkdir.", err)
+	}
+	file, other := filepath.Join(root, "file"), filepath.Join(sub, "file")
+	env.writeClose(os.Create(file))
+	env.writeClose(os.Create(other))
+	w := Watcher{nw}
+	err = w.Load(root, false)
+	if err != nil {
+		t.Fatal("failed to load.", err)
+	}
+	// sub is not watched, so the kernel does not report its children
+	for _, c := range []struct {
+		event Event
+		path  string
+	}{{Create, other}, {Modify, file}, {Delete, file}} {
+		err = w.Inject(c.event, c.path)
+		if err != nil {
+			t.Fatalf("failed to inject %s %s. %v", c.event, c.path, err)
+		}
+		env.expect = append(env.expect, record{c.event, c.path, false})
+	}
+	env.sleep()
+	env.check()
+	if w.Get(other) == nil || w.Get(file) != nil {
+		t.Error("expected injected events to update the cache")
+	}
+	err = w.Inject(Create, filepath.Join(sub, "missing"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected not exist error got %v", err)
+	}
+	err = w.Inject(Create, filepath.Join(root, "none", "file"))
+	if err != ErrNotWatched {
+		t.Errorf("expected ErrNotWatched got %v", err)
+	}
+}
+
+func TestSync(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	gone := env.createWriteClose(env.root, "gone")
+	sub := env.mkdir(env.root, "sub")
+	file := env.createWriteClose(sub, "file")
+	env.sleep()
+	env.check()
+	w := Watcher{env.watcher}
+	// drop the watches to miss the following changes
+	var dirs []*info
+	for _, path := range []string{env.root, sub} {
+		dirs = append(dirs, env.watcher.tree.get(path))
+	}
+	if err := env.watcher.unwatch(dirs); err != nil {
+		t.Fatal("failed to unwatch.", err)
+	}
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0)
+	env.writeClose(f, err)
+	if err := os.Remove(gone); err != nil {
+		t.Fatal("failed to remove.", err)
+	}
+	created := filepath.Join(sub, "new")
+	env.writeClose(os.Create(created))
+	env.sleep()
+	env.check()
+	if err := w.Sync(env.root); err != nil {
+		t.Fatal("failed to sync.", err)
+	}
+	env.expect = append(env.expect,
+		record{Delete, gone, false},
+		record{Modify, file, false},
+		record{Create, created, false},
+	)
+	env.sleep()
+	env.check()
+	// the directories are watched again
+	env.createWriteClose(sub, "other")
+	env.sleep()
+	env.check()
+	if err := w.Sync(filepath.Join(env.root, "none")); err != ErrNotWatched {
+		t.Errorf("expected ErrNotWatched got %v", err)
+	}
+}
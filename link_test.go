@@ -7,6 +7,7 @@
 package fswatch
 
 import (
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
@@ -14,6 +15,7 @@ import (
 )
 
 func TestLinks(t *testing.T) {
+	requireNative(t)
 	env := newtestenv(t)
 	defer env.close()
 
@@ -27,3 +29,172 @@ func TestLinks(t *testing.T) {
 	env.expect = []record{{Create, link, false}}
 	env.check()
 }
+
+func TestHardLinks(t *testing.T) {
+	var changes []*LinkChange
+	var env *testenv
+	env = newtestenvWith(t, &Context{
+		Handle: func(e Event, fi FileInfo) {
+			if lc, ok := fi.(*LinkChange); ok {
+				env.Lock()
+				changes = append(changes, lc)
+				env.Unlock()
+			}
+		},
+	})
+	root, w := env.root, env.watcher
+	defer env.close()
+	file := filepath.Join(root, "file")
+	env.writeClose(os.Create(file))
+	env.load(root, true)
+	nw := Watcher{w}
+	if n := Links(nw.Get(file)); n != 1 {
+		t.Fatalf("expected one link got %d", n)
+	}
+	link := filepath.Join(root, "link")
+	err := os.Link(file, link)
+	if err != nil {
+		t.Fatal("failed to link.", err)
+	}
+	env.sleep()
+	err = os.Remove(link)
+	if err != nil {
+		t.Fatal("failed to remove.", err)
+	}
+	env.sleep()
+	env.Lock()
+	defer env.Unlock()
+	if len(changes) != 2 {
+		t.Fatalf("expected two link changes for %s got %v", file, changes)
+	}
+	for i, c := range changes {
+		if c.Path() != file || c.Old != uint64(i+1) || Links(c) != 1 {
+			t.Errorf("unexpected link change %d from %d", i, c.Old)
+		}
+	}
+}
+
+func TestFileID(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	file := env.createWriteClose(env.root, "file")
+	env.sleep()
+	env.check()
+	w := Watcher{env.watcher}
+	id := FileID(w.Get(file))
+	if id == 0 {
+		t.Fatal("expected file id")
+	}
+	moved := filepath.Join(env.root, "moved")
+	err := os.Rename(file, moved)
+	if err != nil {
+		t.Fatal("failed to rename.", err)
+	}
+	if backend.ReportsRename {
+		env.expect = append(env.expect, record{Rename, moved, false})
+	} else {
+		env.expect = append(env.expect, record{Create, moved, false}, record{Delete, file, false})
+	}
+	env.sleep()
+	env.check()
+	if fi := w.Get(moved); fi == nil || FileID(fi) != id {
+		t.Errorf("expected file id %x after rename got %v", id, fi)
+	}
+	if FileID(w.Get(env.root)) == id {
+		t.Error("expected different file ids")
+	}
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	target, err := ioutil.TempDir("", "watchfs")
+	if err != nil {
+		t.Fatal("failed to setup test environment", err)
+	}
+	defer os.RemoveAll(target)
+	env := newtestenvWith(t, &Context{FollowSymlinks: true})
+	root, w := env.root, env.watcher
+	defer env.close()
+	err = os.Mkdir(filepath.Join(target, "sub"), 0700)
+	if err != nil {
+		t.Fatal("failed to mkdir.", err)
+	}
+	env.writeClose(os.Create(filepath.Join(target, "sub", "file")))
+	link, loop := filepath.Join(root, "link"), filepath.Join(root, "loop")
+	for _, l := range [][2]string{{target, link}, {root, loop}} {
+		if err := os.Symlink(l[0], l[1]); err != nil {
+			t.Fatal("failed to create symlink", err)
+		}
+	}
+	env.load(root, true)
+	nw := Watcher{w}
+	if fi := nw.Get(link); fi == nil || !fi.IsDir() {
+		t.Fatalf("expected the link cached as directory got %v", fi)
+	}
+	if nw.Get(filepath.Join(link, "sub", "file")) == nil {
+		t.Error("expected the files of the target cached below the link")
+	}
+	if fi := nw.Get(loop); fi == nil || fi.IsDir() {
+		t.Errorf("expected the link to an ancestor cached as file got %v", fi)
+	}
+	// changes of the target are reported below the link
+	env.writeClose(os.Create(filepath.Join(target, "sub", "new")))
+	newfile := filepath.Join(link, "sub", "new")
+	env.expect = []record{{Create, newfile, false}, {Modify, newfile, true}}
+	env.sleep()
+	env.check()
+	env.Lock()
+	env.events, env.expect = nil, nil
+	env.Unlock()
+	// removing the link drops the target
+	err = os.Remove(link)
+	if err != nil {
+		t.Fatal("failed to remove.", err)
+	}
+	env.sleep()
+	env.Lock()
+	if n := len(env.events); n < 4 {
+		t.Errorf("expected the link and its three files deleted got %v", env.events)
+	}
+	for _, r := range env.events {
+		if r.Event != Delete || !within(r.path, link) {
+			t.Errorf("unexpected %s", r)
+		}
+	}
+	env.events, env.expect = nil, nil
+	env.Unlock()
+	env.writeClose(os.Create(filepath.Join(target, "sub", "file")))
+	env.sleep()
+	env.check()
+	// a new link loads the target again
+	err = os.Symlink(target, link)
+	if err != nil {
+		t.Fatal("failed to create symlink", err)
+	}
+	env.sleep()
+	sub := filepath.Join(link, "sub")
+	env.expect = []record{
+		{Create, link, false},
+		{Create, sub, false},
+		{Create, filepath.Join(sub, "file"), false},
+		{Create, newfile, false},
+	}
+	env.check()
+	// a removed target leaves the dangling link
+	err = os.RemoveAll(target)
+	if err != nil {
+		t.Fatal("failed to remove.", err)
+	}
+	env.sleep()
+	env.Lock()
+	deleted, n := false, len(env.events)
+	for i := 4; i < n-1; i++ {
+		deleted = deleted || env.events[i] == record{Delete, link, false}
+	}
+	if !deleted || env.events[n-1] != (record{Create, link, false}) {
+		t.Errorf("expected the link deleted and created again got %v", env.events)
+	}
+	env.Unlock()
+	if fi := nw.Get(link); fi == nil || fi.IsDir() {
+		t.Errorf("expected the dangling link cached as file got %v", fi)
+	}
+}
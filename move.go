@@ -0,0 +1,73 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// moveWindow is the time in which the notification of a Move is expected
+var moveWindow = time.Second
+
+// selfMoves holds the new paths of the recent moves by their time
+type selfMoves struct {
+	mutex sync.Mutex
+	paths map[string]time.Time
+}
+
+// Move renames the file at oldpath to newpath and moves its cached subtree with the
+// watches, like the watcher does for a rename it was notified of. The Rename events
+// are delivered before Move returns and the notification of the rename that follows
+// is ignored. If the subtree cannot be moved, because oldpath is not cached or newpath
+// is filtered, the rename is reported when the watcher is notified.
+// A closed watcher returns `ErrClosed` and does not rename the file. Move waits for
+// the event loop and must not be called from the handlers of the watcher.
+func (w Watcher) Move(oldpath, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	var err error
+	// the run loop reads the paths of the cached files without the info lock
+	// and must not see the renamed file before its subtree was moved.
+	// Path and Name lock the info for the handlers and timers on other goroutines.
+	serr := w.serial(func() {
+		if err = os.Rename(oldpath, newpath); err == nil && w.rename(oldpath, newpath) {
+			w.expectMove(newpath)
+		}
+	})
+	if serr != nil {
+		return serr
+	}
+	return err
+}
+
+// expectMove records the new path of a move
+func (w *watcher) expectMove(path string) {
+	m := &w.moves
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := w.clock.now()
+	for p, t := range m.paths {
+		if now.Sub(t) > moveWindow {
+			delete(m.paths, p)
+		}
+	}
+	if m.paths == nil {
+		m.paths = make(map[string]time.Time)
+	}
+	m.paths[path] = now
+}
+
+// selfMoved returns whether path is the new path of a recent move and forgets it.
+// The backends call it for the notification of a rename to path.
+func (w *watcher) selfMoved(path string) bool {
+	m := &w.moves
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	t, ok := m.paths[path]
+	delete(m.paths, path)
+	return ok && w.clock.now().Sub(t) <= moveWindow
+}
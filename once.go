@@ -0,0 +1,225 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// oneShot is a watch registered by LoadOnce that delivers a single event
+type oneShot struct {
+	// dir is the watched directory and file the watched file in dir or empty
+	dir, file string
+	events    Event
+	root      *shotRoot
+}
+
+// shotRoot is a directory loaded for the one shot watches below it
+type shotRoot struct {
+	// opts are the options the directory was loaded with, nil while loading
+	opts *loadOptions
+	// shots is the number of one shot watches that did not fire yet
+	shots int
+	// cached is set if the directory was cached before, its previous
+	// options, explicit flag and watch are then restored instead of unloading it
+	cached   bool
+	prevOpts *loadOptions
+	explicit bool
+	watched  bool
+}
+
+// oneShots holds the one shot watches that did not fire yet
+type oneShots struct {
+	mutex sync.Mutex
+	list  []*oneShot
+	roots map[string]*shotRoot
+}
+
+// matches returns whether the event for the file at path fires s
+func (s *oneShot) matches(event Event, path string) bool {
+	if s.events != 0 && event&s.events == 0 {
+		return false
+	}
+	if s.file != "" {
+		return path == s.file
+	}
+	return path == s.dir || filepath.Dir(path) == s.dir
+}
+
+// LoadOnce delivers the first of events for the file or directory at `path` and then
+// removes the watch. Zero events selects any event. The directory at path is watched
+// non-recursively, a file is watched in its parent directory and may not exist yet.
+// Directories loaded by LoadOnce are watched with a kernel one shot watch where available
+// and unloaded after the event, a directory that was cached before is restored.
+// A path already reported by a loaded root is not changed.
+func (w Watcher) LoadOnce(path string, events Event) error {
+	path = filepath.Clean(path)
+	s := &oneShot{dir: path, events: events}
+	if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+		s.dir, s.file = filepath.Dir(path), path
+	}
+	w.mutex.RLock()
+	if w.reports(s.dir, s.file) {
+		w.mutex.RUnlock()
+		return nil
+	}
+	r := &shotRoot{shots: 1}
+	nfo := w.tree.get(s.dir)
+	if nfo != nil {
+		r.cached, r.prevOpts = true, nfo.opts
+		r.explicit = nfo.has(explicit)
+		r.watched = nfo.watch != nil || w.inSubtree(s.dir)
+	}
+	shots := &w.shots
+	shots.mutex.Lock()
+	if old := shots.roots[s.dir]; old != nil && nfo != nil && old.opts != nil && nfo.opts == old.opts {
+		// share the directory loaded for another one shot watch
+		old.shots++
+		s.root = old
+		shots.list = append(shots.list, s)
+		shots.mutex.Unlock()
+		w.mutex.RUnlock()
+		return nil
+	}
+	if shots.roots == nil {
+		shots.roots = make(map[string]*shotRoot)
+	}
+	s.root = r
+	shots.roots[s.dir] = r
+	shots.list = append(shots.list, s)
+	shots.mutex.Unlock()
+	w.mutex.RUnlock()
+	err := w.Load(s.dir, false, func(o *loadOptions) {
+		// no other events are reported for the directory
+		o.only = true
+		o.once = !r.cached
+	})
+	var opts *loadOptions
+	if err == nil {
+		w.mutex.RLock()
+		if nfo := w.tree.get(s.dir); nfo != nil {
+			opts = nfo.opts
+		}
+		w.mutex.RUnlock()
+	}
+	shots.mutex.Lock()
+	if err != nil {
+		shots.remove(s)
+		shots.mutex.Unlock()
+		return err
+	}
+	r.opts = opts
+	release := r.shots == 0
+	if release && shots.roots[s.dir] == r {
+		delete(shots.roots, s.dir)
+	}
+	shots.mutex.Unlock()
+	if release {
+		// the shot fired while loading
+		w.releaseShot(s.dir, r)
+	}
+	return nil
+}
+
+// remove removes the unfired shot s from the list and drops its unused root.
+// It expects the mutex to be held.
+func (o *oneShots) remove(s *oneShot) {
+	for i, other := range o.list {
+		if other == s {
+			o.list = append(o.list[:i], o.list[i+1:]...)
+			break
+		}
+	}
+	s.root.shots--
+	if s.root.shots == 0 && o.roots[s.dir] == s.root {
+		delete(o.roots, s.dir)
+	}
+}
+
+// reports returns whether the events of the file or the children of dir, if file is
+// empty, are already reported by a loaded root.
+// It expects the watcher mutex to be held.
+func (w *watcher) reports(dir, file string) bool {
+	nfo := w.tree.get(dir)
+	if nfo == nil || nfo.Ignored() || nfo.watch == nil && !w.inSubtree(dir) {
+		return false
+	}
+	opts := w.pathOptions(dir)
+	if opts == nil {
+		return true
+	}
+	if opts.only {
+		return file != "" && opts.files[file]
+	}
+	return !opts.createsOnly && !opts.oneShot && opts.events == 0
+}
+
+// fireShots delivers the event for fi once, if it fires one shot watches, and
+// releases their directories. It returns whether the event was delivered.
+func (w *watcher) fireShots(event Event, fi *info, as FileInfo, s stamp) bool {
+	shots := &w.shots
+	shots.mutex.Lock()
+	if len(shots.list) == 0 {
+		shots.mutex.Unlock()
+		return false
+	}
+	var fired []*oneShot
+	var release []*oneShot
+	for _, s := range shots.list {
+		if s.matches(event, fi.path) {
+			fired = append(fired, s)
+		}
+	}
+	for _, s := range fired {
+		loaded := s.root.opts != nil
+		shots.remove(s)
+		if loaded && s.root.shots == 0 {
+			release = append(release, s)
+		}
+	}
+	shots.mutex.Unlock()
+	if len(fired) == 0 {
+		return false
+	}
+	w.limit(event, fi, as, s)
+	for _, s := range release {
+		// unload asynchronously, because some backends unload on this goroutine
+		go w.releaseShot(s.dir, s.root)
+	}
+	return true
+}
+
+// releaseShot unloads the directory loaded for fired one shot watches or restores
+// its previous state. A directory loaded again in the meantime is not changed.
+func (w *watcher) releaseShot(dir string, r *shotRoot) {
+	w.mutex.Lock()
+	nfo := w.tree.get(dir)
+	if nfo == nil || nfo.opts != r.opts {
+		w.mutex.Unlock()
+		return
+	}
+	if !r.cached {
+		w.mutex.Unlock()
+		err := w.unload(dir, false)
+		if err != nil && err != ErrClosed {
+			w.context.Error(err)
+		}
+		return
+	}
+	nfo.opts = r.prevOpts
+	nfo.mutex.Lock()
+	if !r.explicit {
+		nfo.flags &^= explicit
+	}
+	nfo.mutex.Unlock()
+	w.mutex.Unlock()
+	if !r.watched {
+		if err := w.unwatch([]*info{nfo}); err != nil {
+			w.context.Error(err)
+		}
+	}
+}
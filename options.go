@@ -0,0 +1,359 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// LoadOption configures a root loaded with `Watcher.Load`
+type LoadOption func(*loadOptions)
+
+// loadOptions holds the options of an explicitly loaded root
+type loadOptions struct {
+	root        string
+	handler     func(Event, FileInfo)
+	syncInitial bool
+	exclude     []string
+	createsOnly bool
+	logical     bool
+	walk        func(path string, fi os.FileInfo) (watch, descend bool, err error)
+	// files holds the watched files of a root restricted to files by only
+	files   map[string]bool
+	only    bool
+	oneShot bool
+	// once selects a kernel one shot watch for a root loaded by LoadOnce
+	once bool
+	// events selects the reported events, zero reports all
+	events Event
+	// depth is the depth of the deepest watched directories plus one, zero means no limit
+	depth int
+	// fired is set atomically by the first event of a one shot root
+	fired int32
+}
+
+// newLoadOptions returns the combined options or nil
+func newLoadOptions(opts []LoadOption) *loadOptions {
+	if len(opts) == 0 {
+		return nil
+	}
+	o := new(loadOptions)
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithHandler calls handler after `Context.Handle` for events below the loaded root
+func WithHandler(handler func(Event, FileInfo)) LoadOption {
+	return func(o *loadOptions) {
+		o.handler = handler
+	}
+}
+
+// WithSyncInitial reports the files cached by Load as Create events and
+// delivers them to the handler before Load returns.
+// The initial events are not held back by CreateOnClose, Debounce, DebounceByDir,
+// Throttle, CoalesceBulk or RenameWindow.
+func WithSyncInitial() LoadOption {
+	return func(o *loadOptions) {
+		o.syncInitial = true
+	}
+}
+
+// WithExclude skips the files at paths and their descendants.
+// Relative paths are resolved against the loaded root.
+func WithExclude(paths ...string) LoadOption {
+	return func(o *loadOptions) {
+		o.exclude = append(o.exclude, paths...)
+	}
+}
+
+// WithCreatesOnly only reports the creation of direct children of the loaded root.
+// The root is loaded non-recursively and its children are not watched.
+func WithCreatesOnly() LoadOption {
+	return func(o *loadOptions) {
+		o.createsOnly = true
+	}
+}
+
+// WithOneShot delivers only the first event below the root and then unloads the root.
+// A root that is already loaded is not changed.
+func WithOneShot() LoadOption {
+	return func(o *loadOptions) {
+		o.oneShot = true
+	}
+}
+
+// fire returns true for the first event of a one shot root
+func (o *loadOptions) fire() bool {
+	return atomic.CompareAndSwapInt32(&o.fired, 0, 1)
+}
+
+// unloadShot unloads the fired one shot root
+func (w *watcher) unloadShot(root string) {
+	err := Watcher{w}.Unload(root, true)
+	if err != nil && err != ErrClosed {
+		w.context.Error(err)
+	}
+}
+
+// WithLogicalPaths follows a symlinked root and reports its files with paths
+// below the loaded root, even where the kernel reports the resolved path.
+func WithLogicalPaths() LoadOption {
+	return func(o *loadOptions) {
+		o.logical = true
+	}
+}
+
+// resolve sets the root and makes the excluded paths absolute to root
+func (o *loadOptions) resolve(root string) {
+	if o == nil {
+		return
+	}
+	o.root = root
+	for i, path := range o.exclude {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(root, path)
+		}
+		o.exclude[i] = filepath.Clean(path)
+	}
+}
+
+// excluded returns whether path is or is below an excluded path
+func (o *loadOptions) excluded(path string) bool {
+	if o == nil {
+		return false
+	}
+	if o.depth > 0 && o.below(path) > o.depth {
+		return true
+	}
+	for _, ex := range o.exclude {
+		if path == ex || len(path) > len(ex) && path[len(ex)] == os.PathSeparator && path[:len(ex)] == ex {
+			return true
+		}
+	}
+	return false
+}
+
+// unwatched returns whether the file at path must not be watched
+func (o *loadOptions) unwatched(path string) bool {
+	return o != nil && (o.createsOnly && path != o.root || o.depth > 0 && o.below(path) >= o.depth)
+}
+
+// below returns the number of path elements of path below the root
+func (o *loadOptions) below(path string) int {
+	if len(path) <= len(o.root) {
+		return 0
+	}
+	n := strings.Count(path[len(o.root):], string(os.PathSeparator))
+	if os.IsPathSeparator(o.root[len(o.root)-1]) {
+		// the file system root ends with a separator
+		n++
+	}
+	return n
+}
+
+// wanted returns whether the event for the file at path is reported
+func (o *loadOptions) wanted(event Event, path string) bool {
+	if o == nil {
+		return true
+	}
+	if o.only && !o.files[path] {
+		return false
+	}
+	if o.events != 0 && event&o.events == 0 {
+		return false
+	}
+	if !o.createsOnly {
+		return true
+	}
+	return event == Create && filepath.Dir(path) == o.root
+}
+
+// watchFile returns a load option that restricts the root to the file at path
+func watchFile(path string) LoadOption {
+	return func(o *loadOptions) {
+		o.files = map[string]bool{path: true}
+		o.only = true
+	}
+}
+
+// mergeOptions returns the options of the cached dup loaded again with opts.
+// The files of a `Watcher.WatchFile` load are added to a root restricted to files,
+// but never restrict a root or directory that already reports its files.
+// It expects the watcher mutex to be held.
+func (w *watcher) mergeOptions(dup *info, opts *loadOptions) *loadOptions {
+	if opts.oneShot && dup.has(explicit) {
+		// a loaded root is never unloaded by a one shot
+		return dup.opts
+	}
+	if !opts.only {
+		return opts
+	}
+	old := dup.opts
+	if old == nil {
+		if dup.has(explicit) || dup.watch != nil || w.inSubtree(dup.path) {
+			// the files are already reported with the options of an ancestor
+			return nil
+		}
+		return opts
+	}
+	if !old.only || len(opts.files) == 0 {
+		return old
+	}
+	// copy the options, because they are read without holding the watcher mutex
+	o := *old
+	o.files = make(map[string]bool, len(old.files)+len(opts.files))
+	for path := range old.files {
+		o.files[path] = true
+	}
+	for path := range opts.files {
+		o.files[path] = true
+	}
+	return &o
+}
+
+// widen removes the file restriction of the root at path loaded again without options
+// and replaces the one shot watch of a root loaded by LoadOnce.
+func (w *watcher) widen(path string) {
+	w.mutex.Lock()
+	nfo := w.tree.get(path)
+	if nfo == nil {
+		w.mutex.Unlock()
+		return
+	}
+	if nfo.opts != nil && nfo.opts.only {
+		nfo.opts = nil
+	}
+	nfo.mutex.Lock()
+	shot := nfo.flags&oneshot != 0
+	nfo.flags &^= oneshot
+	nfo.mutex.Unlock()
+	w.mutex.Unlock()
+	if shot {
+		w.rearm(nfo)
+	}
+}
+
+// link maps the resolved path of the root to the loaded path if they differ
+func (w *watcher) link(o *loadOptions) {
+	if o == nil || !o.logical {
+		return
+	}
+	real, err := filepath.EvalSymlinks(o.root)
+	if err != nil || real == o.root {
+		return
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.links == nil {
+		w.links = make(map[string]string)
+	}
+	w.links[real] = o.root
+}
+
+// follow returns the info of the target directory of the symlink at path with fi, if
+// `Context.FollowSymlinks` is set and the target is not yet watched. The resolved target
+// is mapped to path like a linked root, so later links into it are detected as well.
+func (w *watcher) follow(path string, fi os.FileInfo) (os.FileInfo, bool) {
+	if !w.context.FollowSymlinks || fi.Mode()&os.ModeSymlink == 0 {
+		return fi, false
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return fi, false
+	}
+	tfi, err := os.Stat(real)
+	if err != nil || !tfi.IsDir() {
+		return fi, false
+	}
+	// a link to an ancestor would be walked forever
+	if dir, err := filepath.EvalSymlinks(filepath.Dir(path)); err != nil || within(dir, real) {
+		return fi, false
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for r, l := range w.links {
+		// the link was deleted or the root unloaded
+		if w.tree.get(l) == nil {
+			delete(w.links, r)
+		}
+	}
+	if logical := w.logical(real); w.tree.get(logical) != nil || w.tree.ancestor(logical, explicit|recurse) != nil {
+		return fi, false
+	}
+	if w.links == nil {
+		w.links = make(map[string]string)
+	}
+	w.links[real] = path
+	return tfi, true
+}
+
+// unfollow loads the deleted followed link nfo again if only its target disappeared
+func (w *watcher) unfollow(nfo *info) {
+	if _, err := os.Lstat(nfo.path); err != nil {
+		return
+	}
+	w.mutex.RLock()
+	dir := w.tree.get(filepath.Dir(nfo.path))
+	w.mutex.RUnlock()
+	if dir == nil {
+		return
+	}
+	err := w.loadImpl(nfo.path, dir.flags&recurse, Create, w.flags, w.flags, nil)
+	if err != nil && err != SkipDir && !os.IsNotExist(err) {
+		w.context.Error(err)
+	}
+}
+
+// logical translates a resolved path below a linked root to the loaded path.
+// It expects the watcher mutex to be held.
+func (w *watcher) logical(path string) string {
+	for real, root := range w.links {
+		if path == real {
+			return root
+		}
+		if len(path) > len(real) && path[len(real)] == os.PathSeparator && path[:len(real)] == real {
+			return root + path[len(real):]
+		}
+	}
+	return path
+}
+
+// rootOptions returns the options of fi or its nearest loaded root or nil
+func (w *watcher) rootOptions(fi FileInfo) *loadOptions {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	if !w.scoped {
+		return nil
+	}
+	if nfo, ok := unwrap(fi).(*info); ok && (nfo.opts != nil || nfo.has(explicit)) {
+		return nfo.opts
+	}
+	return w.pathOptions(filepath.Dir(fi.Path()))
+}
+
+// pathOptions returns the options of the nearest loaded root at or above path or nil.
+// A nested root loaded without options shadows the options of an outer root.
+// It expects the watcher mutex to be held.
+func (w *watcher) pathOptions(path string) *loadOptions {
+	if !w.scoped {
+		return nil
+	}
+	for {
+		if nfo := w.tree.get(path); nfo != nil && (nfo.opts != nil || nfo.has(explicit)) {
+			return nfo.opts
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return nil
+		}
+		path = parent
+	}
+}
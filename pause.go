@@ -0,0 +1,120 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"path/filepath"
+)
+
+// PauseRoot suspends event delivery for the explicitly loaded root at `path` and its descendents.
+// The cache is kept up to date while paused. Other roots are not affected.
+func (w Watcher) PauseRoot(path string) {
+	path = filepath.Clean(path)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	nfo := w.tree.get(path)
+	if nfo == nil {
+		return
+	}
+	nfo.mutex.Lock()
+	if nfo.flags&explicit == 0 || nfo.flags&paused != 0 {
+		nfo.mutex.Unlock()
+		return
+	}
+	nfo.flags |= paused
+	nfo.mutex.Unlock()
+	var list []*info
+	w.tree.walk(path, func(fi FileInfo) error {
+		list = append(list, fi.(*info).snapshot())
+		return nil
+	})
+	if w.paused == nil {
+		w.paused = make(map[string][]*info)
+	}
+	w.paused[path] = list
+}
+
+// ResumeRoot resumes event delivery for the root at `path` paused with `PauseRoot`.
+// It resyncs the root by reporting the differences between the cache at the time
+// of the pause and now as Create, Modify, Chmod and Delete events.
+func (w Watcher) ResumeRoot(path string) {
+	path = filepath.Clean(path)
+	w.mutex.Lock()
+	old, ok := w.paused[path]
+	if !ok {
+		w.mutex.Unlock()
+		return
+	}
+	delete(w.paused, path)
+	if nfo := w.tree.get(path); nfo != nil {
+		nfo.mutex.Lock()
+		nfo.flags &^= paused
+		nfo.mutex.Unlock()
+	}
+	var list []*info
+	w.tree.walk(path, func(fi FileInfo) error {
+		list = append(list, fi.(*info))
+		return nil
+	})
+	w.mutex.Unlock()
+	w.resync(old, list)
+}
+
+// resync dispatches the events that change the old list of infos to the current list
+func (w *watcher) resync(old, list []*info) {
+	prev := make(map[string]*info, len(old))
+	for _, fi := range old {
+		prev[fi.path] = fi
+	}
+	for _, fi := range list {
+		o := prev[fi.path]
+		delete(prev, fi.path)
+		if o == nil {
+			w.dispatch(Create, fi)
+			continue
+		}
+		if w.changed(o, fi) {
+			w.dispatch(changeEvent(o, fi.Freeze(), false), fi)
+		}
+	}
+	for _, fi := range old {
+		if prev[fi.path] != nil {
+			w.dispatch(Delete, fi)
+		}
+	}
+}
+
+// changed returns whether cur changed since old, using `Context.ModifyPredicate` if set
+func (w *watcher) changed(old, cur *info) bool {
+	nfi := cur.Freeze()
+	if pred := w.context.ModifyPredicate; pred != nil {
+		return pred(old.Freeze(), nfi)
+	}
+	return !old.modt.Equal(nfi.ModTime()) || old.size != nfi.Size() || old.mode != nfi.Mode()
+}
+
+// unpause forgets the snapshots of the paused roots at or below path that were unloaded
+func (w *watcher) unpause(path string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for root := range w.paused {
+		if !within(root, path) {
+			continue
+		}
+		if nfo := w.tree.get(root); nfo == nil || !nfo.has(explicit|paused) {
+			delete(w.paused, root)
+		}
+	}
+}
+
+// pausedAt returns whether delivery for path is suspended by a paused root
+func (w *watcher) pausedAt(path string) bool {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	if len(w.paused) == 0 {
+		return false
+	}
+	return w.tree.ancestor(path, explicit|paused) != nil
+}
@@ -0,0 +1,160 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// pendingRoot holds the load flags and options of a missing root
+type pendingRoot struct {
+	flags uint
+	opts  *loadOptions
+}
+
+// persistRoot registers the missing root at path and watches its nearest existing
+// ancestor until the root is created. Events for files that are only watched
+// because of a persisted ancestor are not delivered.
+func (w *watcher) persistRoot(path string, recursive bool, opts *loadOptions) error {
+	flags := uint(explicit)
+	if recursive {
+		flags |= recurse
+	}
+	anc := path
+	for {
+		parent := filepath.Dir(anc)
+		if parent == anc {
+			return &os.PathError{Op: "load", Path: path, Err: os.ErrNotExist}
+		}
+		anc = parent
+		fi, err := os.Lstat(anc)
+		if err == nil {
+			if !fi.IsDir() {
+				return ErrNotDir
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	w.mutex.Lock()
+	if w.pending == nil {
+		w.pending = make(map[string]pendingRoot)
+	}
+	w.pending[path] = pendingRoot{flags, opts}
+	watched := w.tree.get(anc) != nil
+	w.mutex.Unlock()
+	if !watched {
+		err := w.load(anc, false, nil)
+		if err != nil {
+			return err
+		}
+		w.mutex.Lock()
+		if nfo := w.tree.get(anc); nfo != nil {
+			nfo.mutex.Lock()
+			if nfo.flags&persisted == 0 {
+				nfo.flags |= persisted
+				w.persist++
+			}
+			nfo.mutex.Unlock()
+		}
+		w.mutex.Unlock()
+	}
+	// the root may have been created in the meantime
+	if _, err := os.Lstat(path); err == nil {
+		w.mutex.Lock()
+		delete(w.pending, path)
+		w.mutex.Unlock()
+		return w.load(path, recursive, opts)
+	}
+	return nil
+}
+
+// unpersist marks an explicitly loaded path as no longer only persisted
+func (w *watcher) unpersist(path string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.persist == 0 {
+		return
+	}
+	if nfo := w.tree.get(path); nfo != nil {
+		nfo.mutex.Lock()
+		if nfo.flags&persisted != 0 {
+			nfo.flags &^= persisted
+			w.persist--
+		}
+		nfo.mutex.Unlock()
+	}
+}
+
+// releasePersisted unloads the ancestors that were only loaded for pending roots
+// and have no pending root below them anymore
+func (w *watcher) releasePersisted() {
+	var list []string
+	w.mutex.Lock()
+	if w.persist > 0 {
+		w.tree.each(func(nfo *info) {
+			if !nfo.has(persisted) {
+				return
+			}
+			for path := range w.pending {
+				if within(path, nfo.path) {
+					return
+				}
+			}
+			nfo.mutex.Lock()
+			nfo.flags &^= persisted
+			nfo.mutex.Unlock()
+			w.persist--
+			list = append(list, nfo.path)
+		})
+	}
+	w.mutex.Unlock()
+	for _, path := range list {
+		if err := w.unload(path, false); err != nil && err != ErrClosed {
+			w.context.Error(err)
+		}
+	}
+}
+
+// persistOnly returns whether the nearest explicitly loaded ancestor of path
+// is only watched for a pending root. It expects the watcher mutex to be held.
+func (w *watcher) persistOnly(path string) bool {
+	nfo := w.tree.ancestor(path, explicit)
+	if nfo == nil {
+		return false
+	}
+	nfo.mutex.RLock()
+	defer nfo.mutex.RUnlock()
+	return nfo.flags&persisted != 0
+}
+
+// dispatchPersist completes pending roots and drops events for files
+// that are only watched for pending roots. It returns whether the event was handled.
+func (w *watcher) dispatchPersist(event Event, fi *info, s stamp) bool {
+	w.mutex.Lock()
+	if len(w.pending) == 0 && w.persist == 0 {
+		w.mutex.Unlock()
+		return false
+	}
+	root, pending := w.pending[fi.path]
+	pending = pending && (event == Create || event == Rename)
+	if pending {
+		delete(w.pending, fi.path)
+	}
+	drop := w.persistOnly(fi.path)
+	w.mutex.Unlock()
+	if pending {
+		w.deliver(Create, fi, s)
+		err := w.loadImpl(fi.path, root.flags, Create, w.flags, w.flags, root.opts)
+		if err != nil && err != SkipDir {
+			w.context.Error(err)
+		}
+		return true
+	}
+	return drop
+}
@@ -0,0 +1,103 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import "sync"
+
+// pipe queues events for a single consumer goroutine
+type pipe struct {
+	mutex sync.Mutex
+	queue []EventInfo
+	limit int
+	// full is whether events were dropped since the consumer last caught up
+	full bool
+	wake chan struct{}
+}
+
+// push appends an event to the queue and returns false if the queue is full.
+// The first dropped event of an overflow also returns first as true.
+func (p *pipe) push(e EventInfo) (ok, first bool) {
+	p.mutex.Lock()
+	if p.limit > 0 && len(p.queue) >= p.limit {
+		first = !p.full
+		p.full = true
+		p.mutex.Unlock()
+		return false, first
+	}
+	p.queue = append(p.queue, e)
+	p.mutex.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	return true, false
+}
+
+// take removes and returns all queued events
+func (p *pipe) take() []EventInfo {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	list := p.queue
+	p.queue = nil
+	return list
+}
+
+// caughtUp ends an overflow once the consumer delivered all queued events
+func (p *pipe) caughtUp() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.queue) == 0 {
+		p.full = false
+	}
+}
+
+// pipe returns a new pipe limited by `Context.PipeLimit` and the id of its listener,
+// which queues the events and reports the overflows
+func (w *watcher) pipe() (*pipe, int) {
+	p := &pipe{limit: w.context.PipeLimit, wake: make(chan struct{}, 1)}
+	id := w.listen(func(e EventInfo) {
+		if ok, first := p.push(e); !ok {
+			w.stats.dropped()
+			if first {
+				w.context.Error(ErrPipeFull)
+			}
+		}
+	})
+	return p, id
+}
+
+// Pipe calls fn for every event from a single goroutine in the order the events were dispatched.
+// Events are queued so that a slow fn does not block the watcher. If `Context.PipeLimit` is
+// reached further events are dropped and counted in `Stats.Dropped`, and `ErrPipeFull` is
+// passed to `Context.Error` once until fn caught up with the queued events.
+// The pipe runs until the watcher is closed or the returned stop function is called.
+func (w Watcher) Pipe(fn func(Event, FileInfo)) (stop func()) {
+	p, id := w.pipe()
+	quit := make(chan struct{})
+	go func() {
+		defer w.unlisten(id)
+		for {
+			select {
+			case <-p.wake:
+			case <-w.done:
+				// deliver the remaining events
+				for _, e := range p.take() {
+					fn(e.Event, e.Info)
+				}
+				return
+			case <-quit:
+				return
+			}
+			for _, e := range p.take() {
+				fn(e.Event, e.Info)
+			}
+			p.caughtUp()
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(quit) })
+	}
+}
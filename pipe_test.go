@@ -0,0 +1,89 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPipe(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	var mutex sync.Mutex
+	var piped []record
+	stop := Watcher{env.watcher}.Pipe(func(e Event, fi FileInfo) {
+		// a slow consumer must not block the watcher
+		time.Sleep(time.Millisecond)
+		mutex.Lock()
+		defer mutex.Unlock()
+		piped = append(piped, record{e, fi.Path(), false})
+	})
+	defer stop()
+	dir := env.mkdir(env.root, "dir")
+	env.sleep()
+	for _, name := range []string{"a", "b", "c"} {
+		env.createWriteClose(dir, name)
+	}
+	time.Sleep(2 * waitfor)
+	env.check()
+	env.Lock()
+	defer env.Unlock()
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(piped) != len(env.events) {
+		t.Fatalf("expected %d piped events got %d", len(env.events), len(piped))
+	}
+	for i, r := range env.events {
+		if piped[i] != r {
+			t.Errorf("expected %s got %s", r, piped[i])
+		}
+	}
+	if len(piped) > 0 && piped[0].path != dir {
+		t.Errorf("expected the dir first got %s", piped[0])
+	}
+}
+
+func TestPipeFull(t *testing.T) {
+	env := newtestenvWith(t, &Context{PipeLimit: 1})
+	root, w := env.root, env.watcher
+	defer env.close()
+	env.load(root, true)
+	release := make(chan struct{})
+	stop := Watcher{w}.Pipe(func(e Event, fi FileInfo) {
+		<-release
+	})
+	defer stop()
+	for _, name := range []string{"a", "b", "c", "d"} {
+		env.createWriteClose(root, name)
+	}
+	// the consumer is released once all files were reported
+	env.waitUntil(func() bool {
+		env.Lock()
+		defer env.Unlock()
+		creates := 0
+		for _, r := range env.events {
+			if r.Event == Create {
+				creates++
+			}
+		}
+		return creates == 4
+	})
+	close(release)
+	env.sleep()
+	env.Lock()
+	errs := env.errors
+	env.errors = nil
+	env.Unlock()
+	// an overflow is reported once and the dropped events are counted
+	if len(errs) != 1 || errs[0] != ErrPipeFull {
+		t.Errorf("expected one pipe full error got %v", errs)
+	}
+	if stats := (Watcher{w}).Stats(); stats.Dropped == 0 {
+		t.Error("expected dropped events")
+	}
+	env.check()
+}
@@ -0,0 +1,140 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// quietEvent is an event held back until its file did not change for `Context.Debounce`
+type quietEvent struct {
+	heldEvent
+	timer timer
+}
+
+// quieting holds the events waiting for their file to settle by path
+type quieting struct {
+	mutex   sync.Mutex
+	pending map[string]*quietEvent
+	// nanos is the debounce window and accessed atomically
+	nanos int64
+}
+
+func (q *quieting) window() time.Duration {
+	return time.Duration(atomic.LoadInt64(&q.nanos))
+}
+
+func (q *quieting) setWindow(t time.Duration) {
+	atomic.StoreInt64(&q.nanos, int64(t))
+}
+
+// SetDebounce changes the window of `Context.Debounce` at runtime.
+// Held events adopt the new window with their next Modify, later ones use it from
+// the start. Zero disables the debouncing and delivers the held events right away.
+// `Context.DebounceByDir` is changed by SetDebounceByDir.
+func (w Watcher) SetDebounce(d time.Duration) {
+	q := &w.quieting
+	q.setWindow(d)
+	if d > 0 {
+		return
+	}
+	q.mutex.Lock()
+	held := make(map[string]*quietEvent, len(q.pending))
+	paths := make([]string, 0, len(q.pending))
+	for path, e := range q.pending {
+		held[path] = e
+		paths = append(paths, path)
+	}
+	q.mutex.Unlock()
+	sort.Slice(paths, func(i, j int) bool {
+		return held[paths[i]].stamp.seq < held[paths[j]].stamp.seq
+	})
+	for _, path := range paths {
+		w.unquiet(path, held[path])
+	}
+}
+
+// quiet holds back the Create or Modify of a file until no Modify followed within
+// `Context.Debounce`. Later Modify events of the file restart the window and are
+// absorbed by the held event. Other events of the file deliver the held event first.
+// It returns whether the event was held back.
+func (w *watcher) quiet(event Event, fi *info, as FileInfo, s stamp) bool {
+	q := &w.quieting
+	q.mutex.Lock()
+	e := q.pending[fi.path]
+	switch {
+	case e != nil && e.info == fi && event == Modify:
+		e.timer.Reset(q.window())
+		if e.event == Modify {
+			e.as = absorb(e.as, as)
+		}
+		q.mutex.Unlock()
+		return true
+	case e == nil && (event == Create || event == Modify) && !fi.IsDir():
+		if q.pending == nil {
+			q.pending = make(map[string]*quietEvent)
+		}
+		e = &quietEvent{heldEvent: heldEvent{event, fi, as, s}}
+		path := fi.path
+		e.timer = w.afterFunc(q.window(), func() {
+			w.unquiet(path, e)
+		})
+		q.pending[path] = e
+		q.mutex.Unlock()
+		return true
+	}
+	q.mutex.Unlock()
+	if e == nil {
+		return false
+	}
+	w.unquiet(fi.path, e)
+	return w.quiet(event, fi, as, s)
+}
+
+// absorb returns the FileInfo of a Modify that replaces the held Modify with held.
+// A content change keeps the old size and time of the held change.
+func absorb(held, as FileInfo) FileInfo {
+	h, ok := held.(*ContentChange)
+	c, ok2 := as.(*ContentChange)
+	if !ok || !ok2 {
+		return as
+	}
+	return &ContentChange{c.FileInfo, h.OldSize, c.NewSize, h.OldModTime}
+}
+
+// unhold drops the held events of the files for which gone returns true
+func (w *watcher) unhold(gone func(fi *info) bool) {
+	w.dropChains(gone)
+	q := &w.quieting
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for path, e := range q.pending {
+		if gone(e.info) {
+			e.timer.Stop()
+			delete(q.pending, path)
+		}
+	}
+}
+
+// unquiet updates the file of the held event e with its final state and delivers e
+func (w *watcher) unquiet(path string, e *quietEvent) {
+	q := &w.quieting
+	q.mutex.Lock()
+	if q.pending[path] != e {
+		q.mutex.Unlock()
+		return
+	}
+	delete(q.pending, path)
+	q.mutex.Unlock()
+	e.timer.Stop()
+	if nfi, err := os.Lstat(path); err == nil && w.cached(e.info) && !e.info.has(stale) {
+		e.info.update(nfi)
+	}
+	w.limit(e.event, e.info, e.as, e.stamp)
+}
@@ -0,0 +1,130 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDebounce(t *testing.T) {
+	env := newtestenvWith(t, &Context{Debounce: 4 * waitfor})
+	root, w := env.root, env.watcher
+	defer env.close()
+	env.load(root, true)
+	file := filepath.Join(root, "file")
+	env.writeClose(os.Create(file))
+	appendFile := func() {
+		for i := 0; i < 5; i++ {
+			f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+			env.writeClose(f, err)
+		}
+	}
+	appendFile()
+	env.sleep()
+	// nothing is delivered while the file changes
+	env.check()
+	time.Sleep(5 * waitfor)
+	// the create absorbs the modify events
+	env.expect = append(env.expect, record{Create, file, false})
+	env.check()
+	appendFile()
+	time.Sleep(6 * waitfor)
+	env.expect = append(env.expect, record{Modify, file, false})
+	env.check()
+	if fi := (Watcher{w}).Get(file); fi == nil || fi.Size() != 11*12 {
+		t.Errorf("expected the final size in the cache got %v", fi)
+	}
+	// a delete delivers the held event first
+	appendFile()
+	env.sleep()
+	env.expect = append(env.expect, record{Modify, file, false})
+	env.remove(file)
+	env.sleep()
+	env.check()
+}
+
+func TestUnloadQuiet(t *testing.T) {
+	env := newtestenvWith(t, &Context{Debounce: 4 * waitfor})
+	root, w := env.root, env.watcher
+	defer env.close()
+	env.load(root, true)
+	file := filepath.Join(root, "file")
+	env.writeClose(os.Create(file))
+	env.sleep()
+	if err := (Watcher{w}).UnloadQuiet(root, true); err != nil {
+		t.Fatal("failed to unload", err)
+	}
+	time.Sleep(5 * waitfor)
+	// the held create of the unloaded file is dropped
+	env.check()
+	if fi := (Watcher{w}).Get(file); fi != nil {
+		t.Errorf("expected no cached file got %v", fi)
+	}
+}
+
+func TestUnloadDropsHeld(t *testing.T) {
+	env := newtestenvWith(t, &Context{Debounce: 4 * waitfor})
+	root, w := env.root, env.watcher
+	defer env.close()
+	env.load(root, true)
+	env.writeClose(os.Create(filepath.Join(root, "file")))
+	env.sleep()
+	if err := (Watcher{w}).Unload(root, true); err != nil {
+		t.Fatal("failed to unload", err)
+	}
+	time.Sleep(5 * waitfor)
+	// the held create of the unloaded file is dropped
+	env.check()
+}
+
+func TestCloseDropsHeld(t *testing.T) {
+	env := newtestenvWith(t, &Context{Debounce: 4 * waitfor})
+	root, w := env.root, env.watcher
+	defer env.close()
+	env.load(root, true)
+	env.writeClose(os.Create(filepath.Join(root, "file")))
+	env.sleep()
+	if err := (Watcher{w}).Close(); err != nil {
+		t.Fatal("failed to close", err)
+	}
+	time.Sleep(5 * waitfor)
+	// no held event is delivered after close
+	env.check()
+}
+
+func TestSetDebounce(t *testing.T) {
+	env := newtestenvWith(t, &Context{Debounce: time.Hour})
+	w := Watcher{env.watcher}
+	defer env.close()
+	env.load(env.root, true)
+	w.SetDebounce(2 * waitfor)
+	if d := w.EffectiveContext().Debounce; d != 2*waitfor {
+		t.Errorf("expected window %v got %v", 2*waitfor, d)
+	}
+	create := func(name string) string {
+		path := filepath.Join(env.root, name)
+		env.writeClose(os.Create(path))
+		env.sleep()
+		return path
+	}
+	a := create("a")
+	env.check()
+	time.Sleep(4 * waitfor)
+	env.expect = []record{{Create, a, false}}
+	env.check()
+	w.SetDebounce(time.Hour)
+	b := create("b")
+	env.check()
+	// disabling delivers the held event right away
+	w.SetDebounce(0)
+	env.expect = append(env.expect, record{Create, b, false})
+	env.check()
+	c := create("c")
+	env.expect = append(env.expect, record{Create, c, false}, record{Modify, c, true})
+	env.check()
+}
@@ -0,0 +1,65 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Reload removes the watches at `path` and its descendents and adds them again,
+// keeping the cached entries. It helps when watches silently stopped reporting,
+// like on network file systems. Changes missed by the old watches are then reported
+// like by Sync. The path must be cached, otherwise `ErrNotWatched` is returned.
+func (w Watcher) Reload(path string) error {
+	if w.Closed() {
+		return ErrClosed
+	}
+	path = filepath.Clean(path)
+	var list []*info
+	w.mutex.RLock()
+	nfo := w.tree.get(path)
+	if nfo != nil && !nfo.Ignored() {
+		w.tree.walk(path, func(fi FileInfo) error {
+			if fi := fi.(*info); fi.watch != nil {
+				list = append(list, fi)
+			}
+			return nil
+		})
+	}
+	w.mutex.RUnlock()
+	if nfo == nil || nfo.Ignored() {
+		return ErrNotWatched
+	}
+	var errs LoadErrors
+	// removing a broken watch may fail, it is replaced anyway
+	if err := w.unwatch(list); err != nil {
+		errs = append(errs, &LoadError{path, err})
+	}
+	// watch again before comparing, so that no change falls in between
+	for _, fi := range list {
+		var err error
+		w.mutex.Lock()
+		if w.tree.get(fi.path) == fi && fi.watch == nil {
+			err = w.add(fi, w.flags)
+		}
+		w.mutex.Unlock()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, &LoadError{fi.path, err})
+		}
+	}
+	if err := w.reconcile(nfo); err != nil {
+		if list, ok := err.(LoadErrors); ok {
+			errs = append(errs, list...)
+		} else {
+			errs = append(errs, &LoadError{path, err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// retryBackoff is the delay before the first retry. It doubles with every retry.
+var retryBackoff = 10 * time.Millisecond
+
+// LoadError describes a file that could not be watched or a directory that could not be read
+type LoadError struct {
+	Path string
+	Err  error
+}
+
+func (e *LoadError) Error() string {
+	err := e.Err
+	if we, ok := err.(*WatchError); ok && we.Path == e.Path {
+		err = we.Err
+	}
+	return fmt.Sprintf("cannot watch %s: %v", e.Path, err)
+}
+
+// Unwrap returns the cause of the error
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// LoadErrors holds the files that could not be watched or read. Load passes them to
+// `Context.Error` one by one, NewWith and Reload return them.
+// Changes to these files are not reported.
+type LoadErrors []*LoadError
+
+func (e LoadErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", e[0].Error(), len(e)-1)
+}
+
+// retryInterval is the time between the attempts to load lost roots
+// if `Context.RetryInterval` is zero
+var retryInterval = time.Second
+
+// lostRoots holds the deleted roots that are loaded again once they exist
+type lostRoots struct {
+	mutex   sync.Mutex
+	roots   map[string]pendingRoot
+	running bool
+}
+
+// lose remembers the deleted root fi and starts the retry loop if needed
+func (w *watcher) lose(fi *info) {
+	fi.mutex.RLock()
+	root := pendingRoot{fi.flags & (explicit | recurse), fi.opts}
+	fi.mutex.RUnlock()
+	l := &w.lost
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.roots == nil {
+		l.roots = make(map[string]pendingRoot)
+	}
+	l.roots[fi.path] = root
+	if !l.running {
+		l.running = true
+		go w.retryLost()
+	}
+}
+
+// found forgets the lost root at path and returns whether it was lost
+func (w *watcher) found(path string) (pendingRoot, bool) {
+	l := &w.lost
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	root, ok := l.roots[path]
+	delete(l.roots, path)
+	return root, ok
+}
+
+// retryLost loads the lost roots that exist again every interval
+// until none are left or the watcher is closed
+func (w *watcher) retryLost() {
+	interval := w.context.RetryInterval
+	if interval <= 0 {
+		interval = retryInterval
+	}
+	ticker := w.newTicker(interval)
+	defer w.stopTicker(ticker)
+	l := &w.lost
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+		l.mutex.Lock()
+		paths := make([]string, 0, len(l.roots))
+		for path := range l.roots {
+			paths = append(paths, path)
+		}
+		l.mutex.Unlock()
+		for _, path := range paths {
+			if _, err := os.Lstat(path); err != nil {
+				continue
+			}
+			root, ok := w.found(path)
+			if ok {
+				w.reloadLost(path, root)
+			}
+		}
+		l.mutex.Lock()
+		if len(l.roots) == 0 {
+			l.running = false
+			l.mutex.Unlock()
+			return
+		}
+		l.mutex.Unlock()
+	}
+}
+
+// reloadLost loads the lost root at path again and reports it and its files as Create
+func (w *watcher) reloadLost(path string, root pendingRoot) {
+	err := w.load(path, root.flags&recurse != 0, root.opts)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// gone again before it could be loaded
+			w.lost.mutex.Lock()
+			w.lost.roots[path] = root
+			w.lost.mutex.Unlock()
+		} else if err != ErrClosed {
+			w.context.Error(err)
+		}
+		if _, ok := err.(LoadErrors); !ok {
+			return
+		}
+	}
+	if w.context.initialEvent(root.opts) == Create {
+		// load reported the files already
+		return
+	}
+	var list []*info
+	w.mutex.RLock()
+	w.tree.walk(path, func(fi FileInfo) error {
+		if !fi.Ignored() {
+			list = append(list, fi.(*info))
+		}
+		return nil
+	})
+	w.mutex.RUnlock()
+	for _, fi := range list {
+		w.dispatch(Create, fi)
+	}
+}
+
+// failedAdd is a watch that failed to be added during load
+type failedAdd struct {
+	info  *info
+	flags uint32
+	err   error
+}
+
+// retryAdds schedules the failed watches to be retried up to `Context.AddRetries` times
+// and returns the failures that are not retried. Watches that failed because of the
+// watch limit are not retried.
+func (w *watcher) retryAdds(failed []failedAdd) LoadErrors {
+	var errs LoadErrors
+	var retry []failedAdd
+	for _, f := range failed {
+		if f.err == ErrWatchLimit || w.context.AddRetries <= 0 {
+			errs = append(errs, &LoadError{f.info.path, f.err})
+		} else {
+			retry = append(retry, f)
+		}
+	}
+	if len(retry) > 0 {
+		w.scheduleAdds(retry, 1, retryBackoff)
+	}
+	return errs
+}
+
+// scheduleAdds retries the failed watches on the run loop after backoff, doubling the
+// backoff for the next attempt. Files that vanished or were watched in the meantime are
+// skipped. The failures of the last attempt are passed to `Context.Error` as `*LoadError`.
+func (w *watcher) scheduleAdds(failed []failedAdd, attempt int, backoff time.Duration) {
+	w.clock.afterFunc(backoff, func() {
+		var retry []failedAdd
+		err := w.serial(func() {
+			for _, f := range failed {
+				w.mutex.Lock()
+				if w.tree.get(f.info.path) != f.info || f.info.watch != nil {
+					w.mutex.Unlock()
+					continue
+				}
+				err := w.addTimed(f.info, f.flags)
+				w.mutex.Unlock()
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					f.err = err
+					retry = append(retry, f)
+				}
+			}
+		})
+		if err != nil || len(retry) == 0 {
+			return
+		}
+		if attempt < w.context.AddRetries {
+			w.scheduleAdds(retry, attempt+1, 2*backoff)
+			return
+		}
+		for _, f := range retry {
+			w.context.Error(&LoadError{f.info.path, f.err})
+		}
+	})
+}
@@ -0,0 +1,133 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// settleTime is the time without changes after which a held Create is delivered
+// when `Context.CreateOnClose` is set and the backend does not report the close.
+var settleTime = 100 * time.Millisecond
+
+// settling holds the timers of the new files whose Create is held back.
+// Files held until their close is reported have a nil timer.
+type settling struct {
+	mutex  sync.Mutex
+	timers map[*info]timer
+	// stamps holds the stamps of the held Creates
+	stamps map[*info]stamp
+	// opened holds the paths of the files created by an open, whose close is reported
+	opened map[string]bool
+}
+
+// open marks the new file at path as created by an open while its Create is dispatched
+func (s *settling) open(path string, opened bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !opened {
+		delete(s.opened, path)
+		return
+	}
+	if s.opened == nil {
+		s.opened = make(map[string]bool)
+	}
+	s.opened[path] = true
+}
+
+// settles holds back the Create of a new file and drops the Delete of a file
+// whose Create was held back. It returns whether the event was handled.
+func (w *watcher) settles(event Event, fi *info, at stamp) bool {
+	switch {
+	case event == Create && !fi.IsDir():
+		s := &w.settle
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.timers == nil {
+			s.timers = make(map[*info]timer)
+			s.stamps = make(map[*info]stamp)
+		}
+		if backend.ReportsClose {
+			// links and files moved in are not closed after the create
+			if !s.opened[fi.path] || !fi.Mode().IsRegular() || fi.Links() > 1 {
+				return false
+			}
+			s.timers[fi], s.stamps[fi] = nil, at
+			return true
+		}
+		if _, ok := s.timers[fi]; !ok {
+			s.stamps[fi] = at
+			s.timers[fi] = w.afterFunc(settleTime, func() {
+				w.release(fi, nil)
+			})
+		}
+		return true
+	case event == Delete:
+		s := &w.settle
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		t, ok := s.timers[fi]
+		if t != nil {
+			t.Stop()
+		}
+		delete(s.timers, fi)
+		delete(s.stamps, fi)
+		return ok
+	}
+	return false
+}
+
+// held returns whether the Create of fi is held back and restarts its settle time
+func (w *watcher) held(fi *info) bool {
+	s := &w.settle
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	t, ok := s.timers[fi]
+	if t != nil {
+		t.Reset(settleTime)
+	}
+	return ok
+}
+
+// release updates fi with nfi if not nil and delivers its held Create.
+// It returns false if no Create was held back for fi.
+func (w *watcher) release(fi *info, nfi os.FileInfo) bool {
+	s := &w.settle
+	s.mutex.Lock()
+	t, ok := s.timers[fi]
+	at := s.stamps[fi]
+	delete(s.timers, fi)
+	delete(s.stamps, fi)
+	s.mutex.Unlock()
+	if !ok {
+		return false
+	}
+	if t != nil {
+		t.Stop()
+	}
+	if nfi != nil {
+		fi.update(nfi)
+	}
+	if w.cached(fi) {
+		w.dispatchAt(Create, fi, fi, at)
+	}
+	return true
+}
+
+// releaseAll delivers all held Creates
+func (w *watcher) releaseAll() {
+	s := &w.settle
+	s.mutex.Lock()
+	list := make([]*info, 0, len(s.timers))
+	for fi := range s.timers {
+		list = append(list, fi)
+	}
+	s.mutex.Unlock()
+	for _, fi := range list {
+		w.release(fi, nil)
+	}
+}
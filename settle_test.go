@@ -0,0 +1,88 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCreateOnClose(t *testing.T) {
+	requireNative(t)
+	env := newtestenvWith(t, &Context{CreateOnClose: true})
+	root := env.root
+	defer env.close()
+	env.load(root, true)
+	file := filepath.Join(root, "file")
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal("failed to create.", err)
+	}
+	_, err = f.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal("failed to write.", err)
+	}
+	env.sleep()
+	env.check()
+	f.Close()
+	env.expect = append(env.expect, record{Create, file, false})
+	env.sleep()
+	env.check()
+	// files deleted before they are ready are not reported
+	tmp := filepath.Join(root, "tmp")
+	f, err = os.Create(tmp)
+	if err != nil {
+		t.Fatal("failed to create.", err)
+	}
+	err = os.Remove(tmp)
+	if err != nil {
+		t.Fatal("failed to remove.", err)
+	}
+	f.Close()
+	time.Sleep(settleTime + waitfor)
+	env.check()
+}
+
+func TestCreateOnCloseSlowWriter(t *testing.T) {
+	requireNative(t)
+	if !backend.ReportsClose {
+		t.Skip("the backend does not report the close")
+	}
+	env := newtestenvWith(t, &Context{CreateOnClose: true})
+	root := env.root
+	defer env.close()
+	env.load(root, true)
+	file := filepath.Join(root, "file")
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal("failed to create.", err)
+	}
+	defer f.Close()
+	// pauses longer than the settle time do not release the create
+	for i := 0; i < 2; i++ {
+		if _, err = f.Write([]byte("hello")); err != nil {
+			t.Fatal("failed to write.", err)
+		}
+		time.Sleep(settleTime + waitfor)
+		env.check()
+	}
+	f.Close()
+	env.expect = append(env.expect, record{Create, file, false})
+	env.sleep()
+	env.check()
+	if fi := (Watcher{env.watcher}).Get(file); fi == nil || fi.Size() != 10 {
+		t.Errorf("expected the written size in the cache got %v", fi)
+	}
+	// a link is not opened and reported right away
+	link := filepath.Join(root, "link")
+	if err = os.Symlink(file, link); err != nil {
+		t.Fatal("failed to link.", err)
+	}
+	env.expect = append(env.expect, record{Create, link, false})
+	env.sleep()
+	env.check()
+}
@@ -0,0 +1,88 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"os"
+	"sort"
+)
+
+// Snapshot is an immutable copy of the cached files at one point in time
+type Snapshot struct {
+	// files are sorted by path
+	files []*frozen
+}
+
+// Change is a difference between two snapshots
+type Change struct {
+	// Event is Create, Delete, Modify or Chmod
+	Event Event
+	Path  string
+	// Info is the old file for Delete and the new file otherwise
+	Info os.FileInfo
+}
+
+// Snapshot returns a copy of all cached files that were not ignored by `Context.Filter`.
+func (w Watcher) Snapshot() Snapshot {
+	var s Snapshot
+	w.mutex.RLock()
+	w.tree.each(func(nfo *info) {
+		if !nfo.has(ignored) {
+			s.files = append(s.files, nfo.Freeze().(*frozen))
+		}
+	})
+	w.mutex.RUnlock()
+	sort.Slice(s.files, func(i, j int) bool {
+		return s.files[i].path < s.files[j].path
+	})
+	return s
+}
+
+// Len returns the number of files in s
+func (s Snapshot) Len() int {
+	return len(s.files)
+}
+
+// Get returns the file at path or nil
+func (s Snapshot) Get(path string) os.FileInfo {
+	i := sort.Search(len(s.files), func(i int) bool {
+		return s.files[i].path >= path
+	})
+	if i < len(s.files) && s.files[i].path == path {
+		return s.files[i]
+	}
+	return nil
+}
+
+// Diff returns the changes from s to the later snapshot other ordered by path.
+// A file replaced by a directory or the reverse is a Delete and a Create.
+// The time and size of directories are ignored like by the watcher.
+func (s Snapshot) Diff(other Snapshot) []Change {
+	var res []Change
+	i, j := 0, 0
+	for i < len(s.files) || j < len(other.files) {
+		switch {
+		case j == len(other.files) || i < len(s.files) && s.files[i].path < other.files[j].path:
+			res = append(res, Change{Delete, s.files[i].path, s.files[i]})
+			i++
+		case i == len(s.files) || other.files[j].path < s.files[i].path:
+			res = append(res, Change{Create, other.files[j].path, other.files[j]})
+			j++
+		default:
+			old, fi := s.files[i], other.files[j]
+			switch {
+			case old.IsDir() != fi.IsDir():
+				res = append(res, Change{Delete, old.path, old}, Change{Create, fi.path, fi})
+			case !fi.IsDir() && (!old.modt.Equal(fi.modt) || old.size != fi.size):
+				res = append(res, Change{Modify, fi.path, fi})
+			case old.mode != fi.mode:
+				res = append(res, Change{Chmod, fi.path, fi})
+			}
+			i++
+			j++
+		}
+	}
+	return res
+}
@@ -0,0 +1,62 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	dir := env.mkdir(env.root, "dir")
+	changed := env.createWriteClose(dir, "changed")
+	gone := env.createWriteClose(env.root, "gone")
+	kind := env.createWriteClose(env.root, "kind")
+	env.sleep()
+	env.check()
+	w := Watcher{env.watcher}
+	before := w.Snapshot()
+	if before.Len() != 5 || before.Get(changed) == nil || before.Get(filepath.Join(dir, "none")) != nil {
+		t.Fatalf("expected five files got %d", before.Len())
+	}
+	env.Lock()
+	env.events, env.expect = nil, nil
+	env.Unlock()
+	f, err := os.OpenFile(changed, os.O_APPEND|os.O_WRONLY, 0600)
+	env.writeClose(f, err)
+	env.remove(gone)
+	env.remove(kind)
+	if err := os.Mkdir(kind, 0700); err != nil {
+		t.Fatal("failed to create dir", err)
+	}
+	added := env.createWriteClose(dir, "added")
+	env.sleep()
+	after := w.Snapshot()
+	expect := []Change{
+		{Create, added, nil},
+		{Modify, changed, nil},
+		{Delete, gone, nil},
+		{Delete, kind, nil},
+		{Create, kind, nil},
+	}
+	diff := before.Diff(after)
+	if len(diff) != len(expect) {
+		t.Fatalf("expected %v got %v", expect, diff)
+	}
+	for i, c := range diff {
+		if c.Event != expect[i].Event || c.Path != expect[i].Path || c.Info == nil {
+			t.Errorf("expected %v got %v", expect[i], c)
+		}
+	}
+	if c := diff[2]; c.Info.Size() != 12 {
+		t.Errorf("expected the old file for a delete got %v", c.Info.Size())
+	}
+	if diff := after.Diff(after); len(diff) != 0 {
+		t.Errorf("expected no changes got %v", diff)
+	}
+}
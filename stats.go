@@ -0,0 +1,105 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"sync"
+	"time"
+)
+
+// Stats holds watch establishment timings and counters of the watcher.
+// The timings are only collected if `Context.Timing` is set.
+type Stats struct {
+	// LastLoadDuration is the duration of the last call to Load
+	LastLoadDuration time.Duration
+	// AvgAddLatency is the average duration to add a single watch
+	AvgAddLatency time.Duration
+	// Adds is the number of watches added
+	Adds int
+	// Watched is the number of cached files with an active watch
+	Watched int
+	// Cached is the number of cached files not ignored by `Context.Filter`
+	Cached int
+	// Dropped is the number of events dropped because the receiver of the
+	// channel returned by Events or the function passed to Pipe fell behind
+	Dropped uint64
+	// Overflows is the number of kernel queue overflows that lost events
+	Overflows uint64
+}
+
+// stats collects the timings and counters for a watcher
+type stats struct {
+	mutex     sync.Mutex
+	load      time.Duration
+	adds      int
+	addTime   time.Duration
+	drops     uint64
+	overflows uint64
+}
+
+func (s *stats) loaded(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.load = d
+}
+
+func (s *stats) added(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.adds++
+	s.addTime += d
+}
+
+// dropped counts an event dropped under backpressure
+func (s *stats) dropped() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.drops++
+}
+
+// overflowed counts a kernel queue overflow
+func (s *stats) overflowed() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.overflows++
+}
+
+func (s *stats) snapshot() Stats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	res := Stats{LastLoadDuration: s.load, Adds: s.adds, Dropped: s.drops, Overflows: s.overflows}
+	if s.adds > 0 {
+		res.AvgAddLatency = s.addTime / time.Duration(s.adds)
+	}
+	return res
+}
+
+// addTimed calls add and records its duration if timing is enabled
+func (w *watcher) addTimed(nfo *info, flags uint32) error {
+	if !w.context.Timing {
+		return w.add(nfo, flags)
+	}
+	start := time.Now()
+	err := w.add(nfo, flags)
+	w.stats.added(time.Since(start))
+	return err
+}
+
+// Stats returns the watch establishment timings collected so far and the current counters
+func (w Watcher) Stats() Stats {
+	res := w.stats.snapshot()
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	w.tree.each(func(nfo *info) {
+		if nfo.Ignored() {
+			return
+		}
+		res.Cached++
+		if nfo.watch != nil {
+			res.Watched++
+		}
+	})
+	return res
+}
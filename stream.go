@@ -0,0 +1,62 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// EventRecord is the JSON representation of an event written by Stream
+type EventRecord struct {
+	Seq     uint64    `json:"seq,omitempty"`
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// NewEventRecord returns the record for event and fi
+func NewEventRecord(event Event, fi FileInfo) EventRecord {
+	return EventRecord{
+		Event:   event.String(),
+		Path:    fi.Path(),
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}
+}
+
+// Stream writes every event as a line of JSON to wr until the watcher is closed.
+// The events are queued like those of `Watcher.Pipe` and written on the calling
+// goroutine, so that a slow writer does not block the watcher. If `Context.PipeLimit`
+// is reached further events are dropped and `ErrPipeFull` is reported.
+// Stream stops and returns the first write error.
+func (w Watcher) Stream(wr io.Writer) error {
+	p, id := w.pipe()
+	defer w.unlisten(id)
+	enc := json.NewEncoder(wr)
+	for {
+		closed := false
+		select {
+		case <-p.wake:
+		case <-w.done:
+			// write the remaining events
+			closed = true
+		}
+		for _, e := range p.take() {
+			rec := NewEventRecord(e.Event, e.Info)
+			rec.Seq, rec.Time = e.Seq, e.Time
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+		}
+		if closed {
+			return nil
+		}
+		p.caughtUp()
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+	err error
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.buf.Write(p)
+}
+
+func TestStream(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	w := Watcher{env.watcher}
+	var buf syncBuffer
+	errc := make(chan error)
+	go func() { errc <- w.Stream(&buf) }()
+	env.sleep()
+	dir := env.mkdir(env.root, "dir")
+	env.sleep()
+	env.watcher.close()
+	if err := <-errc; err != nil {
+		t.Fatal("unexpected stream error", err)
+	}
+	var rec EventRecord
+	buf.Lock()
+	err := json.Unmarshal(buf.buf.Bytes(), &rec)
+	buf.Unlock()
+	if err != nil {
+		t.Fatal("failed to decode record", err)
+	}
+	if rec.Event != "Create" || rec.Path != dir {
+		t.Errorf("expected Create %q got %s %q", dir, rec.Event, rec.Path)
+	}
+}
+
+func TestStreamError(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	w := Watcher{env.watcher}
+	buf := &syncBuffer{err: errors.New("write failed")}
+	errc := make(chan error)
+	go func() { errc <- w.Stream(buf) }()
+	env.sleep()
+	env.mkdir(env.root, "dir")
+	select {
+	case err := <-errc:
+		if err != buf.err {
+			t.Errorf("expected write error got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected stream to stop")
+	}
+}
+
+// blockingWriter blocks every write until it is released
+type blockingWriter struct {
+	release chan struct{}
+}
+
+func (b blockingWriter) Write(p []byte) (int, error) {
+	<-b.release
+	return len(p), nil
+}
+
+func TestStreamSlowWriter(t *testing.T) {
+	env := newtestenvWith(t, &Context{PipeLimit: 1})
+	root, w := env.root, env.watcher
+	defer env.close()
+	env.load(root, true)
+	wr := blockingWriter{make(chan struct{})}
+	errc := make(chan error)
+	go func() { errc <- Watcher{w}.Stream(wr) }()
+	env.sleep()
+	for _, name := range []string{"a", "b", "c", "d"} {
+		env.createWriteClose(root, name)
+	}
+	// the handler sees all files while the writer blocks
+	env.waitUntil(func() bool {
+		env.Lock()
+		defer env.Unlock()
+		creates := 0
+		for _, r := range env.events {
+			if r.Event == Create {
+				creates++
+			}
+		}
+		return creates == 4
+	})
+	close(wr.release)
+	env.sleep()
+	env.Lock()
+	errs := env.errors
+	env.errors = nil
+	env.Unlock()
+	if len(errs) != 1 || errs[0] != ErrPipeFull {
+		t.Errorf("expected one pipe full error got %v", errs)
+	}
+	env.check()
+	w.close()
+	if err := <-errc; err != nil {
+		t.Fatal("unexpected stream error", err)
+	}
+}
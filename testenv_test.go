@@ -44,25 +44,42 @@ type testenv struct {
 	recorder
 }
 
+// requireNative skips tests that depend on the details of kernel notifications
+func requireNative(t *testing.T) {
+	if backend.Name == "poll" {
+		t.Skip("requires native notifications")
+	}
+}
+
 // newtestenv sets up a watcher for a temporary folder
 func newtestenv(t *testing.T) *testenv {
+	env := newtestenvWith(t, &Context{})
+	err := env.watcher.load(env.root, true, nil)
+	if err != nil {
+		t.Fatal("failed to add root watch", err)
+	}
+	return env
+}
+
+// newtestenvWith sets up a watcher with ctx for a temporary folder without loading it.
+// The handler and error callbacks default to the recorder of the environment.
+func newtestenvWith(t *testing.T, ctx *Context) *testenv {
 	root, err := ioutil.TempDir("", "watchfs")
 	if err != nil {
 		t.Fatal("failed to setup test environment", err)
 	}
 	env := &testenv{T: t, root: root}
-	w, err := newwatcher(&Context{
-		Handle: env.handle,
-		Error:  env.error,
-	})
-	if err != nil {
-		t.Fatal("failed to create watcher", err)
+	if ctx.Handle == nil && ctx.BatchHandle == nil {
+		ctx.Handle = env.handle
 	}
-	err = w.load(root, true)
+	if ctx.Error == nil {
+		ctx.Error = env.error
+	}
+	env.watcher, err = newwatcher(ctx)
 	if err != nil {
-		t.Fatal("failed to add root watch", err)
+		os.RemoveAll(root)
+		t.Fatal("failed to create watcher", err)
 	}
-	env.watcher = w
 	return env
 }
 
@@ -142,7 +159,7 @@ func (t *testenv) remove(path string) {
 }
 
 func (t *testenv) load(path string, recursive bool) {
-	err := t.watcher.load(path, recursive)
+	err := t.watcher.load(path, recursive, nil)
 	if err != nil {
 		t.Fatal("failed to load.", err)
 	}
@@ -155,6 +172,27 @@ func (t *testenv) unload(path string, recursive bool) {
 	}
 }
 
+// sleep waits for the events of the changes made before the call. The polling backend
+// also scans once more, so that the expectations do not depend on its interval.
+func (t *testenv) sleep() {
+	time.Sleep(waitfor)
+	if p, ok := interface{}(t.watcher).(interface{ poll() bool }); ok {
+		t.watcher.serial(func() { p.poll() })
+	}
+}
+
+// waitUntil polls cond until it returns true and fails the test after a second.
+// It waits for events to be read without racing the windows of a fake clock.
+func (t *testenv) waitUntil(cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the watcher")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
 func (t *testenv) check() {
 	t.Lock()
 	defer t.Unlock()
@@ -166,6 +204,10 @@ func (t *testenv) check() {
 	opt := 0
 	for i, e := range t.expect {
 		if i-opt >= len(t.events) {
+			if e.optional {
+				opt++
+				continue
+			}
 			t.Errorf("expected %s got nothing", e)
 			continue
 		}
@@ -0,0 +1,59 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"sync"
+)
+
+// throttling holds the last dropped event of each throttled path
+type throttling struct {
+	mutex sync.Mutex
+	paths map[string]*heldEvent
+}
+
+// throttle returns true if an event for fi was delivered within the current interval.
+// The event is then held back and delivered at the end of the interval unless
+// a later event replaces it.
+func (w *watcher) throttle(event Event, fi *info, as FileInfo, s stamp) bool {
+	r := &w.rate
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.paths == nil {
+		r.paths = make(map[string]*heldEvent)
+	}
+	if e, ok := r.paths[fi.path]; ok {
+		if e != nil && e.event == Modify && event == Modify {
+			as = absorb(e.as, as)
+		}
+		r.paths[fi.path] = &heldEvent{event, fi, as, s}
+		return true
+	}
+	// a nil entry marks the interval of a delivered event
+	r.paths[fi.path] = nil
+	path := fi.path
+	w.afterFunc(w.context.Throttle, func() {
+		w.trail(path)
+	})
+	return false
+}
+
+// trail delivers the last held back event for path and starts a new interval
+func (w *watcher) trail(path string) {
+	r := &w.rate
+	r.mutex.Lock()
+	e := r.paths[path]
+	if e == nil {
+		delete(r.paths, path)
+		r.mutex.Unlock()
+		return
+	}
+	r.paths[path] = nil
+	w.afterFunc(w.context.Throttle, func() {
+		w.trail(path)
+	})
+	r.mutex.Unlock()
+	w.coalesce(e.event, e.info, e.as, e.stamp)
+}
@@ -0,0 +1,39 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	requireNative(t)
+	env := newtestenvWith(t, &Context{Throttle: 4 * waitfor})
+	root, w := env.root, env.watcher
+	defer env.close()
+	env.load(root, true)
+	file := filepath.Join(root, "file")
+	env.writeClose(os.Create(file))
+	// the changes right after the create are absorbed by the create
+	time.Sleep(2 * createWindow)
+	for i := 0; i < 10; i++ {
+		f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+		env.writeClose(f, err)
+	}
+	env.sleep()
+	// only the first event is delivered within the interval
+	env.expect = append(env.expect, record{Create, file, false})
+	env.check()
+	time.Sleep(4 * waitfor)
+	// the last event is delivered at the end of the interval
+	env.expect = append(env.expect, record{Modify, file, false})
+	env.check()
+	if fi := (Watcher{w}).Get(file); fi == nil || fi.Size() != 11*12 {
+		t.Errorf("expected the final size in the cache got %v", fi)
+	}
+}
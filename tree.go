@@ -4,13 +4,25 @@
 
 package fswatch
 
-import "os"
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
 
 // tree represents a map of string paths to info pointers.
 // it is implemented as a critbit tree from the package:
 // 	github.com/mb0/critbit
 type tree struct {
 	root   *ref
+	// links indexes the cached files by device and inode number,
+	// so that the other hard links of a file are found without a walk
+	links map[fileKey][]*info
+}
+
+// fileKey is the device and inode number of a file, zero if unknown
+type fileKey struct {
+	dev, ino uint64
 }
 
 // ref holds either a info or node pointer
@@ -70,8 +82,36 @@ func (t *tree) get(path string) *info {
 	return p.info
 }
 
+// ancestor returns the info at path or its nearest ancestor with all flags set or nil
+func (t *tree) ancestor(path string, flags uint) *info {
+	for {
+		if nfo := t.get(path); nfo != nil {
+			nfo.mutex.RLock()
+			found := nfo.flags&flags == flags
+			nfo.mutex.RUnlock()
+			if found {
+				return nfo
+			}
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return nil
+		}
+		path = parent
+	}
+}
+
 // get inserts an info pointer into the tree or returns an existing one with the same path
 func (t *tree) insert(info *info) *info {
+	dup := t.insertPath(info)
+	if dup == nil {
+		t.index(info)
+	}
+	return dup
+}
+
+// insertPath inserts the info pointer into the critbit tree unless its path exists
+func (t *tree) insertPath(info *info) *info {
 	// test for empty tree
 	if t.root == nil {
 		t.root = &ref{info: info}
@@ -137,6 +177,11 @@ func (t *tree) deleteAll(root string, f func(*info)) {
 	if t.root == nil {
 		return
 	}
+	del := f
+	f = func(nfo *info) {
+		t.unindex(nfo)
+		del(nfo)
+	}
 	// walk for best member
 	var dir byte
 	var wp *ref
@@ -165,19 +210,18 @@ func (t *tree) deleteAll(root string, f func(*info)) {
 	}
 	// delete subtree
 	root += string(os.PathSeparator)
+	// walk for the top of the subtree prefixed with root
+	dir, wp = 0, nil
+	top := t.root
+	for top.node != nil && top.node.off < len(root) {
+		wp = top
+		dir = top.node.dir(root)
+		top = &top.node.child[dir]
+	}
 	// walk for best member
-	p, top, wp := wp, wp, nil
+	p = top
 	for p.node != nil {
-		newtop := p.node.off < len(root)
-		if newtop {
-			wp = p
-		}
-		ndir := p.node.dir(root)
-		p = &p.node.child[dir]
-		if newtop {
-			dir = ndir
-			top = p
-		}
+		p = &p.node.child[p.node.dir(root)]
 	}
 	if len(p.info.path) < len(root) {
 		return
@@ -187,12 +231,107 @@ func (t *tree) deleteAll(root string, f func(*info)) {
 			return
 		}
 	}
+	sub := *top
 	if wp == nil {
 		t.root = nil
 	} else {
 		*wp = wp.node.child[1-dir]
 	}
-	t.deliter(*top, f)
+	t.deliter(sub, f)
+}
+
+// index adds the file nfo with a known inode to the links index
+func (t *tree) index(nfo *info) {
+	nfo.mutex.RLock()
+	key := fileKey{nfo.dev, nfo.ino}
+	dir := nfo.mode&os.ModeDir != 0
+	nfo.mutex.RUnlock()
+	if key.ino == 0 || dir {
+		return
+	}
+	if t.links == nil {
+		t.links = make(map[fileKey][]*info)
+	}
+	nfo.key = key
+	t.links[key] = append(t.links[key], nfo)
+}
+
+// unindex removes nfo from the links index
+func (t *tree) unindex(nfo *info) {
+	list := t.links[nfo.key]
+	for i, other := range list {
+		if other == nfo {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(t.links, nfo.key)
+	} else {
+		t.links[nfo.key] = list
+	}
+	nfo.key = fileKey{}
+}
+
+// linked returns the other cached links of the file fi. A cached fi whose inode
+// changed since it was indexed is indexed again.
+func (t *tree) linked(fi *info) []*info {
+	fi.mutex.RLock()
+	key := fileKey{fi.dev, fi.ino}
+	fi.mutex.RUnlock()
+	if key != fi.key && t.get(fi.path) == fi {
+		t.unindex(fi)
+		t.index(fi)
+	}
+	var list []*info
+	for _, nfo := range t.links[key] {
+		if nfo != fi && nfo.sameFile(fi) {
+			list = append(list, nfo)
+		}
+	}
+	return list
+}
+
+// each calls f for every info in the tree in traversal order
+func (t *tree) each(f func(*info)) {
+	if t.root != nil {
+		t.deliter(*t.root, f)
+	}
+}
+
+// iter calls f for every info in the tree in traversal order until f returns false
+func (t *tree) iter(f func(*info) bool) {
+	if t.root != nil {
+		nextiter(*t.root, f)
+	}
+}
+
+// prefixed calls f for every info with a path starting with prefix
+// in traversal order until f returns false
+func (t *tree) prefixed(prefix string, f func(*info) bool) {
+	if t.root == nil {
+		return
+	}
+	// walk for the top of the subtree, all keys below differ after prefix
+	top := *t.root
+	for top.node != nil && top.node.off < len(prefix) {
+		top = top.node.child[top.node.dir(prefix)]
+	}
+	p := top
+	for p.node != nil {
+		p = p.node.child[0]
+	}
+	if !strings.HasPrefix(p.info.path, prefix) {
+		return
+	}
+	nextiter(top, f)
+}
+
+func nextiter(p ref, f func(*info) bool) bool {
+	if p.node != nil {
+		return nextiter(p.node.child[0], f) && nextiter(p.node.child[1], f)
+	}
+	return f(p.info)
 }
 
 func (t *tree) deliter(p ref, f func(*info)) {
@@ -63,3 +63,139 @@ func TestWalk(t *testing.T) {
 		}
 	}
 }
+
+func TestDeleteAll(t *testing.T) {
+	sep := string(os.PathSeparator)
+	paths := []string{"a", "a" + sep + "b", "a" + sep + "b" + sep + "c", "a" + sep + "d", "a.b", "b"}
+	tr := new(tree)
+	for _, path := range paths {
+		tr.insert(&info{path: path, mode: os.ModeDir})
+	}
+	var deleted []string
+	tr.deleteAll(paths[1], func(nfo *info) {
+		deleted = append(deleted, nfo.path)
+	})
+	if len(deleted) != 2 || deleted[0] != paths[1] || deleted[1] != paths[2] {
+		t.Errorf("expected to delete %v got %v", paths[1:3], deleted)
+	}
+	for i, path := range paths {
+		deleted := i == 1 || i == 2
+		if nfo := tr.get(path); (nfo == nil) != deleted {
+			t.Errorf("expected %s deleted %v got %v", path, deleted, nfo == nil)
+		}
+	}
+}
+
+func TestTreeLinks(t *testing.T) {
+	sep := string(os.PathSeparator)
+	tr := new(tree)
+	tr.insert(&info{path: "a", mode: os.ModeDir})
+	a := &info{path: "a" + sep + "f", dev: 1, ino: 2}
+	b := &info{path: "b", dev: 1, ino: 2}
+	other := &info{path: "c", dev: 1, ino: 3}
+	for _, nfo := range []*info{a, b, other} {
+		tr.insert(nfo)
+	}
+	if list := tr.linked(b); len(list) != 1 || list[0] != a {
+		t.Errorf("expected the link %s got %v", a.path, list)
+	}
+	tr.deleteAll("a", func(*info) {})
+	if list := tr.linked(b); len(list) != 0 {
+		t.Errorf("expected no links after the delete got %v", list)
+	}
+	if len(tr.links) != 2 {
+		t.Errorf("expected two indexed files got %d", len(tr.links))
+	}
+}
+
+func TestRange(t *testing.T) {
+	sep := string(os.PathSeparator)
+	paths := []string{"a", "a" + sep + "b", "a" + sep + "b" + sep + "c", "a" + sep + "d", "a-b", "a.b", "b"}
+	tr := new(tree)
+	for i := len(paths) - 1; i >= 0; i-- {
+		tr.insert(&info{path: paths[i], mode: os.ModeDir})
+	}
+	tr.get("a.b").flags |= ignored
+	w := Watcher{&watcher{tree: tr}}
+	var got []string
+	w.Range(func(fi FileInfo) bool {
+		got = append(got, fi.Path())
+		return true
+	})
+	expect := []string{paths[0], paths[1], paths[2], paths[3], paths[4], paths[6]}
+	if len(got) != len(expect) {
+		t.Fatalf("expected %v got %v", expect, got)
+	}
+	for i := range expect {
+		if got[i] != expect[i] {
+			t.Errorf("expected %s at %d got %s", expect[i], i, got[i])
+		}
+	}
+	got = got[:0]
+	w.Range(func(fi FileInfo) bool {
+		got = append(got, fi.Path())
+		return len(got) < 2
+	})
+	if len(got) != 2 {
+		t.Errorf("expected to stop after 2 entries got %v", got)
+	}
+}
+
+func TestUnder(t *testing.T) {
+	sep := string(os.PathSeparator)
+	paths := []string{"a", "a" + sep + "b", "a" + sep + "b" + sep + "c", "a" + sep + "d", "a-b", "a.b", "ab", "b"}
+	tr := new(tree)
+	for _, path := range paths {
+		tr.insert(&info{path: path, mode: os.ModeDir})
+	}
+	tr.get("a.b").flags |= ignored
+	w := Watcher{&watcher{tree: tr}}
+	tests := []struct {
+		prefix string
+		expect []string
+	}{
+		{"", []string{paths[0], paths[1], paths[2], paths[3], paths[4], paths[6], paths[7]}},
+		{"a", []string{paths[0], paths[1], paths[2], paths[3], paths[4], paths[6]}},
+		{"a" + sep, []string{paths[1], paths[2], paths[3]}},
+		{"a" + sep + "b", []string{paths[1], paths[2]}},
+		{"ab", []string{paths[6]}},
+		{"abc", nil},
+		{"c", nil},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, fi := range w.Under(test.prefix) {
+			got = append(got, fi.Path())
+		}
+		if len(got) != len(test.expect) {
+			t.Errorf("%q: expected %v got %v", test.prefix, test.expect, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.expect[i] {
+				t.Errorf("%q: expected %v got %v", test.prefix, test.expect, got)
+				break
+			}
+		}
+	}
+}
+
+func TestGC(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	w := Watcher{env.watcher}
+	// insert an uncovered entry for a path that does not exist
+	stale := &info{path: filepath.Join(env.root+"-gone", "file")}
+	w.mutex.Lock()
+	w.tree.insert(stale)
+	w.mutex.Unlock()
+	if n := w.GC(); n != 1 {
+		t.Errorf("expected 1 reclaimed entry got %d", n)
+	}
+	if w.Get(stale.path) != nil {
+		t.Error("expected stale entry to be removed")
+	}
+	if w.Get(env.root) == nil {
+		t.Error("expected root to be kept")
+	}
+}
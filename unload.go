@@ -0,0 +1,74 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fswatch
+
+import "path/filepath"
+
+// UnloadQuiet stops watching like Unload and drops the events held back for the
+// unloaded files by `Context.Throttle`, `Context.CreateOnClose`,
+// the bulk coalescing and `Context.DebounceByDir`. No events are delivered for
+// the unloaded files afterwards. Explicitly loaded descendants that are kept by a
+// non recursive unload keep their held events.
+func (w Watcher) UnloadQuiet(path string, recursive bool) error {
+	if err := w.Unload(path, recursive); err != nil {
+		return err
+	}
+	w.discard(filepath.Clean(path))
+	return nil
+}
+
+// discard drops the held events of the files at root and below that are not cached anymore
+func (w *watcher) discard(root string) {
+	gone := func(fi *info) bool {
+		return within(fi.path, root) && !w.cached(fi)
+	}
+	w.unhold(gone)
+	r := &w.rate
+	r.mutex.Lock()
+	for path, e := range r.paths {
+		if e != nil && gone(e.info) {
+			// the nil entry ends the interval without delivering
+			r.paths[path] = nil
+		}
+	}
+	r.mutex.Unlock()
+	s := &w.settle
+	s.mutex.Lock()
+	for fi, t := range s.timers {
+		if gone(fi) {
+			t.Stop()
+			delete(s.timers, fi)
+		}
+	}
+	s.mutex.Unlock()
+	b := &w.bulk
+	b.mutex.Lock()
+	for key, list := range b.pending {
+		keep := list[:0]
+		for _, e := range list {
+			if !gone(e.info) {
+				keep = append(keep, e)
+			}
+		}
+		// the pending flush delivers the remaining events
+		b.pending[key] = keep
+	}
+	b.mutex.Unlock()
+	d := &w.dirs
+	d.mutex.Lock()
+	for dir := range d.pending {
+		if !within(dir, root) {
+			continue
+		}
+		w.mutex.RLock()
+		cached := w.tree.get(dir) != nil
+		w.mutex.RUnlock()
+		if !cached {
+			// the pending flush finds the directory gone
+			delete(d.pending, dir)
+		}
+	}
+	d.mutex.Unlock()
+}
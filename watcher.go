@@ -6,21 +6,149 @@
 package fswatch
 
 import (
+	"context"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 // Context holds a filter and handler functions for file events and errors
 type Context struct {
-	// Handle handles file events
+	// Handle handles file events.
+	// The Create of a directory is handled before the Creates of its descendants.
+	// A Modify is not handled if the file was deleted before the change could be read.
+	// Handle is not called if BatchHandle is set.
 	Handle func(Event, FileInfo)
+	// HandleW handles file events like Handle and also receives the watcher.
+	// It is called after Handle.
+	HandleW func(Watcher, Event, FileInfo)
+	// HandleInfo handles file events like Handle with the sequence number and time
+	// of their delivery. It is called after HandleW.
+	HandleInfo func(EventInfo)
+	// BatchHandle handles the events delivered during one iteration of the event loop
+	// of the backend at once, after the iteration and in delivery order. Events delivered
+	// outside of an iteration, by Load or delayed by Debounce or Throttle, are passed
+	// alone unless an iteration is running. It replaces Handle, but HandleW and
+	// HandleInfo are still called for every event.
+	BatchHandle func([]EventInfo)
 	// Filter returns `false` if the watcher should ignore FileInfo
 	Filter func(FileInfo) bool
 	// Error handles errors
 	Error func(error)
+	// Warn is called with a hint when the watcher falls behind the kernel and is
+	// at risk of losing events, e.g. because the handlers are too slow.
+	// Only the inotify backend reports warnings. Nil disables the check.
+	Warn func(string)
+	// ModifyPredicate returns `false` if the change from old to new should not
+	// be reported as Modify or Chmod. The cache is updated regardless.
+	ModifyPredicate func(old, new os.FileInfo) bool
+	// PipeLimit is the maximum number of events queued for each `Watcher.Pipe`
+	// and `Watcher.Stream`. Zero means no limit.
+	PipeLimit int
+	// EventBuffer is the capacity of the channels returned by `Watcher.Events`
+	// and `Watcher.Errors`. Zero means a default of 64.
+	EventBuffer int
+	// DropEvents drops events and errors if the channel is full instead of
+	// blocking the watcher until the receiver catches up.
+	DropEvents bool
+	// DebounceByDir coalesces all events for the children of a directory within
+	// the duration into a single Modify of the directory with a `*DirChange`.
+	// Zero disables the debouncing.
+	DebounceByDir time.Duration
+	// Debounce holds back the Create or Modify of a file until the file did not
+	// change for the duration. Repeated Modify events are collapsed into the held
+	// event, which is delivered with the final state of the file. Zero disables it.
+	Debounce time.Duration
+	// Throttle limits the events for each path to one per interval. The first event
+	// is delivered immediately, later ones within the interval are dropped except
+	// the last, which is delivered when the interval ends. Zero disables throttling.
+	Throttle time.Duration
+	// CreateWindow is the time after the Create of a file in which a Modify is not
+	// reported if it did not change the size or modification time of the file, because
+	// backends differ in whether writing a new file is reported as a second event.
+	// Zero means 10ms, a negative duration reports every Modify.
+	CreateWindow time.Duration
+	// CreateOnClose holds back the Create of a new file until the file was closed
+	// after writing and reports it as a single Create without Modify. Backends
+	// without close notifications, see `BackendInfo.ReportsClose`, deliver the Create
+	// once the file did not change for a short time. Files deleted before are not reported.
+	CreateOnClose bool
+	// CoalesceBulk holds back the events below each loaded root for a short window.
+	// If many files changed within the window, like after a branch switch,
+	// a single Modify of their common directory with a `*BulkChange` is delivered
+	// instead of the individual events.
+	CoalesceBulk bool
+	// AddRetries is the number of times a watch that failed during Load is retried in
+	// the background with a growing backoff. The last failure is passed to Error.
+	AddRetries int
+	// Timing enables the collection of watch establishment timings returned by Stats
+	Timing bool
+	// ResyncOnOverflow compares all loaded roots with the disk after the inotify
+	// queue overflowed and reports the differences as Create, Modify and Delete.
+	// `ErrOverflow` is passed to Error regardless.
+	ResyncOnOverflow bool
+	// PersistRoots lets Load succeed for missing paths. The nearest existing
+	// ancestor is watched and the path is loaded once it is created.
+	PersistRoots bool
+	// RetryWatch remembers loaded roots that were deleted or lost their watch, like
+	// a directory that is atomically replaced, and loads them again once they exist.
+	// The root and its files are then reported as Create.
+	RetryWatch bool
+	// RetryInterval is the time between the attempts to load the lost roots.
+	// Zero means one second.
+	RetryInterval time.Duration
+	// PollInterval is the time between the scans of the polling backend, which is
+	// used on platforms without native notifications or if built with the poll tag.
+	// Zero means one second.
+	PollInterval time.Duration
+	// EmitInitial delivers a Create event for every file cached by Load, starting with
+	// the loaded root, so the initial tree is reported like later changes. The events are
+	// handled before Load returns, unless they are held back by Debounce, DebounceByDir,
+	// Throttle or CoalesceBulk.
+	EmitInitial bool
+	// FollowSymlinks caches and watches a symlink to a directory as the directory and
+	// loads the target below the path of the link. Links to a directory that is already
+	// watched, like links to an ancestor, are cached as files. If the target disappears
+	// the link is reported deleted and created again as a file.
+	FollowSymlinks bool
+	// WatchExts restricts the files watched individually by the kqueue backend to the
+	// files with one of the extensions, like ".go". Directories are always watched.
+	// Other files are cached and their creation and deletion is reported, but not
+	// their changes. Other backends only watch directories and ignore the list.
+	WatchExts []string
+	// ModifyParent delivers a Modify for the cached directory of a created, deleted
+	// or renamed file after the event of the file, if the modification time of
+	// the directory changed. The cached time of the directory is updated.
+	ModifyParent bool
+	// BufferSize is the size in bytes of the buffer for reading kernel events on linux
+	// and of the buffer of each watched directory on windows. Zero means 64KiB on linux
+	// and 4KiB on windows, or 64KiB with `SubtreeWatch`. New fails if the buffer cannot
+	// hold an event for the longest file name, which is the longest relative path with
+	// `SubtreeWatch`. Other backends ignore it.
+	BufferSize int
+	// SubtreeWatch watches each recursively loaded root on windows with a single watch
+	// of its whole subtree instead of one watch per directory, which saves handles for
+	// large trees. The subdirectories are not `Watched` and unloading one of
+	// them has no effect. Other backends ignore it.
+	SubtreeWatch bool
+	// EventMask reduces the changes reported by the kernel. On every backend Create,
+	// Delete and Rename events are delivered with StructureChanges, Modify events with
+	// ContentChanges and Chmod events with Attributes. Deletes are always watched and
+	// remove the files from the cache, the cache may miss other changes.
+	EventMask Mask
+	// RenameWindow holds back the Create and Rename of a file for the duration. A file
+	// that is renamed again within the window is part of a rename chain, so renames like
+	// A to B to C are delivered as a single Rename from A to C, or as the Delete of A and
+	// the Create of C where the renames are reported as Delete and Create. Zero disables it.
+	RenameWindow time.Duration
 }
 
-// FileInfo is an `os.FileInfo` with additional information
+// FileInfo is an `os.FileInfo` with additional information.
+//
+// A FileInfo is owned by the watcher cache. Its methods are safe for concurrent use,
+// but the returned values may change between calls when the watcher handles
+// a Modify event, and the cache may drop it on a Delete event.
+// Use FreezeInfo to retain a consistent copy.
 type FileInfo interface {
 	os.FileInfo
 	// Path returns the absolute path of the file
@@ -40,11 +168,143 @@ func New(ctx *Context) (Watcher, error) {
 	return Watcher{w}, err
 }
 
+// Root is a directory loaded by NewWith
+type Root struct {
+	Path      string
+	Recursive bool
+	// Depth limits a recursive root like LoadDepth, zero watches only the root
+	// and a negative depth means no limit
+	Depth int
+	// Options apply to the root like the options of Load
+	Options []LoadOption
+}
+
+// NewWith creates a new watcher like New and loads the roots in order before the watcher
+// starts handling the changes. The kernel queues the changes from the moment a watch is
+// added, so no change after the watch of a file was added is missed. The watcher is
+// returned together with the `LoadErrors` of the roots that failed to load.
+func NewWith(ctx *Context, roots ...Root) (Watcher, error) {
+	w, err := newwatcher(ctx, roots...)
+	return Watcher{w}, err
+}
+
+// Backend returns the name and capabilities of the platform specific implementation
+func (w Watcher) Backend() BackendInfo {
+	b := backend
+	b.NativeRecursive = b.NativeRecursive && w.context.SubtreeWatch
+	return b
+}
+
+// EffectiveContext returns a copy of the context used by the watcher
+// with all defaults and runtime changes filled in
+func (w Watcher) EffectiveContext() Context {
+	c := w.context
+	c.Filter = w.filter.Load().(func(FileInfo) bool)
+	c.DebounceByDir = w.dirs.window()
+	c.Debounce = w.quieting.window()
+	return c
+}
+
 // Load starts watching the directory at `path`
-// and all descendent directories if recursive is `true`
-func (w Watcher) Load(path string, recursive bool) error {
+// and all descendent directories if recursive is `true`.
+// If `Context.PersistRoots` is set a missing path is loaded once it is created.
+// The options apply to events and files below path.
+func (w Watcher) Load(path string, recursive bool, opts ...LoadOption) error {
+	err := w.loadRoot(path, recursive, opts)
+	if errs, ok := err.(LoadErrors); ok {
+		// the files that could not be watched or read are reported separately
+		for _, e := range errs {
+			w.context.Error(e)
+		}
+		return nil
+	}
+	return err
+}
+
+// loadRoot implements Load and returns the errors of the files that could not be
+// watched or read as `LoadErrors`
+func (w Watcher) loadRoot(path string, recursive bool, opts []LoadOption) error {
+	path = filepath.Clean(path)
+	var start time.Time
+	if w.context.Timing {
+		start = time.Now()
+	}
+	o := newLoadOptions(opts)
+	o.resolve(path)
+	w.link(o)
+	if o != nil && o.createsOnly {
+		recursive = false
+	}
+	if o == nil {
+		w.widen(path)
+	}
+	err := w.load(path, recursive, o)
+	if w.context.Timing {
+		w.stats.loaded(time.Since(start))
+	}
+	if err == nil {
+		w.unpersist(path)
+	} else if os.IsNotExist(err) && w.context.PersistRoots {
+		err = w.persistRoot(path, recursive, o)
+	}
+	return err
+}
+
+// LoadWalk starts watching the directory at `root` like Load, but walkFn decides
+// which files are watched and which directories are descended into during the
+// initial load instead of `Context.Filter`. Directories are only descended into
+// if recursive is `true`. An error returned by walkFn aborts the load.
+func (w Watcher) LoadWalk(root string, recursive bool, walkFn func(path string, fi os.FileInfo) (watch, descend bool, err error)) error {
+	return w.Load(root, recursive, func(o *loadOptions) {
+		o.walk = walkFn
+	})
+}
+
+// LoadDepth starts watching the directory at `path` like a recursive Load, but only
+// watches the directories up to depth levels below path. Zero watches only path,
+// one also its children. The files in the deepest watched directories are cached
+// but not watched, deeper files are not cached. A negative depth means no limit.
+func (w Watcher) LoadDepth(path string, depth int, opts ...LoadOption) error {
+	if depth < 0 {
+		return w.Load(path, true, opts...)
+	}
+	return w.Load(path, true, append(opts, loadDepth(depth))...)
+}
+
+// loadDepth returns the option of LoadDepth for a depth that is not negative
+func loadDepth(depth int) LoadOption {
+	return func(o *loadOptions) {
+		o.depth = depth + 1
+	}
+}
+
+// WatchFile watches the file at `path` by loading its parent directory and only
+// reports events for the file itself. Watching the directory keeps the file watched
+// when it is deleted and recreated or atomically replaced by a rename.
+func (w Watcher) WatchFile(path string) error {
 	path = filepath.Clean(path)
-	return w.load(path, recursive)
+	return w.Load(filepath.Dir(path), false, watchFile(path))
+}
+
+// Descriptors returns the paths of all active watches keyed by their descriptor.
+// The descriptors are inotify watch descriptors, kqueue file descriptors or
+// directory handles on windows. It is meant for debugging watch leaks.
+func (w Watcher) Descriptors() map[int]string {
+	return w.descriptors()
+}
+
+// List returns the paths of all cached files with an active watch in traversal order.
+// Unlike Walk it omits files that are only cached as children of a watched directory.
+func (w Watcher) List() []string {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	var list []string
+	w.tree.each(func(nfo *info) {
+		if nfo.watch != nil {
+			list = append(list, nfo.path)
+		}
+	})
+	return list
 }
 
 // Get returns a cached `FileInfo` at `path` or `nil`
@@ -60,6 +320,42 @@ func (w Watcher) Get(path string) FileInfo {
 	return fi
 }
 
+// LastEvent returns the time of the last event of the cached file at `path` or one of
+// its children, which tells whether the watch of a busy directory is still alive.
+// The time is zero if no event occurred since the file was cached. Events dropped by
+// the options of a loaded root or by pausing count as well.
+// It returns false if the file is not cached.
+func (w Watcher) LastEvent(path string) (time.Time, bool) {
+	path = filepath.Clean(path)
+	w.mutex.RLock()
+	fi := w.tree.get(path)
+	w.mutex.RUnlock()
+	if fi == nil || fi.Ignored() {
+		return time.Time{}, false
+	}
+	fi.mutex.RLock()
+	defer fi.mutex.RUnlock()
+	return fi.last, true
+}
+
+// IsRecursive returns whether changes below the cached directory at `path` are reported,
+// because it or its nearest explicitly loaded ancestor was loaded recursively.
+func (w Watcher) IsRecursive(path string) bool {
+	path = filepath.Clean(path)
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	if w.tree.get(path) == nil {
+		return false
+	}
+	nfo := w.tree.ancestor(path, explicit)
+	if nfo == nil {
+		return false
+	}
+	nfo.mutex.RLock()
+	defer nfo.mutex.RUnlock()
+	return nfo.flags&recurse != 0
+}
+
 // Lstat mimics `os.Lstat` and returns a cached `FileInfo` at `path` or an `os.PathError`.
 // Lstat ignores files previously filtered out by `Context.Filter`.
 func (w Watcher) Lstat(path string) (os.FileInfo, error) {
@@ -71,7 +367,10 @@ func (w Watcher) Lstat(path string) (os.FileInfo, error) {
 
 // Traverse will call `travFn` with cached `FileInfo`s at root and its descendents.
 // Traverse ignores files previously filtered out by `Context.Filter`.
+// `Watched` tells the entries with a watch from the cached-only entries.
 // The passed in function can return `SkipDir` to skip the current directory.
+// Traverse holds the read lock of the cache for the whole walk, which blocks loads
+// and the handling of events. Large trees are better traversed with TraverseContext.
 func (w Watcher) Traverse(root string, travFn func(FileInfo) error) error {
 	root = filepath.Clean(root)
 	w.mutex.RLock()
@@ -79,8 +378,95 @@ func (w Watcher) Traverse(root string, travFn func(FileInfo) error) error {
 	return w.tree.walk(root, travFn)
 }
 
+// TraverseContext is like Traverse but only holds the read lock to collect the entries
+// and returns the error of ctx once it is done. Entries removed from the cache after
+// they were collected are skipped, entries added are not visited.
+func (w Watcher) TraverseContext(ctx context.Context, root string, travFn func(FileInfo) error) error {
+	root = filepath.Clean(root)
+	var list []*info
+	w.mutex.RLock()
+	err := w.tree.walk(root, func(fi FileInfo) error {
+		list = append(list, fi.(*info))
+		return nil
+	})
+	w.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	var skips []string
+Entries:
+	for _, nfo := range list {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for _, dir := range skips {
+			if within(nfo.path, dir) {
+				continue Entries
+			}
+		}
+		if !w.cached(nfo) {
+			continue
+		}
+		err = travFn(nfo)
+		if err == SkipDir && nfo.IsDir() {
+			skips = append(skips, nfo.path)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TraverseWatched is like Traverse but also passes whether changes to the entry are reported.
+// Directories are watched if they hold a kernel watch or are below a subtree watch,
+// see `Context.SubtreeWatch`, files if they or their directory are watched.
+// Unwatched directories in a watched tree point to watches lost to limits or permissions.
+func (w Watcher) TraverseWatched(root string, fn func(fi FileInfo, watched bool) error) error {
+	root = filepath.Clean(root)
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	return w.tree.walk(root, func(fi FileInfo) error {
+		nfo := fi.(*info)
+		if nfo.IsDir() {
+			return fn(fi, nfo.watch != nil || w.inSubtree(nfo.path))
+		}
+		return fn(fi, w.covered(nfo))
+	})
+}
+
+// Range calls fn with every cached `FileInfo` in walk order, like `filepath.Walk`,
+// until fn returns false. A directory comes before its descendents.
+// Range ignores files previously filtered out by `Context.Filter`.
+// Range holds the read lock of the cache, fn must not load or unload paths.
+func (w Watcher) Range(fn func(FileInfo) bool) {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	w.tree.iter(func(nfo *info) bool {
+		return nfo.Ignored() || fn(nfo)
+	})
+}
+
+// Under returns the cached `FileInfo`s with a path starting with prefix in walk order,
+// like `filepath.Walk`.
+// The prefix is matched as string, "/var/www" also matches "/var/www2" but
+// "/var/www/" only matches the descendents of "/var/www".
+// Under ignores files previously filtered out by `Context.Filter`.
+func (w Watcher) Under(prefix string) []FileInfo {
+	var list []FileInfo
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	w.tree.prefixed(prefix, func(nfo *info) bool {
+		if !nfo.Ignored() {
+			list = append(list, nfo)
+		}
+		return true
+	})
+	return list
+}
+
 // Walk mimics `filepath.Walk` and calls `walkFn` with cached `os.FileInfo`s at root and its descendents.
 // Walk ignores files previously filtered out by `Context.Filter`.
+// The passed infos are `FileInfo`s and tell whether they are watched.
 // The passed in function can return `SkipDir` to skip the current directory.
 func (w Watcher) Walk(root string, walkFn filepath.WalkFunc) error {
 	var found bool
@@ -95,13 +481,116 @@ func (w Watcher) Walk(root string, walkFn filepath.WalkFunc) error {
 }
 
 // Unload stops watching the directory at `path`
-// and all descendent directories if recursive is `true`
+// and all descendent directories if recursive is `true`.
+// The events held back by `Context.Debounce` and `Context.RenameWindow`
+// for the unloaded files are dropped.
 func (w Watcher) Unload(path string, recursive bool) error {
 	path = filepath.Clean(path)
-	return w.unload(path, recursive)
+	w.mutex.Lock()
+	_, pending := w.pending[path]
+	delete(w.pending, path)
+	w.mutex.Unlock()
+	if pending {
+		w.releasePersisted()
+	}
+	w.found(path)
+	if err := w.unload(path, recursive); err != nil {
+		return err
+	}
+	w.unpause(path)
+	w.unhold(func(fi *info) bool {
+		return within(fi.path, path) && !w.cached(fi)
+	})
+	return nil
 }
 
-// Close will close the watcher and release the underlying resources
+// Close will close the watcher and release the underlying resources.
+// Load and Unload calls that returned before Close are fully processed,
+// and no events are delivered for paths that were unloaded.
+// Calls racing with Close may return `ErrClosed`.
+// Events held back by the context options are dropped.
+// The channels returned by Events and Errors are closed.
+// Closing a closed watcher returns `ErrClosed`, see CloseIdempotent.
 func (w Watcher) Close() error {
-	return w.close()
+	w.chans.close()
+	err := w.close()
+	w.mutex.Lock()
+	w.paused = nil
+	w.mutex.Unlock()
+	w.unhold(func(*info) bool { return true })
+	return err
+}
+
+// CloseIdempotent closes the watcher like Close but returns nil if it was closed before.
+// It suits a deferred close of a watcher that may also be closed explicitly.
+func (w Watcher) CloseIdempotent() error {
+	if w.Closed() {
+		return nil
+	}
+	if err := w.Close(); err != ErrClosed {
+		return err
+	}
+	return nil
+}
+
+// Closed returns whether Close was called or the watcher stopped.
+func (w Watcher) Closed() bool {
+	c := &w.chans
+	c.mutex.RLock()
+	closed := c.closed
+	c.mutex.RUnlock()
+	if closed {
+		return true
+	}
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// CloseContext closes the watcher like Close and waits until the watcher stopped and
+// released all file descriptors, or returns the error of ctx if it is done first.
+// A watcher closed before still returns `ErrClosed` once it stopped.
+func (w Watcher) CloseContext(ctx context.Context) error {
+	err := w.Close()
+	select {
+	case <-w.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WaitFor blocks until one of events is delivered for path, or returns the error of ctx
+// if it is done first and `ErrClosed` if the watcher stops. Zero events waits for any event.
+// A wait for Create returns at once if path is cached and a wait for Delete if it is not,
+// so a change made before the call is not missed. Other events are only observed
+// if they are delivered after the call.
+func (w Watcher) WaitFor(ctx context.Context, path string, events Event) error {
+	path = filepath.Clean(path)
+	seen := make(chan struct{}, 1)
+	id := w.listen(func(e EventInfo) {
+		if (events == 0 || e.Event&events != 0) && e.Info.Path() == path {
+			select {
+			case seen <- struct{}{}:
+			default:
+			}
+		}
+	})
+	defer w.unlisten(id)
+	// the listener is registered first to not miss the event after the check
+	cached := w.Get(path) != nil
+	if events&Create != 0 && cached || events&Delete != 0 && !cached {
+		return nil
+	}
+	select {
+	case <-seen:
+		return nil
+	case <-w.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
@@ -2,15 +2,17 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// +build freebsd openbsd netbsd darwin
+// +build freebsd,!poll openbsd,!poll netbsd,!poll darwin,!poll
 
 package fswatch
 
 // http://www.freebsd.org/cgi/man.cgi?query=kqueue
 
 import (
-	"fmt"
+	"errors"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 	"syscall"
 )
@@ -23,6 +25,12 @@ const (
 
 var openwdFlags = syscall.O_NONBLOCK | syscall.O_RDONLY
 
+var backend = BackendInfo{
+	Name:               "kqueue",
+	PerFileGranularity: true,
+	DetectsAttrib:      true,
+}
+
 type watch struct {
 	fd int
 }
@@ -30,13 +38,15 @@ type watch struct {
 type watcher struct {
 	mutex   sync.RWMutex
 	fd      int
+	flags   uint32
 	context Context
 	tree    *tree
 	fdmap   map[int]*info
 	signal  chan func() (done bool)
+	shared
 }
 
-func newwatcher(ctx *Context) (*watcher, error) {
+func newwatcher(ctx *Context, roots ...Root) (*watcher, error) {
 	fd, err := syscall.Kqueue()
 	if fd == -1 {
 		return nil, os.NewSyscallError("Kqueue", err)
@@ -48,15 +58,44 @@ func newwatcher(ctx *Context) (*watcher, error) {
 		fdmap:   make(map[int]*info),
 		signal:  make(chan func() bool, 1),
 	}
+	w.flags = eventFlags(w.context.EventMask)
+	w.init(&w.context)
+	// the roots are watched before the changes are handled
+	err = w.seed(roots)
 	go w.run(fd)
-	return w, nil
+	return w, err
+}
+
+// eventFlags translates the portable event mask to kqueue vnode flags.
+// Deletes are always reported to keep the cache consistent.
+func eventFlags(mask Mask) uint32 {
+	if mask == 0 {
+		return allFlags
+	}
+	flags := uint32(deleteFlags)
+	if mask&(StructureChanges|ContentChanges) != 0 {
+		// directory entry changes are reported as writes
+		flags |= syscall.NOTE_WRITE
+	}
+	if mask&ContentChanges != 0 {
+		flags |= syscall.NOTE_EXTEND
+	}
+	if mask&Attributes != 0 {
+		flags |= syscall.NOTE_ATTRIB
+	}
+	return flags
 }
 
 func watchFilter(nfo *info) bool {
 	return true
 }
 
-func (w *watcher) load(path string, recursive bool) error {
+// inSubtree returns false, only windows watches whole subtrees
+func (w *watcher) inSubtree(path string) bool {
+	return false
+}
+
+func (w *watcher) load(path string, recursive bool, opts *loadOptions) error {
 	w.mutex.RLock()
 	fd := w.fd
 	w.mutex.RUnlock()
@@ -67,29 +106,67 @@ func (w *watcher) load(path string, recursive bool) error {
 	if recursive {
 		fiFlags |= recurse
 	}
-	err := w.loadImpl(path, fiFlags, 0, allFlags, allFlags)
+	err := w.loadImpl(path, fiFlags, w.context.initialEvent(opts), w.flags, w.flags, opts)
 	if err == SkipDir {
 		return nil
 	}
 	return err
 }
 
+// add opens the watch of nfo. It expects the watcher mutex to be held.
 func (w *watcher) add(nfo *info, flags uint32) error {
+	if w.fd == -1 || w.fdmap == nil {
+		return ErrClosed
+	}
 	fd, err := syscall.Open(nfo.path, openwdFlags, 0700)
 	if fd == -1 {
+		if err == syscall.EMFILE || err == syscall.ENFILE {
+			return ErrWatchLimit
+		}
+		return watchError("add", nfo.path, "Open", err)
+	}
+	if err := w.register(fd, nfo, flags); err != nil {
+		syscall.Close(fd)
 		return err
 	}
+	nfo.setWatch(&watch{fd: fd})
+	w.fdmap[fd] = nfo
+	return nil
+}
+
+// register adds the vnode event of the watch fd of nfo to the kqueue.
+// It is a one shot event if nfo has the oneshot flag.
+func (w *watcher) register(fd int, nfo *info, flags uint32) error {
+	evflags := syscall.EV_ADD | syscall.EV_CLEAR
+	if nfo.has(oneshot) {
+		evflags |= syscall.EV_ONESHOT
+	}
 	ev := []syscall.Kevent_t{{Fflags: flags}}
-	syscall.SetKevent(&ev[0], fd, syscall.EVFILT_VNODE, syscall.EV_ADD|syscall.EV_CLEAR)
+	syscall.SetKevent(&ev[0], fd, syscall.EVFILT_VNODE, evflags)
 	code, err := syscall.Kevent(w.fd, ev, nil, nil)
 	if code == -1 {
-		return os.NewSyscallError("Kevent", err)
+		return watchError("add", nfo.path, "Kevent", err)
 	}
-	nfo.watch = &watch{fd: fd}
-	w.fdmap[fd] = nfo
 	return nil
 }
 
+// rearm registers the event of nfo again after the kernel deleted its fired one shot
+// event, or replaces it with a permanent event once the oneshot flag is cleared.
+func (w *watcher) rearm(nfo *info) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.fd == -1 || nfo.watch == nil || w.fdmap[nfo.watch.fd] != nfo {
+		return
+	}
+	// the event may still be registered, a one shot flag is not cleared by EV_ADD
+	ev := []syscall.Kevent_t{{}}
+	syscall.SetKevent(&ev[0], nfo.watch.fd, syscall.EVFILT_VNODE, syscall.EV_DELETE)
+	syscall.Kevent(w.fd, ev, nil, nil)
+	if err := w.register(nfo.watch.fd, nfo, w.flags); err != nil {
+		w.context.Error(err)
+	}
+}
+
 func (w *watcher) unload(path string, recursive bool) error {
 	w.mutex.RLock()
 	fd := w.fd
@@ -98,15 +175,16 @@ func (w *watcher) unload(path string, recursive bool) error {
 	if fd == -1 {
 		return ErrClosed
 	}
-	if nfo == nil || nfo.watch == nil {
+	if nfo == nil {
 		return nil
 	}
 	w.mutex.Lock()
-	var err error
-	if nfo.watch != nil {
-		err = w.rm(nfo)
-		nfo.watch = nil
+	if nfo.watch == nil {
+		w.mutex.Unlock()
+		return nil
 	}
+	err := w.rm(nfo)
+	nfo.setWatch(nil)
 	var reload []*info
 	w.tree.deleteAll(nfo.path, func(nfo *info) {
 		if !recursive && nfo.flags&explicit != 0 && nfo.path != path {
@@ -124,15 +202,55 @@ func (w *watcher) unload(path string, recursive bool) error {
 	return err
 }
 
+// rm closes the watch of nfo. The descriptor is forgotten even if close fails,
+// it must not be mapped to nfo once it is reused.
 func (w *watcher) rm(nfo *info) error {
+	delete(w.fdmap, nfo.watch.fd)
 	err := syscall.Close(nfo.watch.fd)
 	if err != nil {
-		return os.NewSyscallError("Close rm", err)
+		return watchError("rm", nfo.path, "Close", err)
 	}
-	delete(w.fdmap, nfo.watch.fd)
 	return nil
 }
 
+// unwatch removes the watches of all infos in list but keeps them cached
+func (w *watcher) unwatch(list []*info) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	var err error
+	for _, nfo := range list {
+		if nfo.watch == nil {
+			continue
+		}
+		if e := w.rm(nfo); e != nil && err == nil {
+			err = e
+		}
+		nfo.setWatch(nil)
+	}
+	return err
+}
+
+// forget releases the watch of a deleted info.
+// It expects the watcher mutex to be held.
+func (w *watcher) forget(nfo *info) {
+	if nfo.watch != nil {
+		if err := w.rm(nfo); err != nil {
+			w.context.Error(err)
+		}
+	}
+}
+
+// descriptors returns the paths of all watches by descriptor
+func (w *watcher) descriptors() map[int]string {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	res := make(map[int]string, len(w.fdmap))
+	for fd, nfo := range w.fdmap {
+		res[fd] = nfo.path
+	}
+	return res
+}
+
 func (w *watcher) close() error {
 	w.mutex.RLock()
 	fd := w.fd
@@ -140,9 +258,16 @@ func (w *watcher) close() error {
 	if fd == -1 {
 		return ErrClosed
 	}
-	w.signal <- func() bool {
+	// the watches are closed in the run loop, so no event is handled with a closed watch
+	sig := func() bool {
 		w.mutex.Lock()
 		defer w.mutex.Unlock()
+		for _, nfo := range w.fdmap {
+			if err := w.rm(nfo); err != nil {
+				w.context.Error(err)
+			}
+			nfo.setWatch(nil)
+		}
 		err := syscall.Close(fd)
 		if err != nil {
 			w.context.Error(os.NewSyscallError("Close close", err))
@@ -150,21 +275,49 @@ func (w *watcher) close() error {
 		w.fdmap = nil
 		return true
 	}
+	select {
+	case w.signal <- sig:
+	case <-w.done:
+		return ErrClosed
+	}
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
-	for _, nfo := range w.fdmap {
-		err := w.rm(nfo)
-		if err != nil {
-			w.context.Error(err)
-		}
-	}
 	w.fd = -1
 	return nil
 }
 
+// serial runs fn in the run loop and waits for it.
+// It returns ErrClosed if the watcher was closed before fn could run.
+func (w *watcher) serial(fn func()) error {
+	w.mutex.RLock()
+	closed := w.fd == -1
+	w.mutex.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+	ran := make(chan struct{})
+	sig := func() bool {
+		fn()
+		close(ran)
+		return false
+	}
+	select {
+	case w.signal <- sig:
+	case <-w.done:
+		return ErrClosed
+	}
+	select {
+	case <-ran:
+		return nil
+	case <-w.done:
+		return ErrClosed
+	}
+}
+
 func (w *watcher) run(fd int) {
 	var buf [1024]syscall.Kevent_t
 	wait := syscall.NsecToTimespec(50e6)
+	defer close(w.done)
 	for {
 		n, err := syscall.Kevent(fd, nil, buf[:], &wait)
 		select {
@@ -180,52 +333,173 @@ func (w *watcher) run(fd int) {
 			}
 			continue
 		}
-		for _, ev := range buf[:n] {
-			w.mutex.Lock()
+		events := buf[:n]
+		// the renames are handled first, so that the write event of the parent
+		// does not load the new path as Create before the renamed file is moved
+		sort.SliceStable(events, func(i, j int) bool {
+			return events[i].Fflags&syscall.NOTE_RENAME != 0 && events[j].Fflags&syscall.NOTE_RENAME == 0
+		})
+		w.beginBatch()
+		for _, ev := range events {
+			w.mutex.RLock()
 			nfo := w.fdmap[int(ev.Ident)]
-			w.mutex.Unlock()
-			if nfo == nil || nfo.watch == nil {
-				w.context.Error(fmt.Errorf("unknown watch"))
+			watched := nfo != nil && nfo.watch != nil
+			w.mutex.RUnlock()
+			if !watched {
+				// the watch was removed by an unload after the event was read
 				continue
 			}
 			w.handle(ev.Fflags, nfo)
+			if nfo.has(oneshot) {
+				// the kernel deleted the one shot event after it fired
+				w.rearm(nfo)
+			}
 		}
+		w.endBatch()
+	}
+}
+
+// linked returns whether the file watched by nfo still has a link on disk
+func (w *watcher) linked(nfo *info) bool {
+	var st syscall.Stat_t
+	// the read lock keeps an unload from closing the watch while in use
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	if nfo.watch == nil || syscall.Fstat(nfo.watch.fd, &st) != nil {
+		return false
+	}
+	return st.Nlink > 0
+}
+
+// rekey moves the renamed file or the cached subtree of the renamed directory nfo to
+// its new path, keeping the watches open. It reports the move as Rename events.
+// It returns false if the new path is unknown or not below a cached directory.
+func (w *watcher) rekey(nfo *info) bool {
+	w.mutex.RLock()
+	if nfo.watch == nil {
+		w.mutex.RUnlock()
+		return false
+	}
+	path, err := fdpath(nfo.watch.fd)
+	if err == nil {
+		path = w.logical(path)
+	}
+	w.mutex.RUnlock()
+	if err != nil {
+		return false
+	}
+	return path != nfo.path && w.rename(nfo.path, path)
+}
+
+// rediscover loads new entries in the cached directory at path
+func (w *watcher) rediscover(path string) {
+	w.mutex.RLock()
+	dir := w.tree.get(path)
+	w.mutex.RUnlock()
+	if dir == nil {
+		return
+	}
+	err := w.loadImpl(path, dir.flags&recurse, Create, w.flags, w.flags, nil)
+	if err != nil && err != SkipDir && !os.IsNotExist(err) {
+		w.context.Error(err)
+	}
+}
+
+// rewatch adds the missing watches of the cached subdirectories of the recursively
+// watched directory dir and loads their new entries. A burst of nested creates can leave
+// a directory cached but unwatched, if it vanished or moved while its watch was opened.
+func (w *watcher) rewatch(dir *info) {
+	if !dir.has(recurse) {
+		return
+	}
+	var missing []*info
+	var errs []error
+	w.mutex.Lock()
+	if w.fd != -1 {
+		w.tree.walk(dir.path, func(fi FileInfo) error {
+			nfo := fi.(*info)
+			if nfo == dir || !nfo.IsDir() {
+				return nil
+			}
+			if nfo.watch == nil && !nfo.has(stale) && !nfo.Ignored() {
+				err := w.add(nfo, w.flags)
+				if err == nil {
+					missing = append(missing, nfo)
+				} else if !errors.Is(err, os.ErrNotExist) {
+					errs = append(errs, err)
+				}
+			}
+			return SkipDir
+		})
+	}
+	w.mutex.Unlock()
+	// the errors are reported without the lock, because the handler may use the watcher
+	for _, err := range errs {
+		w.context.Error(err)
+	}
+	for _, nfo := range missing {
+		w.rediscover(nfo.path)
+		w.rewatch(nfo)
 	}
 }
 
 func (w *watcher) handle(mask uint32, nfo *info) {
+	if !w.cached(nfo) {
+		return
+	}
+	if mask&syscall.NOTE_RENAME != 0 && w.selfMoved(nfo.path) {
+		// the subtree was already moved by Watcher.Move
+		return
+	}
+	nfo.setSys(mask)
 	path, fi := nfo.path, nfo
+	if mask&syscall.NOTE_RENAME != 0 && w.rekey(nfo) {
+		return
+	}
 	if mask&deleteFlags != 0 {
+		if mask&syscall.NOTE_REVOKE != 0 {
+			// tell an unmount from deleted files
+			w.context.Error(&WatchError{"revoke", path, ErrRevoked})
+		}
+		// a renamed file is still linked and can be rediscovered
+		renamed := mask&syscall.NOTE_RENAME != 0 && w.linked(nfo)
 		var list []*info
 		w.mutex.Lock()
 		w.tree.deleteAll(nfo.path, func(fi *info) {
-			if fi.watch != nil {
-				delete(w.fdmap, fi.watch.fd)
-			}
+			w.forget(fi)
 			list = append(list, fi)
 		})
 		w.mutex.Unlock()
 		for _, fi = range list {
-			w.context.Handle(Delete, fi)
+			w.dispatch(Delete, fi)
+		}
+		if renamed {
+			w.rediscover(filepath.Dir(path))
+		} else if nfo.has(followed) {
+			w.unfollow(nfo)
 		}
 		return
 	}
 	if nfo.IsDir() && mask&modifyFlags != 0 {
-		err := w.loadImpl(path, fi.flags&recurse, Create, allFlags, allFlags)
+		err := w.loadImpl(path, fi.flags&recurse, Create, w.flags, w.flags, nil)
 		if err != nil && err != SkipDir {
 			if !os.IsNotExist(err) {
 				w.context.Error(err)
 			}
 		}
+		w.rewatch(fi)
 	} else {
-		nfi, err := os.Lstat(nfo.path)
+		nfi, err := nfo.stat()
 		if err != nil {
 			if !os.IsNotExist(err) {
 				w.context.Error(err)
 			}
 			return
 		}
-		fi.update(nfi)
-		w.context.Handle(Modify, fi)
+		if mask&modifyFlags == syscall.NOTE_ATTRIB {
+			w.chattr(fi, nfi)
+		} else {
+			w.modify(fi, nfi)
+		}
 	}
 }
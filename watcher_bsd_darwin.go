@@ -2,12 +2,32 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// +build darwin
+// +build darwin,!poll
 
 package fswatch
 
-import "syscall"
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
 
 func init() {
 	openwdFlags = syscall.O_EVTONLY
 }
+
+// fdpath returns the current path of the file opened as fd
+func fdpath(fd int) (string, error) {
+	// the buffer must be at least MAXPATHLEN bytes
+	var buf [1024]byte
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETPATH, uintptr(unsafe.Pointer(&buf[0])))
+	if errno != 0 {
+		return "", os.NewSyscallError("F_GETPATH", errno)
+	}
+	for i, c := range buf {
+		if c == 0 {
+			return string(buf[:i]), nil
+		}
+	}
+	return string(buf[:]), nil
+}
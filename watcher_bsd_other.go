@@ -0,0 +1,17 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build freebsd,!poll openbsd,!poll netbsd,!poll
+
+package fswatch
+
+import "errors"
+
+var errNoPath = errors.New("cannot read the path of a file descriptor")
+
+// fdpath returns the current path of the file opened as fd.
+// It is not supported on this platform and renamed files are found by rescanning their parent.
+func fdpath(fd int) (string, error) {
+	return "", errNoPath
+}
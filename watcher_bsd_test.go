@@ -0,0 +1,73 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build freebsd,!poll openbsd,!poll netbsd,!poll darwin,!poll
+
+package fswatch
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func TestRevoke(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	dir := env.mkdir(env.root, "dir")
+	file := env.createWriteClose(dir, "file")
+	env.sleep()
+	env.check()
+	w := env.watcher
+	w.mutex.RLock()
+	nfo := w.tree.get(dir)
+	w.mutex.RUnlock()
+	// simulate the revoke of an unmounted directory
+	w.handle(syscall.NOTE_REVOKE, nfo)
+	env.expect = append(env.expect, record{Delete, dir, false}, record{Delete, file, false})
+	env.check()
+	env.Lock()
+	defer env.Unlock()
+	var werr *WatchError
+	if len(env.errors) != 1 || !errors.As(env.errors[0], &werr) || werr.Path != dir || !errors.Is(werr, ErrRevoked) {
+		t.Errorf("expected a revoke error for %s got %v", dir, env.errors)
+	}
+	env.errors = nil
+}
+
+func TestRenameFile(t *testing.T) {
+	if runtime.GOOS != "darwin" {
+		t.Skip("requires the path of a file descriptor")
+	}
+	env := newtestenv(t)
+	defer env.close()
+	file := env.createWriteClose(env.root, "file")
+	env.sleep()
+	env.check()
+	w := env.watcher
+	w.mutex.RLock()
+	before := w.tree.get(file)
+	w.mutex.RUnlock()
+	if before == nil || before.watch == nil {
+		t.Fatal("expected a watched file")
+	}
+	fd := before.watch.fd
+	other := filepath.Join(env.root, "other")
+	if err := os.Rename(file, other); err != nil {
+		t.Fatal("failed to rename.", err)
+	}
+	env.sleep()
+	// the renamed file keeps its cached info and watch
+	env.expect = append(env.expect, record{Rename, other, false})
+	env.check()
+	w.mutex.RLock()
+	after := w.tree.get(other)
+	w.mutex.RUnlock()
+	if after != before || after.watch == nil || after.watch.fd != fd {
+		t.Errorf("expected the moved info with watch %d got %v", fd, after)
+	}
+}
@@ -6,17 +6,37 @@ package fswatch
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
-// Create, Modify and Delete are all possible events
-// that can be received by `Context.Handle`
+// Create, Modify, Delete, Rename and Chmod are all possible events
+// that can be received by `Context.Handle`.
+// Rename is delivered with a `*RenameChange` where the backend can correlate
+// both paths, otherwise a rename is reported as Delete and Create.
+// Chmod is delivered instead of Modify if the attributes of a file changed
+// but neither its size nor its modification time.
+// A Modify of a file shortly after its Create is not delivered if the file did not
+// change since the Create, see `Context.CreateWindow`.
 const (
 	Create Event = 1 << iota
 	Modify
 	Delete
+	Rename
+	Chmod
+)
+
+// StructureChanges, ContentChanges and Attributes select the kinds of changes
+// the kernel should report. They can be combined in `Context.EventMask`.
+const (
+	StructureChanges Mask = 1 << iota
+	ContentChanges
+	Attributes
 )
 
 // ErrClosed is returned if the watcher cannot take action because it is closed.
@@ -25,18 +45,86 @@ var ErrClosed = errors.New("watcher was already closed")
 // ErrNotDir is used to indicate that the watcher cannot load a path because it is not directory.
 var ErrNotDir = errors.New("can only watch directories")
 
+// ErrNotWatched is returned if a path is neither cached nor directly below a cached directory.
+var ErrNotWatched = errors.New("path is not watched")
+
+// ErrWatchLimit is returned if a watch cannot be added because the kernel limit is reached,
+// like the inotify limit `/proc/sys/fs/inotify/max_user_watches` or the open file limit
+// of kqueue. Load stops adding watches below the root once the limit is reached.
+var ErrWatchLimit = errors.New("watch limit reached")
+
+// WatchError is passed to `Context.Error` or returned by Load if a watch for a path
+// could not be added or removed or its events could not be read.
+type WatchError struct {
+	// Op is the failed operation "add", "rm", "read" or "revoke"
+	Op string
+	// Path is the path of the watched file
+	Path string
+	// Err is the error of the failed system call
+	Err error
+}
+
+func (e *WatchError) Error() string {
+	return e.Op + " " + e.Path + ": " + e.Err.Error()
+}
+
+// Unwrap returns the error of the failed system call
+func (e *WatchError) Unwrap() error {
+	return e.Err
+}
+
+// watchError returns a `*WatchError` for the failed system call of op on path
+func watchError(op, path, call string, err error) error {
+	return &WatchError{op, path, os.NewSyscallError(call, err)}
+}
+
+// ErrRevoked is passed to `Context.Error` in a `*WatchError` with the op "revoke" before
+// the Delete events of a watched file whose access was revoked, like when its file system
+// was unmounted. Only the kqueue backend reports it.
+var ErrRevoked = errors.New("watch revoked")
+
 // ErrOverflow is used to indicated that the watcher may have missed any number of file events.
 var ErrOverflow = errors.New("watcher overflow")
 
+// ErrPipeFull is passed to `Context.Error` once the queue of a `Watcher.Pipe` or
+// `Watcher.Stream` reached `Context.PipeLimit` and events are dropped until the
+// consumer catches up.
+var ErrPipeFull = errors.New("pipe queue full")
+
 // SkipDir is the same as `filepath.SkipDir` and used as a return value from the functions passed to
 // Walk or Traverse to indicate that the directory named in the call is to be skipped.
 var SkipDir = filepath.SkipDir
 
 var errShortRead = errors.New("short read")
 
-// Event is either Create, Modify or Delete
+// BackendInfo describes the platform specific watcher implementation
+type BackendInfo struct {
+	// Name is the name of the notification mechanism like "inotify", "kqueue" or "iocp"
+	Name string
+	// ReportsRename is true if renames within the watched tree are reported as Rename.
+	// Other backends report Delete and Create, or Rename only for some files.
+	ReportsRename bool
+	// PerFileGranularity is true if every file has its own watch
+	PerFileGranularity bool
+	// DetectsAttrib is true if attribute changes are reported by default
+	DetectsAttrib bool
+	// NativeRecursive is true if the kernel watches directories recursively,
+	// see `Context.SubtreeWatch`
+	NativeRecursive bool
+	// ReportsClose is true if closing a written file is reported
+	ReportsClose bool
+	// ReportsRepeats is true if a single change may be reported more than once.
+	// A Modify of an unchanged file shortly after its last event is then dropped.
+	ReportsRepeats bool
+}
+
+// Event is either Create, Modify, Delete, Rename or Chmod
 type Event uint
 
+// Mask is a combination of StructureChanges, ContentChanges and Attributes.
+// The zero mask uses the platform's default set of changes.
+type Mask uint
+
 func (e Event) String() string {
 	switch e {
 	case Create:
@@ -45,6 +133,10 @@ func (e Event) String() string {
 		return "Modify"
 	case Delete:
 		return "Delete"
+	case Rename:
+		return "Rename"
+	case Chmod:
+		return "Chmod"
 	}
 	return "Unknown"
 }
@@ -66,57 +158,876 @@ func defaults(ctx *Context) Context {
 	return c
 }
 
-func (w *watcher) loadImpl(root string, flags uint, event Event, rootflags, otherflags uint32) error {
-	fi, err := os.Lstat(root)
+// seed loads the roots of NewWith before the run loop starts
+// and returns the errors of the roots as `LoadErrors`
+func (w *watcher) seed(roots []Root) error {
+	var errs LoadErrors
+	for _, r := range roots {
+		opts := r.Options
+		if r.Recursive && r.Depth >= 0 {
+			opts = append(opts[:len(opts):len(opts)], loadDepth(r.Depth))
+		}
+		err := Watcher{w}.loadRoot(r.Path, r.Recursive, opts)
+		switch e := err.(type) {
+		case nil:
+		case LoadErrors:
+			errs = append(errs, e...)
+		case *LoadError:
+			errs = append(errs, e)
+		default:
+			errs = append(errs, &LoadError{filepath.Clean(r.Path), err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// initialEvent returns the event dispatched for the files cached by Load with opts
+func (c *Context) initialEvent(opts *loadOptions) Event {
+	if c.EmitInitial || opts != nil && opts.syncInitial {
+		return Create
+	}
+	return 0
+}
+
+// bufferSize returns `Context.BufferSize` or def if it is zero.
+// It returns an error if the size is smaller than min, the size of the longest event.
+func bufferSize(c *Context, def, min int) (int, error) {
+	switch size := c.BufferSize; {
+	case size == 0:
+		return def, nil
+	case size < min:
+		return 0, fmt.Errorf("buffer size %d is smaller than the longest event of %d bytes", size, min)
+	default:
+		return size, nil
+	}
+}
+
+// shared holds the watcher state common to all backends
+type shared struct {
+	stats     stats
+	chains    chains
+	pending   map[string]pendingRoot
+	scoped    bool
+	persist   int
+	listeners map[int]func(EventInfo)
+	listenID  int
+	links     map[string]string
+	paused    map[string][]*info
+	dirs      dirDebounce
+	bulk      bulkCoalesce
+	settle    settling
+	rate      throttling
+	quieting  quieting
+	chans     channels
+	batch     batching
+	lost      lostRoots
+	creations creations
+	moves     selfMoves
+	shots     oneShots
+	clock     clock
+	tickers   tickers
+	// repeats is whether the backend repeats notifications, see `BackendInfo.ReportsRepeats`
+	repeats bool
+	// seq is the sequence number of the last observed event and accessed atomically
+	seq uint64
+	// filter holds the current `Context.Filter` and is swapped by SetFilter
+	filter atomic.Value
+	// done is closed when the run loop returns
+	done chan struct{}
+}
+
+// init prepares the shared state for a new watcher with the context c
+func (s *shared) init(c *Context) {
+	s.done = make(chan struct{})
+	s.clock = realClock{}
+	s.repeats = backend.ReportsRepeats
+	s.filter.Store(c.Filter)
+	s.dirs.setWindow(c.DebounceByDir)
+	s.quieting.setWindow(c.Debounce)
+	s.chans.init(c)
+}
+
+// stamp is the sequence number and time of an event when the watcher observed it
+type stamp struct {
+	seq  uint64
+	time time.Time
+}
+
+// observe returns the stamp of a newly observed event
+func (w *watcher) observe() stamp {
+	return stamp{atomic.AddUint64(&w.seq, 1), w.clock.now()}
+}
+
+// dispatch delivers the event for fi unless it is handled for a pending root,
+// debounced by directory or held back in a rename chain
+func (w *watcher) dispatch(event Event, fi *info) {
+	s := w.observe()
+	if event == Delete && w.context.RetryWatch && fi.has(explicit) && !fi.has(persisted) {
+		w.lose(fi)
+	}
+	if w.context.CreateOnClose && !fi.has(initial) && w.settles(event, fi, s) {
+		return
+	}
+	w.dispatchAt(event, fi, fi, s)
+}
+
+// dispatchInitial dispatches the Create of f, if dispatched and not vanished,
+// for a load with `WithSyncInitial` so it is delivered directly
+func (w *watcher) dispatchInitial(f *info, dispatched bool) {
+	if !dispatched || w.vanished(f) {
+		return
+	}
+	f.mutex.Lock()
+	f.flags |= initial
+	f.mutex.Unlock()
+	w.dispatch(Create, f)
+	f.mutex.Lock()
+	f.flags &^= initial
+	f.mutex.Unlock()
+}
+
+// dispatchAs is like dispatch but delivers the event with the FileInfo as
+func (w *watcher) dispatchAs(event Event, fi *info, as FileInfo) {
+	w.dispatchAt(event, fi, as, w.observe())
+}
+
+// dispatchAt is like dispatchAs for an event observed with the stamp s
+func (w *watcher) dispatchAt(event Event, fi *info, as FileInfo, s stamp) {
+	w.touch(fi)
+	if (event == Create || event == Delete) && fi.Links() > 1 && !fi.IsDir() {
+		// the link counts of the other cached links changed as well
+		defer w.relink(fi)
+	}
+	if w.context.ModifyParent && (event == Create || event == Delete || event == Rename) {
+		defer w.modifyParents(fi, as)
+	}
+	if w.created(event, fi) {
+		return
+	}
+	if !fi.has(initial) && w.masked(event) {
+		return
+	}
+	if w.dispatchPersist(event, fi, s) {
+		return
+	}
+	if w.fireShots(event, fi, as, s) {
+		return
+	}
+	opts := w.rootOptions(fi)
+	if !opts.wanted(event, fi.path) {
+		return
+	}
+	if w.pausedAt(fi.path) {
+		return
+	}
+	if opts != nil && opts.oneShot {
+		if !opts.fire() {
+			return
+		}
+		// unload asynchronously, because some backends unload on this goroutine
+		go w.unloadShot(opts.root)
+	}
+	if fi.has(initial) {
+		// the initial events of a synchronous load are not held back
+		w.deliver(event, as, s)
+		return
+	}
+	if w.quieting.window() > 0 && w.quiet(event, fi, as, s) {
+		return
+	}
+	w.limit(event, fi, as, s)
+}
+
+// masked returns whether the event is not selected by `Context.EventMask`. The backends
+// report changes that are not selected as well, deletes to keep the cache consistent
+// and other changes if the kernel flags are not fine grained enough.
+func (w *watcher) masked(event Event) bool {
+	mask := w.context.EventMask
+	if mask == 0 {
+		return false
+	}
+	switch event {
+	case Create, Delete, Rename:
+		return mask&StructureChanges == 0
+	case Modify:
+		return mask&ContentChanges == 0
+	case Chmod:
+		return mask&Attributes == 0
+	}
+	return false
+}
+
+// limit delivers the event for fi unless it is throttled
+func (w *watcher) limit(event Event, fi *info, as FileInfo, s stamp) {
+	if w.context.Throttle > 0 && w.throttle(event, fi, as, s) {
+		return
+	}
+	w.coalesce(event, fi, as, s)
+}
+
+// coalesce delivers the event for fi unless it is coalesced in bulk or debounced by directory
+func (w *watcher) coalesce(event Event, fi *info, as FileInfo, s stamp) {
+	if w.context.CoalesceBulk && w.coalesceBulk(event, fi, as, s) {
+		return
+	}
+	w.debounce(event, fi, as, s)
+}
+
+// debounce delivers the event for fi unless it is debounced by directory
+// or held back in a rename chain
+func (w *watcher) debounce(event Event, fi *info, as FileInfo, s stamp) {
+	if w.dirs.window() > 0 && w.debounceDir(fi, s) {
+		return
+	}
+	if w.context.RenameWindow > 0 && w.chain(event, fi, as, s) {
+		return
+	}
+	w.deliver(event, as, s)
+}
+
+// deliver calls the context handlers and all listeners with the event for fi
+// and passes the stamp s to `Context.HandleInfo` and the listeners
+func (w *watcher) deliver(event Event, fi FileInfo, s stamp) {
+	if w.context.BatchHandle == nil {
+		w.context.Handle(event, fi)
+	}
+	if w.context.HandleW != nil {
+		w.context.HandleW(Watcher{w}, event, fi)
+	}
+	if opts := w.rootOptions(fi); opts != nil && opts.handler != nil {
+		opts.handler(event, fi)
+	}
+	e := EventInfo{event, fi, s.seq, s.time, 0}
+	if raw, ok := fi.Sys().(uint32); ok {
+		e.raw = raw
+	}
+	if w.context.HandleInfo != nil {
+		w.context.HandleInfo(e)
+	}
+	if w.context.BatchHandle != nil {
+		w.batchEvent(e)
+	}
+	w.mutex.RLock()
+	if len(w.listeners) == 0 {
+		w.mutex.RUnlock()
+		return
+	}
+	list := make([]func(EventInfo), 0, len(w.listeners))
+	for _, l := range w.listeners {
+		list = append(list, l)
+	}
+	w.mutex.RUnlock()
+	for _, l := range list {
+		l(e)
+	}
+}
+
+// listen registers a function that is called for every event after the context handlers
+// and returns an id for unlisten
+func (w *watcher) listen(l func(EventInfo)) int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.listeners == nil {
+		w.listeners = make(map[int]func(EventInfo))
+	}
+	w.listenID++
+	w.listeners[w.listenID] = l
+	return w.listenID
+}
+
+// unlisten removes the listener with id
+func (w *watcher) unlisten(id int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	delete(w.listeners, id)
+}
+
+// modify updates fi with nfi and dispatches a Modify or Chmod event
+// if the change is accepted by `Context.ModifyPredicate`.
+// A Modify is delivered with a `*ContentChange`, a change of only the link count
+// with a `*LinkChange`.
+func (w *watcher) modify(fi *info, nfi os.FileInfo) {
+	w.change(fi, nfi, false)
+}
+
+// chattr is like modify for a notification that only signals changed attributes
+func (w *watcher) chattr(fi *info, nfi os.FileInfo) {
+	w.change(fi, nfi, true)
+}
+
+// change implements modify and chattr
+func (w *watcher) change(fi *info, nfi os.FileInfo, attrib bool) {
+	if fi.has(stale) {
+		// frozen entries are not updated
+		return
+	}
+	if w.context.CreateOnClose && w.held(fi) {
+		fi.update(nfi)
+		return
+	}
+	old := fi.snapshot()
+	fi.update(nfi)
+	if !attrib && w.repeated(fi, old, nfi) {
+		return
+	}
+	if pred := w.context.ModifyPredicate; pred == nil || pred(old.Freeze(), nfi) {
+		event := changeEvent(old, nfi, attrib)
+		if attrib && w.masked(Modify) {
+			// the cache misses the content changes that are not selected by the mask
+			event = Chmod
+		}
+		if old.nlink != fi.Links() && old.modt.Equal(nfi.ModTime()) &&
+			old.size == nfi.Size() && old.mode == nfi.Mode() {
+			w.dispatchAs(Modify, fi, &LinkChange{fi, old.nlink})
+		} else if event == Modify {
+			w.dispatchAs(Modify, fi, &ContentChange{fi, old.size, nfi.Size(), old.modt})
+		} else {
+			w.dispatch(event, fi)
+		}
+	}
+	if nfi.IsDir() && (old.mode != nfi.Mode() || old.flags&unreadable != 0) {
+		// only a permission change can make the directory readable again
+		w.regain(fi)
+	}
+}
+
+// repeatWindow is the time after the last event of a file in which a notification of
+// the unchanged file is taken as a repeat, see `BackendInfo.ReportsRepeats`
+const repeatWindow = 10 * time.Millisecond
+
+// repeated returns whether the backend repeats notifications and the file fi with the
+// previous state old did not change since its last event within repeatWindow
+func (w *watcher) repeated(fi, old *info, nfi os.FileInfo) bool {
+	if !w.repeats || nfi.IsDir() || !old.modt.Equal(nfi.ModTime()) ||
+		old.size != nfi.Size() || old.mode != nfi.Mode() || old.nlink != fi.Links() {
+		return false
+	}
+	fi.mutex.RLock()
+	last := fi.last
+	fi.mutex.RUnlock()
+	return !last.IsZero() && w.clock.now().Sub(last) < repeatWindow
+}
+
+// afterFunc calls fn after d like the clock unless the watcher was closed in the
+// meantime, so that no held back event is delivered after Close
+func (w *watcher) afterFunc(d time.Duration, fn func()) timer {
+	return w.clock.afterFunc(d, func() {
+		if !(Watcher{w}).Closed() {
+			fn()
+		}
+	})
+}
+
+// changeEvent returns Chmod if the size and modification time of nfi are those of old
+// and either the mode changed or the notification signaled attributes only,
+// otherwise Modify. The time and size of directories change with their children
+// and are ignored.
+func changeEvent(old *info, nfi os.FileInfo, attrib bool) Event {
+	same := old.modt.Equal(nfi.ModTime()) && old.size == nfi.Size() || old.IsDir() && nfi.IsDir()
+	if same && (attrib || old.mode != nfi.Mode()) {
+		return Chmod
+	}
+	return Modify
+}
+
+// relink updates the other cached hard links of fi after a link was created or deleted
+func (w *watcher) relink(fi *info) {
+	w.mutex.Lock()
+	list := w.tree.linked(fi)
+	w.mutex.Unlock()
+	for _, nfo := range list {
+		nfi, err := os.Lstat(nfo.path)
+		if err != nil {
+			continue
+		}
+		if _, _, nlink := statIDs(nfi); nlink != nfo.Links() {
+			w.modify(nfo, nfi)
+		}
+	}
+}
+
+// watches returns whether nfo gets its own watch. Only directories and, with
+// `Context.WatchExts`, files with a listed extension are watched.
+func (w *watcher) watches(nfo *info) bool {
+	if !watchFilter(nfo) {
+		return false
+	}
+	exts := w.context.WatchExts
+	if len(exts) == 0 || nfo.IsDir() {
+		return true
+	}
+	ext := strings.TrimPrefix(filepath.Ext(nfo.path), ".")
+	for _, e := range exts {
+		if ext != "" && strings.TrimPrefix(e, ".") == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// touch records the time of an event for fi and its cached directory
+func (w *watcher) touch(fi *info) {
+	now := w.clock.now()
+	fi.touch(now)
+	w.mutex.RLock()
+	dir := w.tree.get(filepath.Dir(fi.path))
+	w.mutex.RUnlock()
+	if dir != nil && dir != fi {
+		dir.touch(now)
+	}
+}
+
+// modifyParents dispatches a Modify for the changed directories of fi
+// and, for a rename delivered as `*RenameChange`, of its old path
+func (w *watcher) modifyParents(fi *info, as FileInfo) {
+	dirs := []string{filepath.Dir(fi.path)}
+	if r, ok := as.(*RenameChange); ok && filepath.Dir(r.OldPath()) != dirs[0] {
+		dirs = append(dirs, filepath.Dir(r.OldPath()))
+	}
+	for _, dir := range dirs {
+		w.mutex.RLock()
+		nfo := w.tree.get(dir)
+		w.mutex.RUnlock()
+		if nfo == nil || nfo.has(ignored) {
+			continue
+		}
+		nfi, err := nfo.stat()
+		if err != nil {
+			continue
+		}
+		nfo.mutex.RLock()
+		changed := !nfo.modt.Equal(nfi.ModTime())
+		nfo.mutex.RUnlock()
+		if changed {
+			w.modify(nfo, nfi)
+		}
+	}
+}
+
+// regain watches and rescans the directory fi if it was unreadable and can be read again.
+// Directories that become unreadable are marked to be rescanned later.
+func (w *watcher) regain(fi *info) {
+	f, err := os.Open(fi.path)
+	if err == nil {
+		f.Close()
+	}
+	fi.mutex.Lock()
+	was := fi.flags&unreadable != 0
+	if err == nil {
+		fi.flags &^= unreadable
+	} else if os.IsPermission(err) {
+		fi.flags |= unreadable
+	}
+	fi.mutex.Unlock()
+	if !was || err != nil {
+		return
+	}
+	w.mutex.Lock()
+	if fi.watch == nil && w.watches(fi) {
+		err = w.addTimed(fi, w.flags)
+	}
+	var flags uint
+	if anc := w.tree.ancestor(fi.path, explicit); anc != nil {
+		anc.mutex.RLock()
+		flags = anc.flags & recurse
+		anc.mutex.RUnlock()
+	}
+	w.mutex.Unlock()
+	if err != nil {
+		w.context.Error(err)
+	}
+	err = w.loadImpl(fi.path, flags, Create, w.flags, w.flags, nil)
+	if err != nil && err != SkipDir && !os.IsNotExist(err) {
+		w.context.Error(err)
+	}
+}
+
+// vanished removes fi from the cache and returns true if it no longer exists.
+// Creates for vanished files are not delivered, so that their deletes,
+// which may have been missed, are not expected by consumers.
+func (w *watcher) vanished(fi *info) bool {
+	if _, err := os.Lstat(fi.path); !os.IsNotExist(err) {
+		return false
+	}
+	w.mutex.Lock()
+	w.tree.deleteAll(fi.path, w.forget)
+	w.mutex.Unlock()
+	return true
+}
+
+// rescan reconciles the cached children of the directory nfo with the disk after
+// events may have been lost. Missing files are reported as Delete, new ones as Create.
+func (w *watcher) rescan(nfo *info) {
+	var gone []*info
+	w.mutex.RLock()
+	w.tree.walk(nfo.path, func(fi FileInfo) error {
+		if fi == FileInfo(nfo) {
+			return nil
+		}
+		if _, err := os.Lstat(fi.Path()); os.IsNotExist(err) {
+			gone = append(gone, fi.(*info))
+		}
+		if fi.IsDir() {
+			return SkipDir
+		}
+		return nil
+	})
+	var flags uint
+	if anc := w.tree.ancestor(nfo.path, explicit); anc != nil {
+		anc.mutex.RLock()
+		flags = anc.flags & recurse
+		anc.mutex.RUnlock()
+	}
+	w.mutex.RUnlock()
+	for _, fi := range gone {
+		var list []*info
+		w.mutex.Lock()
+		w.tree.deleteAll(fi.path, func(fi *info) {
+			w.forget(fi)
+			list = append(list, fi)
+		})
+		w.mutex.Unlock()
+		for _, fi = range list {
+			w.dispatch(Delete, fi)
+		}
+	}
+	err := w.loadImpl(nfo.path, flags, Create, w.flags, w.flags, nil)
+	if err != nil && err != SkipDir && !os.IsNotExist(err) {
+		w.context.Error(err)
+	}
+}
+
+// rename moves the cached subtree at path to the new path to, keeping the watches,
+// and dispatches a Rename with a `*RenameChange` for each moved file.
+// It returns false if the move should be reported as Delete and Create,
+// because path is not cached, the parent of to is not cached or the new path
+// is filtered. A rename over a cached file, like an atomic save, is reported
+// as Delete of the old path and Modify of the replaced file.
+func (w *watcher) rename(path, to string) bool {
+	w.mutex.RLock()
+	nfo := w.tree.get(path)
+	ok := nfo != nil && w.tree.get(filepath.Dir(to)) != nil && w.tree.get(to) == nil &&
+		!w.pathOptions(to).excluded(to)
+	w.mutex.RUnlock()
+	if !ok {
+		return false
+	}
+	moved := nfo.snapshot()
+	moved.path = to
+	if !w.accept(moved) {
+		return false
+	}
+	w.mutex.Lock()
+	if w.tree.get(path) != nfo || w.tree.get(to) != nil {
+		w.mutex.Unlock()
+		return false
+	}
+	var list []*info
+	w.tree.deleteAll(path, func(fi *info) {
+		list = append(list, fi)
+	})
+	old := make([]string, len(list))
+	for i, fi := range list {
+		old[i] = fi.move(to + fi.path[len(path):]).path
+		w.tree.insert(fi)
+	}
+	w.mutex.Unlock()
+	for i, fi := range list {
+		w.dispatchAs(Rename, fi, &RenameChange{fi, old[i]})
+	}
+	return true
+}
+
+// reconcile compares the cached subtree of nfo with the disk after events were lost.
+// Missing files are reported as Delete, changed ones as Modify and new ones as Create.
+// A file replaced by a directory or the reverse is reported as Delete and Create.
+// Compared directories missing their watch are watched again.
+// It returns the errors of watching and loading the new files.
+func (w *watcher) reconcile(nfo *info) error {
+	var list []*info
+	w.mutex.RLock()
+	w.tree.walk(nfo.path, func(fi FileInfo) error {
+		list = append(list, fi.(*info))
+		return nil
+	})
+	var flags uint
+	if anc := w.tree.ancestor(nfo.path, explicit); anc != nil {
+		anc.mutex.RLock()
+		flags = anc.flags & recurse
+		anc.mutex.RUnlock()
+	}
+	w.mutex.RUnlock()
+	var dirs []*info
+	for _, fi := range list {
+		if !w.cached(fi) {
+			// below a deleted directory
+			continue
+		}
+		nfi, err := fi.stat()
+		if err == nil && nfi.IsDir() != fi.IsDir() && fi != nfo {
+			// the parent directory loads the new file
+			err = os.ErrNotExist
+		}
+		if err == nil && nfi.IsDir() && (fi == nfo || flags&recurse != 0) {
+			dirs = append(dirs, fi)
+		}
+		if os.IsNotExist(err) {
+			var gone []*info
+			w.mutex.Lock()
+			w.tree.deleteAll(fi.path, func(fi *info) {
+				w.forget(fi)
+				gone = append(gone, fi)
+			})
+			w.mutex.Unlock()
+			for _, fi = range gone {
+				w.dispatch(Delete, fi)
+			}
+		} else if err == nil && differs(fi, nfi) {
+			w.modify(fi, nfi)
+		}
+	}
+	// load the new files of each directory, because cached directories are not descended
+	var errs LoadErrors
+	for _, fi := range dirs {
+		if !w.cached(fi) {
+			continue
+		}
+		w.mutex.Lock()
+		var err error
+		if fi.watch == nil && !fi.has(stale) && !fi.Ignored() && w.watches(fi) && !w.pathOptions(fi.path).unwatched(fi.path) {
+			err = w.add(fi, w.flags)
+		}
+		w.mutex.Unlock()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, &LoadError{fi.path, err})
+		}
+		err = w.loadImpl(fi.path, flags, Create, w.flags, w.flags, nil)
+		if err == nil || err == SkipDir || os.IsNotExist(err) {
+			continue
+		}
+		if list, ok := err.(LoadErrors); ok {
+			errs = append(errs, list...)
+		} else {
+			errs = append(errs, &LoadError{fi.path, err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// differs returns whether nfi differs from the cached fi. The time and size
+// of directories change with their children and are not compared.
+func differs(fi *info, nfi os.FileInfo) bool {
+	fi.mutex.RLock()
+	defer fi.mutex.RUnlock()
+	if fi.mode != nfi.Mode() {
+		return true
+	}
+	return !nfi.IsDir() && (!fi.modt.Equal(nfi.ModTime()) || fi.size != nfi.Size())
+}
+
+// cached returns whether nfo is still the cached info for its path.
+// It is used to drop events read before nfo was unloaded.
+func (w *watcher) cached(nfo *info) bool {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	return w.tree.get(nfo.path) == nfo
+}
+
+func (w *watcher) loadImpl(root string, flags uint, event Event, rootflags, otherflags uint32, opts *loadOptions) error {
+	scope := opts
+	if scope == nil {
+		w.mutex.RLock()
+		scope = w.pathOptions(root)
+		w.mutex.RUnlock()
+	}
+	if flags&explicit == 0 && scope.excluded(root) {
+		return nil
+	}
+	stat, walkroot := os.Lstat, root
+	if flags&explicit != 0 && opts != nil && opts.logical {
+		// follow a symlinked root but keep the loaded path
+		stat, walkroot = os.Stat, root+string(os.PathSeparator)
+	}
+	fi, err := stat(root)
 	if err != nil {
 		return err
 	}
+	if flags&explicit == 0 {
+		if lfi, ok := w.follow(root, fi); ok {
+			fi, walkroot = lfi, root+string(os.PathSeparator)
+			flags |= followed
+		}
+	}
 	if !fi.IsDir() && flags&explicit != 0 {
 		return ErrNotDir
 	}
 	f := newInfo(root, fi)
-	if !w.context.Filter(f) {
+	// the custom walk function of the initial load replaces the filters
+	var walkFn func(string, os.FileInfo) (bool, bool, error)
+	if opts != nil {
+		walkFn = opts.walk
+	}
+	watched, descend := true, true
+	if walkFn != nil {
+		watched, descend, err = walkFn(root, fi)
+		if err != nil {
+			return err
+		}
+	} else if !w.accept(f) {
 		return nil
 	}
 	f.flags |= flags
+	f.opts = opts
+	if opts != nil && opts.once {
+		f.flags |= oneshot
+	}
 	w.mutex.Lock()
 	dup := w.tree.insert(f)
+	if opts != nil {
+		w.scoped = true
+		if dup != nil {
+			dup.opts = w.mergeOptions(dup, opts)
+		}
+	}
+	// an explicit load adds the missing watch of a cached directory
+	rewatch := dup != nil && flags&explicit != 0 && dup.watch == nil && !w.inSubtree(root)
 	w.mutex.Unlock()
+	thawed := dup != nil && dup.thaw(fi)
 	if dup != nil {
 		dup.mutex.Lock()
-		dup.flags |= f.flags
+		if dup.flags&explicit == 0 && flags&explicit != 0 {
+			// the first explicit load decides whether an implicitly
+			// cached directory is recursive
+			dup.flags &^= recurse
+		}
+		// only a new root is watched with a one shot watch
+		dup.flags |= f.flags &^ oneshot
 		dup.mutex.Unlock()
 		// TODO(mb0) check if changed
 		//return nil
 		f = dup
-	} else if watchFilter(f) {
+	}
+	var failed []failedAdd
+	limited := false
+	// addWatch adds the watch for f and records the failure.
+	// It expects the watcher mutex to be held.
+	addWatch := func(f *info, flags uint32) {
+		if limited {
+			return
+		}
+		err := w.addTimed(f, flags)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			failed = append(failed, failedAdd{f, flags, err})
+			limited = err == ErrWatchLimit
+		}
+	}
+	// the limits of an ancestor root do not apply to an explicitly loaded root
+	rootScope := scope
+	if flags&explicit != 0 {
+		rootScope = opts
+	}
+	if (dup == nil || thawed || rewatch) && watched && (walkFn != nil || w.watches(f) && !rootScope.unwatched(root)) {
 		w.mutex.Lock()
-		err = w.add(f, rootflags)
+		addWatch(f, rootflags)
 		w.mutex.Unlock()
-		if err != nil {
-			if !os.IsNotExist(err) {
-				w.context.Error(err)
+	}
+	if limited && flags&explicit != 0 {
+		if dup == nil {
+			// remove the unwatched root, so that a later load adds the watch
+			w.mutex.Lock()
+			if w.tree.get(root) == f {
+				w.tree.deleteAll(root, func(*info) {})
 			}
+			w.mutex.Unlock()
 		}
+		return ErrWatchLimit
 	}
 	var list []*info
+	var blind LoadErrors
+	// follow holds the followed links to walk after walkroot,
+	// linkroot is the followed link that is walked
+	var follow []string
+	var linkroot string
 	walker := filepath.WalkFunc(func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
 			if !os.IsNotExist(err) {
-				w.context.Error(err)
+				blind = append(blind, &LoadError{path, err})
+			}
+			if fi == nil || !fi.IsDir() || !os.IsPermission(err) {
+				return nil
+			}
+			// the directory is cached and rescanned once it becomes readable
+			if path == linkroot {
+				return nil
+			}
+			if path == root || path == walkroot {
+				f.mutex.Lock()
+				f.flags |= unreadable
+				f.mutex.Unlock()
+				return nil
+			}
+			nf := newInfo(path, fi)
+			if !w.accept(nf) {
+				return nil
+			}
+			nf.flags |= unreadable
+			w.mutex.Lock()
+			defer w.mutex.Unlock()
+			if w.tree.insert(nf) == nil && event != 0 {
+				list = append(list, nf)
 			}
 			return nil
 		}
-		if path == root {
+		if path == root || path == walkroot || path == linkroot {
+			return nil
+		}
+		if scope.excluded(path) {
+			if fi.IsDir() {
+				return SkipDir
+			}
 			return nil
 		}
+		fi, linked := w.follow(path, fi)
 		f := newInfo(path, fi)
-		ignore := !w.context.Filter(f)
+		if linked {
+			f.flags |= followed
+		}
+		watched, descend, ignore := false, true, false
+		if walkFn != nil {
+			watched, descend, err = walkFn(path, fi)
+			if err != nil {
+				return err
+			}
+		} else {
+			watched = w.watches(f) && !scope.unwatched(path)
+			ignore = !w.accept(f)
+		}
 		w.mutex.Lock()
 		defer w.mutex.Unlock()
-		if w.tree.insert(f) != nil {
-			// TODO(mb0) check if changed
-			return SkipDir
+		if dup := w.tree.insert(f); dup != nil {
+			if !dup.thaw(fi) {
+				// TODO(mb0) check if changed
+				if fi.IsDir() {
+					return SkipDir
+				}
+				// skipping a file would skip its remaining siblings
+				return nil
+			}
+			// frozen entries are watched again
+			thawed, f = true, dup
+			if !ignore && watched {
+				addWatch(f, otherflags)
+			}
+			if fi.IsDir() && (ignore || flags&recurse == 0 || !descend) {
+				return SkipDir
+			}
+			return nil
 		}
 		if ignore {
 			f.flags |= ignored
@@ -125,29 +1036,56 @@ func (w *watcher) loadImpl(root string, flags uint, event Event, rootflags, othe
 			}
 			return nil
 		}
-		if watchFilter(f) {
-			err = w.add(f, otherflags)
-			if err != nil {
-				if !os.IsNotExist(err) {
-					w.context.Error(err)
-				}
-			}
+		if watched {
+			addWatch(f, otherflags)
 		}
 		if event != 0 {
 			list = append(list, f)
 		}
-		if fi.IsDir() && flags&recurse == 0 {
+		if fi.IsDir() && (flags&recurse == 0 || !descend) {
 			return SkipDir
 		}
+		if linked {
+			// the walk does not descend into links
+			follow = append(follow, path)
+		}
 		return nil
 	})
-	err = filepath.Walk(root, walker)
+	if descend {
+		err = filepath.Walk(walkroot, walker)
+		for len(follow) > 0 && err == nil {
+			linkroot, follow = follow[0]+string(os.PathSeparator), follow[1:]
+			err = filepath.Walk(linkroot, walker)
+		}
+	}
+	if thawed {
+		w.dropStale(root)
+	}
+	if errs := append(blind, w.retryAdds(failed)...); len(errs) > 0 && err == nil {
+		err = errs
+	}
+	// the walk visits directories before their contents, so the list
+	// is ordered with every directory before its descendants
 	if event != 0 {
-		if dup == nil {
-			w.context.Handle(event, f)
+		if opts != nil && opts.syncInitial {
+			w.dispatchInitial(f, dup == nil)
+			for _, f = range list {
+				w.dispatchInitial(f, true)
+			}
+			return err
+		}
+		if dup == nil && !(event == Create && w.vanished(f)) {
+			w.dispatch(event, f)
 		}
 		for _, f = range list {
-			w.context.Handle(event, f)
+			if !w.cached(f) {
+				// the file was unloaded by a handler or a racing Unload
+				continue
+			}
+			if event == Create && w.vanished(f) {
+				continue
+			}
+			w.dispatch(event, f)
 		}
 	}
 	return err
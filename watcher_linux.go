@@ -2,11 +2,15 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+// +build !poll
+
 package fswatch
 
 // http://man7.org/linux/man-pages/man7/inotify.7.html
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -22,6 +26,13 @@ const (
 	allFlags    = createFlags | modifyFlags | deleteFlags ^ syscall.IN_DELETE_SELF | syscall.IN_EXCL_UNLINK
 )
 
+var backend = BackendInfo{
+	Name:          "inotify",
+	ReportsRename: true,
+	DetectsAttrib: true,
+	ReportsClose:  true,
+}
+
 type watch struct {
 	fd int
 }
@@ -29,32 +40,106 @@ type watch struct {
 type watcher struct {
 	mutex   sync.RWMutex
 	fd      int
+	epfd    int
+	wake    [2]int
+	flags   uint32
 	context Context
 	tree    *tree
 	fdmap   map[int]*info
 	signal  chan func() (done bool)
+	shared
 }
 
-func newwatcher(ctx *Context) (*watcher, error) {
+func newwatcher(ctx *Context, roots ...Root) (*watcher, error) {
+	// an event holds a name of up to 255 bytes with a null terminator
+	size, err := bufferSize(ctx, syscall.SizeofInotifyEvent*4096, syscall.SizeofInotifyEvent+256)
+	if err != nil {
+		return nil, err
+	}
 	fd, err := syscall.InotifyInit()
 	if fd == -1 {
 		return nil, os.NewSyscallError("InotifyInit", err)
 	}
+	// the wake pipe is polled alongside the inotify fd
+	// and used by close to interrupt the blocking read
+	var wake [2]int
+	err = syscall.Pipe2(wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("Pipe2", err)
+	}
+	epfd, err := newpoll(fd, wake[0])
+	if err != nil {
+		syscall.Close(fd)
+		syscall.Close(wake[0])
+		syscall.Close(wake[1])
+		return nil, err
+	}
 	w := &watcher{
 		fd:      fd,
+		epfd:    epfd,
+		wake:    wake,
 		context: defaults(ctx),
 		tree:    new(tree),
 		fdmap:   make(map[int]*info),
 		signal:  make(chan func() bool, 1),
 	}
-	go w.run(fd)
-	return w, nil
+	w.flags = eventFlags(w.context.EventMask)
+	w.init(&w.context)
+	// the roots are watched before the changes are handled
+	err = w.seed(roots)
+	go w.run(fd, size)
+	return w, err
+}
+
+// newpoll returns an epoll fd that waits for input on all fds
+func newpoll(fds ...int) (int, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if epfd == -1 {
+		return -1, os.NewSyscallError("EpollCreate1", err)
+	}
+	for _, fd := range fds {
+		ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
+		err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, &ev)
+		if err != nil {
+			syscall.Close(epfd)
+			return -1, os.NewSyscallError("EpollCtl", err)
+		}
+	}
+	return epfd, nil
+}
+
+// eventFlags translates the portable event mask to inotify flags.
+// Deletes are always reported to keep the cache consistent.
+func eventFlags(mask Mask) uint32 {
+	if mask == 0 {
+		return allFlags
+	}
+	flags := uint32(deleteFlags ^ syscall.IN_DELETE_SELF | syscall.IN_EXCL_UNLINK)
+	if mask&StructureChanges != 0 {
+		flags |= createFlags
+	}
+	if mask&ContentChanges != 0 {
+		flags |= syscall.IN_CLOSE_WRITE
+	}
+	if mask&Attributes != 0 {
+		flags |= syscall.IN_ATTRIB
+	}
+	return flags
 }
 
 func watchFilter(info *info) bool {
-	return info.mode&os.ModeDir != 0
+	return info.IsDir()
+}
+
+// inSubtree returns false, only windows watches whole subtrees
+func (w *watcher) inSubtree(path string) bool {
+	return false
 }
 
+// hasParentWatch returns whether the parent of path is cached.
+// The parent watch then reports the deletion of path by name and
+// the root watch does not need IN_DELETE_SELF.
 func (w *watcher) hasParentWatch(path string) bool {
 	if path, _ = filepath.Split(path); path[len(path)-1] == os.PathSeparator {
 		path = path[:len(path)-1]
@@ -62,10 +147,10 @@ func (w *watcher) hasParentWatch(path string) bool {
 	return w.tree.get(path) != nil
 }
 
-func (w *watcher) load(path string, recursive bool) error {
-	rootFlags := uint32(allFlags)
+func (w *watcher) load(path string, recursive bool, opts *loadOptions) error {
 	w.mutex.RLock()
 	fd := w.fd
+	rootFlags := w.flags
 	if !w.hasParentWatch(path) {
 		rootFlags |= syscall.IN_DELETE_SELF
 	}
@@ -77,7 +162,7 @@ func (w *watcher) load(path string, recursive bool) error {
 	if recursive {
 		fiFlags |= recurse
 	}
-	err := w.loadImpl(path, fiFlags, 0, rootFlags, allFlags)
+	err := w.loadImpl(path, fiFlags, w.context.initialEvent(opts), rootFlags, w.flags, opts)
 	if err == SkipDir {
 		return nil
 	}
@@ -85,11 +170,17 @@ func (w *watcher) load(path string, recursive bool) error {
 }
 
 func (w *watcher) add(info *info, flags uint32) error {
+	if info.has(oneshot) {
+		flags |= syscall.IN_ONESHOT
+	}
 	fd, err := syscall.InotifyAddWatch(w.fd, info.path, flags)
 	if fd == -1 {
-		return os.NewSyscallError("InotifyAddWatch", err)
+		if err == syscall.ENOSPC {
+			return ErrWatchLimit
+		}
+		return watchError("add", info.path, "InotifyAddWatch", err)
 	}
-	info.watch = &watch{fd: fd}
+	info.setWatch(&watch{fd: fd})
 	w.fdmap[fd] = info
 	return nil
 }
@@ -109,7 +200,7 @@ func (w *watcher) unload(path string, recursive bool) error {
 	var err error
 	if nfo.watch != nil {
 		err = w.rm(nfo)
-		nfo.watch = nil
+		nfo.setWatch(nil)
 	}
 	var reload []*info
 	w.tree.deleteAll(nfo.path, func(nfo *info) {
@@ -124,7 +215,7 @@ func (w *watcher) unload(path string, recursive bool) error {
 	})
 	w.mutex.Unlock()
 	for _, nfo = range reload {
-		err := w.loadImpl(nfo.path, nfo.flags&(recurse|explicit), 0, allFlags, allFlags)
+		err := w.loadImpl(nfo.path, nfo.flags&(recurse|explicit), 0, w.flags, w.flags, nfo.opts)
 		if err != nil {
 			w.context.Error(err)
 		}
@@ -132,34 +223,89 @@ func (w *watcher) unload(path string, recursive bool) error {
 	return err
 }
 
+// rm removes the watch of nfo. The descriptor is forgotten even if the removal
+// fails, because the kernel already dropped the watch of a deleted directory.
 func (w *watcher) rm(nfo *info) error {
+	delete(w.fdmap, nfo.watch.fd)
 	code, err := syscall.InotifyRmWatch(w.fd, uint32(nfo.watch.fd))
 	if code == -1 {
-		return os.NewSyscallError("InotifyRmWatch", err)
+		if err == syscall.EINVAL && nfo.has(oneshot) {
+			// the kernel removed the fired one shot watch
+			return nil
+		}
+		return watchError("rm", nfo.path, "InotifyRmWatch", err)
 	}
-	delete(w.fdmap, nfo.watch.fd)
 	return nil
 }
 
+// rearm adds the watch of nfo again after the kernel removed its fired one shot
+// watch, or replaces it with a permanent watch once the oneshot flag is cleared.
+func (w *watcher) rearm(nfo *info) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.fd == -1 || nfo.watch == nil || w.tree.get(nfo.path) != nfo {
+		return
+	}
+	delete(w.fdmap, nfo.watch.fd)
+	flags := w.flags
+	if !w.hasParentWatch(nfo.path) {
+		flags |= syscall.IN_DELETE_SELF
+	}
+	if err := w.add(nfo, flags); err != nil && !errors.Is(err, os.ErrNotExist) {
+		w.context.Error(err)
+	}
+}
+
+// unwatch removes the watches of all infos in list but keeps them cached
+func (w *watcher) unwatch(list []*info) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	var err error
+	for _, nfo := range list {
+		if nfo.watch == nil {
+			continue
+		}
+		if e := w.rm(nfo); e != nil && err == nil {
+			err = e
+		}
+		nfo.setWatch(nil)
+	}
+	return err
+}
+
+// forget releases the watch of a deleted info.
+// It expects the watcher mutex to be held.
+func (w *watcher) forget(nfo *info) {
+	if nfo.watch != nil {
+		delete(w.fdmap, nfo.watch.fd)
+	}
+}
+
+// descriptors returns the paths of all watches by descriptor
+func (w *watcher) descriptors() map[int]string {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	res := make(map[int]string, len(w.fdmap))
+	for fd, nfo := range w.fdmap {
+		res[fd] = nfo.path
+	}
+	return res
+}
+
 func (w *watcher) close() error {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
 	if w.fd == -1 {
 		return ErrClosed
 	}
-	if w.tree.root == nil {
-		fd, err := syscall.InotifyAddWatch(w.fd, "/", syscall.IN_DELETE_SELF)
-		if fd == -1 {
-			return os.NewSyscallError("InotifyAddWatch", err)
-		}
-		w.fdmap[fd] = &info{path: "/", watch: &watch{fd}}
-	}
 	w.signal <- func() bool {
 		w.mutex.Lock()
 		defer w.mutex.Unlock()
-		err := syscall.Close(w.fd)
-		if err != nil {
-			w.context.Error(os.NewSyscallError("Close", err))
+		for _, fd := range []int{w.fd, w.epfd, w.wake[0], w.wake[1]} {
+			err := syscall.Close(fd)
+			if err != nil {
+				w.context.Error(os.NewSyscallError("Close", err))
+			}
 		}
 		w.fd, w.fdmap = -1, nil
 		return true
@@ -170,19 +316,100 @@ func (w *watcher) close() error {
 			w.context.Error(err)
 		}
 	}
+	return w.wakeup()
+}
+
+// serial runs fn in the run loop and waits for it.
+// It returns ErrClosed if the watcher was closed before fn could run.
+func (w *watcher) serial(fn func()) error {
+	w.mutex.RLock()
+	closed := w.fd == -1
+	w.mutex.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+	ran := make(chan struct{})
+	sig := func() bool {
+		fn()
+		close(ran)
+		return false
+	}
+	select {
+	case w.signal <- sig:
+	case <-w.done:
+		return ErrClosed
+	}
+	if err := w.wakeup(); err != nil {
+		return err
+	}
+	select {
+	case <-ran:
+		return nil
+	case <-w.done:
+		return ErrClosed
+	}
+}
+
+// wakeup interrupts the run loop waiting for events
+func (w *watcher) wakeup() error {
+	_, err := syscall.Write(w.wake[1], []byte{0})
+	if err != nil && err != syscall.EAGAIN {
+		return os.NewSyscallError("Write", err)
+	}
 	return nil
 }
 
-func (w *watcher) run(fd int) {
-	var buf [syscall.SizeofInotifyEvent * 4096]byte
+func (w *watcher) run(fd int, size int) {
+	buf := make([]byte, size)
+	var events [2]syscall.EpollEvent
+	var lag backlog
+	defer close(w.done)
 	for {
-		n, err := syscall.Read(fd, buf[:])
+		n, err := syscall.EpollWait(w.epfd, events[:], -1)
+		if n == -1 {
+			if err != syscall.EINTR {
+				w.context.Error(os.NewSyscallError("EpollWait", err))
+			}
+			continue
+		}
+		woken := false
+		for _, ev := range events[:n] {
+			if int(ev.Fd) == w.wake[0] {
+				woken = true
+			}
+		}
+		if woken {
+			var drain [64]byte
+			for {
+				if n, _ := syscall.Read(w.wake[0], drain[:]); n <= 0 {
+					break
+				}
+			}
+			select {
+			case done := <-w.signal:
+				if done() {
+					return
+				}
+			default:
+			}
+			continue
+		}
+		n, err = syscall.Read(fd, buf)
 		if n == 0 {
-			err := w.close()
-			if err != nil {
-				w.context.Error(err)
+			// the inotify instance ended. close queues its signal from another
+			// goroutine, because the buffered signal may be full, and the loop
+			// stops once it handled the signal.
+			go func() {
+				err := w.close()
+				if err != nil && err != ErrClosed {
+					w.context.Error(err)
+				}
+			}()
+			for done := range w.signal {
+				if done() {
+					return
+				}
 			}
-			return
 		} else if n < syscall.SizeofInotifyEvent {
 			if err != nil {
 				w.context.Error(os.NewSyscallError("Read", err))
@@ -191,51 +418,133 @@ func (w *watcher) run(fd int) {
 			}
 			continue
 		}
-		select {
-		case done := <-w.signal:
-			if done() {
-				return
-			}
-		default:
-		}
+		var batch []rawEvent
 		offset := 0
 		for offset <= n-syscall.SizeofInotifyEvent {
 			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			var name string
+			if raw.Len > 0 {
+				start := offset + syscall.SizeofInotifyEvent
+				end := start + int(raw.Len)
+				if end > n {
+					end = n
+				}
+				name = strings.TrimRight(string(buf[start:end]), "\000")
+			}
+			batch = append(batch, rawEvent{int(raw.Wd), raw.Mask, raw.Cookie, name})
+			offset += syscall.SizeofInotifyEvent + int(raw.Len)
+		}
+		batch = squash(batch)
+		w.beginBatch()
+		for i, ev := range batch {
+			if ev.wd == -1 && ev.mask&syscall.IN_Q_OVERFLOW != 0 {
+				w.overflow()
+				continue
+			}
+			if ev.mask == 0 || ev.mask&syscall.IN_MOVED_FROM != 0 && w.moved(batch, i) {
+				continue
+			}
 			w.mutex.RLock()
-			info := w.fdmap[int(raw.Wd)]
+			info := w.fdmap[ev.wd]
 			w.mutex.RUnlock()
 			if info != nil {
-				var name string
-				if raw.Len > 0 {
-					start := &buf[offset+syscall.SizeofInotifyEvent]
-					bytes := *(*[syscall.PathMax]byte)(unsafe.Pointer(start))
-					name = strings.TrimRight(string(bytes[:raw.Len]), "\000")
+				w.handle(ev.mask, info, ev.name)
+			}
+		}
+		w.endBatch()
+		if w.context.Warn != nil && lag.growing(queued(fd)) {
+			w.context.Warn(fmt.Sprintf("inotify queue grew for %d reads to %d bytes, "+
+				"consider a faster handler or debouncing", lagReads, lag.last))
+		}
+	}
+}
+
+// rawEvent is an inotify event read from the inotify fd
+type rawEvent struct {
+	wd     int
+	mask   uint32
+	cookie uint32
+	name   string
+}
+
+// moved handles the IN_MOVED_FROM event at i in batch as Rename if a later event
+// in batch is its IN_MOVED_TO. The IN_MOVED_TO is cleared and true returned.
+func (w *watcher) moved(batch []rawEvent, i int) bool {
+	from := batch[i]
+	for j := i + 1; j < len(batch); j++ {
+		to := &batch[j]
+		if to.mask&syscall.IN_MOVED_TO == 0 || to.cookie != from.cookie {
+			continue
+		}
+		w.mutex.RLock()
+		src, dst := w.fdmap[from.wd], w.fdmap[to.wd]
+		w.mutex.RUnlock()
+		if src == nil || dst == nil || !w.cached(src) || !w.cached(dst) {
+			return false
+		}
+		if !w.rename(filepath.Join(src.path, from.name), filepath.Join(dst.path, to.name)) {
+			return false
+		}
+		to.mask = 0
+		return true
+	}
+	return false
+}
+
+// squash drops modify events from the batch that are followed by a delete of the same file.
+// The file is already gone when the modify would be handled, so only the delete is reported.
+func squash(batch []rawEvent) []rawEvent {
+	res := batch[:0]
+Events:
+	for i, ev := range batch {
+		if ev.mask&modifyFlags != 0 && ev.mask&(createFlags|deleteFlags) == 0 {
+			for _, later := range batch[i+1:] {
+				if later.wd == ev.wd && later.name == ev.name && later.mask&(deleteFlags|syscall.IN_IGNORED) != 0 {
+					continue Events
 				}
-				w.handle(raw.Mask, info, name)
 			}
-			offset += syscall.SizeofInotifyEvent + int(raw.Len)
 		}
+		res = append(res, ev)
 	}
+	return res
 }
 
 func (w *watcher) handle(mask uint32, nfo *info, name string) {
+	if !w.cached(nfo) {
+		return
+	}
+	if mask&syscall.IN_IGNORED != 0 && name == "" && nfo.has(oneshot) {
+		// the kernel removed the one shot watch after its first event
+		w.rearm(nfo)
+		return
+	}
 	path, fi := nfo.path, nfo
 	if name != "" {
 		path = filepath.Join(path, name)
 		fi = nil
 	}
 	if mask&(deleteFlags|syscall.IN_IGNORED) != 0 {
+		// the deleted infos leave the cache before they are dispatched, so the
+		// second report by the parent or the watch itself finds nothing to delete
 		var list []*info
 		w.mutex.Lock()
+		top := w.tree.get(path)
 		w.tree.deleteAll(path, func(fi *info) {
-			if fi.watch != nil {
-				delete(w.fdmap, fi.watch.fd)
-			}
+			fi.setSys(mask)
+			w.forget(fi)
 			list = append(list, fi)
 		})
 		w.mutex.Unlock()
+		linked := top != nil && top.has(followed)
+		if linked {
+			// the watches below a deleted link stay active while the target exists
+			w.unwatch(list)
+		}
 		for _, fi = range list {
-			w.context.Handle(Delete, fi)
+			w.dispatch(Delete, fi)
+		}
+		if linked {
+			w.unfollow(top)
 		}
 		return
 	}
@@ -245,21 +554,104 @@ func (w *watcher) handle(mask uint32, nfo *info, name string) {
 		w.mutex.RUnlock()
 	}
 	if fi == nil {
-		err := w.loadImpl(path, nfo.flags&recurse, Create, allFlags, allFlags)
+		opened := mask&syscall.IN_CREATE != 0 && w.context.CreateOnClose
+		if opened {
+			w.settle.open(path, true)
+		}
+		err := w.loadImpl(path, nfo.flags&recurse, Create, w.flags, w.flags, nil)
+		if opened {
+			w.settle.open(path, false)
+		}
 		if err != nil && err != SkipDir {
 			if !os.IsNotExist(err) {
 				w.context.Error(err)
 			}
 		}
 	} else {
-		nfi, err := os.Lstat(path)
+		nfi, err := fi.stat()
 		if err != nil {
 			if !os.IsNotExist(err) {
 				w.context.Error(err)
 			}
 			return
 		}
-		fi.update(nfi)
-		w.context.Handle(Modify, fi)
+		if name != "" && mask&modifyFlags == syscall.IN_ATTRIB && fi.IsDir() && fi.Watched() {
+			// the watch of the directory reports its attributes itself
+			return
+		}
+		if mask&syscall.IN_MOVED_TO != 0 && w.selfMoved(path) {
+			// the subtree was already moved by Watcher.Move
+			return
+		}
+		fi.setSys(mask)
+		if mask&syscall.IN_CLOSE_WRITE != 0 && w.context.CreateOnClose && w.release(fi, nfi) {
+			return
+		}
+		if mask&modifyFlags == syscall.IN_ATTRIB {
+			w.chattr(fi, nfi)
+		} else {
+			w.modify(fi, nfi)
+		}
+	}
+}
+
+// overflow reports the events lost by the kernel queue overflow
+// and resyncs all loaded roots if `Context.ResyncOnOverflow` is set
+func (w *watcher) overflow() {
+	w.stats.overflowed()
+	w.context.Error(ErrOverflow)
+	if w.context.CreateOnClose {
+		// the close of the held files may be lost
+		w.releaseAll()
+	}
+	if !w.context.ResyncOnOverflow {
+		return
+	}
+	var roots []*info
+	w.mutex.RLock()
+	w.tree.each(func(nfo *info) {
+		if nfo.has(explicit) {
+			roots = append(roots, nfo)
+		}
+	})
+	w.mutex.RUnlock()
+	for _, nfo := range roots {
+		if err := w.reconcile(nfo); err != nil {
+			w.context.Error(err)
+		}
+	}
+}
+
+// lagReads is the number of consecutive reads with a growing queue before a warning
+const lagReads = 8
+
+// backlog tracks the number of bytes left in the inotify queue after each read
+type backlog struct {
+	last int
+	grow int
+}
+
+// growing records the pending bytes and returns true if the queue grew for lagReads reads
+func (b *backlog) growing(pending int) bool {
+	if pending > 0 && pending > b.last {
+		b.grow++
+	} else {
+		b.grow = 0
+	}
+	b.last = pending
+	if b.grow < lagReads {
+		return false
+	}
+	b.grow = 0
+	return true
+}
+
+// queued returns the number of bytes waiting to be read from the inotify fd
+func queued(fd int) int {
+	var n int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCINQ, uintptr(unsafe.Pointer(&n)))
+	if errno != 0 {
+		return 0
 	}
+	return int(n)
 }
@@ -0,0 +1,218 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !poll
+
+package fswatch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestSquash(t *testing.T) {
+	batch := []rawEvent{
+		{1, syscall.IN_CLOSE_WRITE, 0, "a"},
+		{1, syscall.IN_CLOSE_WRITE, 0, "b"},
+		{1, syscall.IN_ATTRIB, 0, "a"},
+		{1, syscall.IN_DELETE, 0, "a"},
+		{2, syscall.IN_ATTRIB, 0, ""},
+		{2, syscall.IN_DELETE_SELF, 0, ""},
+		{3, syscall.IN_CLOSE_WRITE, 0, "b"},
+	}
+	expect := []rawEvent{
+		{1, syscall.IN_CLOSE_WRITE, 0, "b"},
+		{1, syscall.IN_DELETE, 0, "a"},
+		{2, syscall.IN_DELETE_SELF, 0, ""},
+		{3, syscall.IN_CLOSE_WRITE, 0, "b"},
+	}
+	got := squash(batch)
+	if len(got) != len(expect) {
+		t.Fatalf("expected %v got %v", expect, got)
+	}
+	for i := range expect {
+		if got[i] != expect[i] {
+			t.Errorf("expected %v got %v", expect[i], got[i])
+		}
+	}
+}
+
+func TestBacklog(t *testing.T) {
+	var b backlog
+	for i := 1; i < lagReads; i++ {
+		if b.growing(i * 100) {
+			t.Fatalf("unexpected warning after %d reads", i)
+		}
+	}
+	if !b.growing(lagReads * 100) {
+		t.Fatal("expected warning")
+	}
+	if b.growing(lagReads*100 + 1) {
+		t.Error("expected reset after warning")
+	}
+	b.growing(0)
+	if b.grow != 0 {
+		t.Error("expected reset on drained queue")
+	}
+}
+
+func TestResyncOnOverflow(t *testing.T) {
+	env := newtestenvWith(t, &Context{ResyncOnOverflow: true})
+	root, w := env.root, env.watcher
+	defer env.close()
+	env.load(root, true)
+	changed := env.createWriteClose(root, "changed")
+	missed := env.createWriteClose(root, "missed")
+	sub := env.mkdir(root, "sub")
+	env.sleep()
+	deep := env.createWriteClose(sub, "deep")
+	env.sleep()
+	env.check()
+	// let the cache drift as if events were lost
+	ghost := filepath.Join(root, "ghost")
+	w.mutex.Lock()
+	nfo := w.tree.get(changed)
+	nfo.size = 0
+	w.tree.deleteAll(missed, w.forget)
+	w.tree.deleteAll(deep, w.forget)
+	w.tree.insert(newInfo(ghost, nfo.Freeze()))
+	w.mutex.Unlock()
+	w.overflow()
+	env.Lock()
+	if len(env.errors) != 1 || env.errors[0] != ErrOverflow {
+		t.Errorf("expected overflow error got %v", env.errors)
+	}
+	env.errors = nil
+	env.Unlock()
+	if n := (Watcher{w}).Stats().Overflows; n != 1 {
+		t.Errorf("expected one overflow got %d", n)
+	}
+	env.expect = append(env.expect,
+		record{Modify, changed, false},
+		record{Delete, ghost, false},
+		record{Create, missed, false},
+		record{Create, deep, false},
+	)
+	env.check()
+	if fi, err := os.Lstat(changed); err != nil || (Watcher{w}).Get(changed).Size() != fi.Size() {
+		t.Error("expected the resynced size in the cache")
+	}
+}
+
+func TestRepeatedModify(t *testing.T) {
+	env := newtestenvWith(t, &Context{})
+	defer env.close()
+	env.watcher.repeats = true
+	env.load(env.root, true)
+	file := env.createWriteClose(env.root, "file")
+	env.sleep()
+	env.check()
+	env.Lock()
+	env.events, env.expect = nil, nil
+	env.Unlock()
+	// closing the unchanged file twice is reported once
+	for i := 0; i < 2; i++ {
+		f, err := os.OpenFile(file, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal("failed to open.", err)
+		}
+		f.Close()
+	}
+	env.sleep()
+	env.expect = append(env.expect, record{Modify, file, false})
+	env.check()
+}
+
+func TestRenameKeepsWatch(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	dir := env.mkdir(env.root, "foo")
+	sub := env.mkdir(dir, "sub")
+	env.sleep()
+	w := env.watcher
+	w.mutex.RLock()
+	before := w.tree.get(sub)
+	w.mutex.RUnlock()
+	if before == nil || before.watch == nil {
+		t.Fatal("expected a watched directory")
+	}
+	wd := before.watch.fd
+	newdir := filepath.Join(env.root, "bar")
+	if err := os.Rename(dir, newdir); err != nil {
+		t.Fatal("failed to rename.", err)
+	}
+	env.sleep()
+	newsub := filepath.Join(newdir, "sub")
+	w.mutex.RLock()
+	after, mapped := w.tree.get(newsub), w.fdmap[wd]
+	w.mutex.RUnlock()
+	// the moved subtree keeps its cached infos and watch descriptors
+	if after != before || mapped != before || after.watch == nil || after.watch.fd != wd {
+		t.Errorf("expected the moved info with watch %d got %v", wd, after)
+	}
+	env.expect = append(env.expect,
+		record{Rename, newdir, false},
+		record{Rename, newsub, false},
+	)
+	file := env.createWriteClose(newsub, "file")
+	env.sleep()
+	if fi := (Watcher{w}).Get(file); fi == nil {
+		t.Error("expected the new file below the moved directory")
+	}
+	env.check()
+}
+
+func TestRemoveLoadedRoot(t *testing.T) {
+	for _, test := range []struct{ recursive, subFirst bool }{
+		{true, false}, {false, false}, {true, true},
+	} {
+		env := newtestenvWith(t, &Context{})
+		root := env.root
+		sub := filepath.Join(root, "sub")
+		if err := os.MkdirAll(filepath.Join(sub, "deep"), 0700); err != nil {
+			t.Fatal("failed to mkdir.", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(sub, "file"), nil, 0600); err != nil {
+			t.Fatal("failed to create.", err)
+		}
+		// the parent watch reports the removal by name and the root watch by itself
+		if test.subFirst {
+			// without a parent watch the root watch includes IN_DELETE_SELF
+			env.load(sub, true)
+			env.load(root, test.recursive)
+		} else {
+			env.load(root, test.recursive)
+			env.load(sub, true)
+		}
+		if err := os.RemoveAll(sub); err != nil {
+			t.Fatal("failed to remove.", err)
+		}
+		env.sleep()
+		// the removal order of the children depends on the directory listing
+		count := make(map[string]int)
+		env.Lock()
+		for _, r := range env.events {
+			if r.Event != Delete {
+				t.Errorf("unexpected %s", r)
+			}
+			count[r.path]++
+		}
+		for _, err := range env.errors {
+			t.Error(err)
+		}
+		env.Unlock()
+		for _, path := range []string{sub, filepath.Join(sub, "deep"), filepath.Join(sub, "file")} {
+			if count[path] != 1 {
+				t.Errorf("%+v: expected one delete for %s got %d", test, path, count[path])
+			}
+		}
+		if len(count) != 3 {
+			t.Errorf("%+v: expected three deletes got %v", test, count)
+		}
+		env.close()
+	}
+}
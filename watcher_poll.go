@@ -0,0 +1,404 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build poll !linux,!windows,!freebsd,!openbsd,!netbsd,!darwin
+
+package fswatch
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pollInterval is the time between scans if `Context.PollInterval` is zero
+var pollInterval = time.Second
+
+const allFlags = uint32(StructureChanges | ContentChanges | Attributes)
+
+var backend = BackendInfo{
+	Name:          "poll",
+	DetectsAttrib: true,
+}
+
+type watch struct {
+	id int
+}
+
+type watcher struct {
+	mutex   sync.RWMutex
+	flags   uint32
+	context Context
+	tree    *tree
+	polled  map[int]*info
+	lastID  int
+	stop    chan struct{}
+	signal  chan func()
+	// loads is the number of running loads and accessed atomically
+	loads int32
+	shared
+}
+
+func newwatcher(ctx *Context, roots ...Root) (*watcher, error) {
+	w := &watcher{
+		context: defaults(ctx),
+		tree:    new(tree),
+		polled:  make(map[int]*info),
+		stop:    make(chan struct{}),
+		signal:  make(chan func()),
+	}
+	w.flags = eventFlags(w.context.EventMask)
+	w.init(&w.context)
+	interval := w.context.PollInterval
+	if interval <= 0 {
+		interval = pollInterval
+	}
+	// the roots are watched before the changes are handled
+	err := w.seed(roots)
+	go w.run(w.newTicker(interval))
+	return w, err
+}
+
+// eventFlags returns the mask as flags that select the changes found by a scan
+func eventFlags(mask Mask) uint32 {
+	if mask == 0 {
+		return allFlags
+	}
+	return uint32(mask)
+}
+
+func watchFilter(nfo *info) bool {
+	return nfo.IsDir()
+}
+
+// inSubtree returns false, only windows watches whole subtrees
+func (w *watcher) inSubtree(path string) bool {
+	return false
+}
+
+// rearm does nothing, polled directories have no one shot watches
+func (w *watcher) rearm(nfo *info) {}
+
+func (w *watcher) load(path string, recursive bool, opts *loadOptions) error {
+	w.mutex.RLock()
+	closed := w.polled == nil
+	w.mutex.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+	fiFlags := uint(explicit)
+	if recursive {
+		fiFlags |= recurse
+	}
+	atomic.AddInt32(&w.loads, 1)
+	defer atomic.AddInt32(&w.loads, -1)
+	err := w.loadImpl(path, fiFlags, w.context.initialEvent(opts), w.flags, w.flags, opts)
+	if err == SkipDir {
+		return nil
+	}
+	return err
+}
+
+func (w *watcher) add(nfo *info, flags uint32) error {
+	if w.polled == nil {
+		return ErrClosed
+	}
+	w.lastID++
+	nfo.setWatch(&watch{id: w.lastID})
+	w.polled[w.lastID] = nfo
+	return nil
+}
+
+func (w *watcher) unload(path string, recursive bool) error {
+	w.mutex.RLock()
+	closed := w.polled == nil
+	nfo := w.tree.get(path)
+	w.mutex.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+	if nfo == nil || nfo.watch == nil {
+		return nil
+	}
+	w.mutex.Lock()
+	var reload []*info
+	w.tree.deleteAll(nfo.path, func(nfo *info) {
+		if !recursive && nfo.flags&explicit != 0 && nfo.path != path {
+			reload = append(reload, nfo)
+		}
+		if nfo.watch != nil {
+			w.rm(nfo)
+		}
+	})
+	w.mutex.Unlock()
+	for _, nfo = range reload {
+		err := w.loadImpl(nfo.path, nfo.flags&(recurse|explicit), 0, w.flags, w.flags, nfo.opts)
+		if err != nil {
+			w.context.Error(err)
+		}
+	}
+	return nil
+}
+
+func (w *watcher) rm(nfo *info) error {
+	delete(w.polled, nfo.watch.id)
+	return nil
+}
+
+// unwatch stops polling all infos in list but keeps them cached
+func (w *watcher) unwatch(list []*info) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, nfo := range list {
+		if nfo.watch == nil {
+			continue
+		}
+		w.rm(nfo)
+		nfo.setWatch(nil)
+	}
+	return nil
+}
+
+// forget stops polling a deleted info.
+// It expects the watcher mutex to be held.
+func (w *watcher) forget(nfo *info) {
+	if nfo.watch != nil {
+		delete(w.polled, nfo.watch.id)
+	}
+}
+
+// descriptors returns the paths of all polled directories by their id
+func (w *watcher) descriptors() map[int]string {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	res := make(map[int]string, len(w.polled))
+	for id, nfo := range w.polled {
+		res[id] = nfo.path
+	}
+	return res
+}
+
+func (w *watcher) close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.polled == nil {
+		return ErrClosed
+	}
+	w.polled = nil
+	close(w.stop)
+	return nil
+}
+
+// serial runs fn in the run loop between two scans and waits for it.
+// It returns ErrClosed if the watcher was closed before fn could run.
+func (w *watcher) serial(fn func()) error {
+	ran := make(chan struct{})
+	select {
+	case w.signal <- func() {
+		fn()
+		close(ran)
+	}:
+	case <-w.stop:
+		return ErrClosed
+	}
+	<-ran
+	return nil
+}
+
+func (w *watcher) run(ticker *ticker) {
+	defer close(w.done)
+	defer w.stopTicker(ticker)
+	for {
+		select {
+		case <-w.stop:
+			return
+		case fn := <-w.signal:
+			fn()
+			continue
+		case <-ticker.C:
+		}
+		if !w.poll() {
+			return
+		}
+	}
+}
+
+// poll scans all polled directories once and returns false if the watcher was closed.
+// It is called by the run loop.
+func (w *watcher) poll() bool {
+	w.mutex.RLock()
+	list := make([]*info, 0, len(w.polled))
+	for _, nfo := range w.polled {
+		list = append(list, nfo)
+	}
+	w.mutex.RUnlock()
+	// parents are scanned before their children
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].path < list[j].path
+	})
+	w.beginBatch()
+	defer w.endBatch()
+	for _, nfo := range list {
+		select {
+		case <-w.stop:
+			return false
+		default:
+		}
+		w.scan(nfo)
+	}
+	return true
+}
+
+// scan compares the polled directory nfo and its cached children with the disk
+// and dispatches the differences as Create, Modify and Delete events.
+func (w *watcher) scan(nfo *info) {
+	if !w.cached(nfo) {
+		return
+	}
+	nfi, err := nfo.stat()
+	if err != nil {
+		if os.IsNotExist(err) {
+			w.vanish(nfo.path)
+		} else {
+			w.context.Error(err)
+		}
+		return
+	}
+	w.compare(nfo, nfi)
+	// directories are read with any event mask to find the deleted and changed files,
+	// the events not selected by the mask are dropped on dispatch
+	if !nfi.IsDir() {
+		return
+	}
+	f, err := os.Open(nfo.path)
+	if err != nil {
+		if !os.IsNotExist(err) && !os.IsPermission(err) {
+			w.context.Error(err)
+		}
+		return
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		w.context.Error(err)
+		return
+	}
+	var list []*info
+	w.mutex.RLock()
+	w.tree.walk(nfo.path, func(fi FileInfo) error {
+		if fi == FileInfo(nfo) {
+			return nil
+		}
+		// a nested root below an uncached directory is scanned on its own
+		if filepath.Dir(fi.Path()) == nfo.path {
+			list = append(list, fi.(*info))
+		}
+		if fi.IsDir() {
+			return SkipDir
+		}
+		return nil
+	})
+	w.mutex.RUnlock()
+	cached := make(map[string]*info, len(list))
+	for _, fi := range list {
+		cached[fi.path] = fi
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !w.cached(nfo) {
+			// the directory was unloaded by a handler, like for a one shot root
+			return
+		}
+		path := filepath.Join(nfo.path, name)
+		fi := cached[path]
+		delete(cached, path)
+		if fi != nil {
+			nfi, err := fi.stat()
+			if err != nil || fi.watch != nil {
+				// polled directories are compared by their own scan
+				continue
+			}
+			if !replaced(fi, nfi) {
+				w.compare(fi, nfi)
+				continue
+			}
+			w.vanish(path)
+		} else if w.ignored(path) {
+			// an ignored file is only loaded again by the recheck of SetFilter
+			continue
+		} else if atomic.LoadInt32(&w.loads) > 0 {
+			// a running load caches the files it walks without reporting them,
+			// the next scan reports the files it missed
+			continue
+		}
+		err := w.loadImpl(path, nfo.flags&recurse, Create, w.flags, w.flags, nil)
+		if err != nil && err != SkipDir && !os.IsNotExist(err) {
+			select {
+			case <-w.stop:
+				// the watcher was closed during the scan
+				return
+			default:
+				w.context.Error(err)
+			}
+		}
+	}
+	for _, fi := range list {
+		if cached[fi.path] != nil {
+			w.vanish(fi.path)
+		}
+	}
+}
+
+// ignored returns whether path is cached as ignored by the filter
+func (w *watcher) ignored(path string) bool {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	nfo := w.tree.get(path)
+	return nfo != nil && nfo.Ignored()
+}
+
+// compare dispatches a Modify or Chmod with nfi if fi changed and the change is selected by
+// the event mask, otherwise it only updates fi. The time and size of directories
+// change with their children and are ignored like by the native backends.
+func (w *watcher) compare(fi *info, nfi os.FileInfo) {
+	_, _, nlink := statIDs(nfi)
+	fi.mutex.RLock()
+	content := !nfi.IsDir() && (!fi.modt.Equal(nfi.ModTime()) || fi.size != nfi.Size())
+	attrib := fi.mode != nfi.Mode() || !nfi.IsDir() && fi.nlink != nlink
+	fi.mutex.RUnlock()
+	switch {
+	case content && w.flags&uint32(ContentChanges) != 0:
+		w.modify(fi, nfi)
+	case attrib && w.flags&uint32(Attributes) != 0:
+		w.chattr(fi, nfi)
+	case (content || attrib) && !fi.has(stale):
+		fi.update(nfi)
+	}
+}
+
+// replaced returns whether nfi is another file than the cached fi,
+// because its kind or its inode differs
+func replaced(fi *info, nfi os.FileInfo) bool {
+	dev, ino, _ := statIDs(nfi)
+	fi.mutex.RLock()
+	defer fi.mutex.RUnlock()
+	return nfi.IsDir() != (fi.mode&os.ModeDir != 0) || ino != 0 && (dev != fi.dev || ino != fi.ino)
+}
+
+// vanish removes the cached subtree at path and dispatches the Delete events
+func (w *watcher) vanish(path string) {
+	var list []*info
+	w.mutex.Lock()
+	w.tree.deleteAll(path, func(fi *info) {
+		w.forget(fi)
+		list = append(list, fi)
+	})
+	w.mutex.Unlock()
+	for _, fi := range list {
+		w.dispatch(Delete, fi)
+	}
+}
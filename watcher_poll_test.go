@@ -0,0 +1,14 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build poll !linux,!windows,!freebsd,!openbsd,!netbsd,!darwin
+
+package fswatch
+
+import "time"
+
+func init() {
+	// scan often enough for the expectations after waitfor
+	pollInterval = 3 * time.Millisecond
+}
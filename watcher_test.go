@@ -5,9 +5,15 @@
 package fswatch
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"sync"
 	"testing"
 	"time"
 )
@@ -18,26 +24,26 @@ func TestWatch(t *testing.T) {
 	defer env.close()
 	// create
 	file1 := env.createWriteClose(env.root, "file1")
-	time.Sleep(waitfor)
+	env.sleep()
 	// remove
 	env.remove(file1)
-	time.Sleep(waitfor)
+	env.sleep()
 	// recreate
 	env.createWriteClose(file1)
-	time.Sleep(waitfor)
+	env.sleep()
 	// change
 	env.openWriteClose(file1)
-	time.Sleep(waitfor)
+	env.sleep()
 	// remove again
 	env.remove(file1)
-	time.Sleep(waitfor)
+	env.sleep()
 	// remove root watch and dir
 	env.unload(env.root, false)
 	os.RemoveAll(env.root)
-	time.Sleep(waitfor)
+	env.sleep()
 	// close watcher
 	env.watcher.close()
-	time.Sleep(waitfor)
+	env.sleep()
 	// check results
 	env.check()
 }
@@ -49,19 +55,17 @@ func TestRename(t *testing.T) {
 	// create
 	dir := env.mkdir(env.root, "foo")
 	file := env.createWriteClose(dir, "file")
-	time.Sleep(waitfor)
+	env.sleep()
 	// rename
 	newdir := filepath.Join(env.root, "bar")
 	err := os.Rename(dir, newdir)
 	if err != nil {
 		t.Fatal("failed to rename.", err)
 	}
-	if runtime.GOOS == "linux" || runtime.GOOS == "windows" {
+	if backend.ReportsRename {
 		env.expect = append(env.expect,
-			record{Delete, dir, false},
-			record{Delete, file, false},
-			record{Create, newdir, false},
-			record{Create, filepath.Join(newdir, "file"), false},
+			record{Rename, newdir, false},
+			record{Rename, filepath.Join(newdir, "file"), false},
 		)
 	} else {
 		env.expect = append(env.expect,
@@ -71,29 +75,163 @@ func TestRename(t *testing.T) {
 			record{Delete, file, false},
 		)
 	}
-	time.Sleep(waitfor)
+	env.sleep()
 	// close and check results
 	env.watcher.close()
-	time.Sleep(waitfor)
+	env.sleep()
+	env.check()
+}
+
+func TestMove(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	dir := env.mkdir(env.root, "foo")
+	sub := env.mkdir(dir, "sub")
+	env.createWriteClose(sub, "file")
+	env.sleep()
+	env.check()
+	w := Watcher{env.watcher}
+	before := w.Get(sub)
+	newdir := filepath.Join(env.root, "bar")
+	newsub := filepath.Join(newdir, "sub")
+	if err := w.Move(dir, newdir); err != nil {
+		t.Fatal("failed to move.", err)
+	}
+	// the rename is only reported by Move
+	env.expect = append(env.expect,
+		record{Rename, newdir, false},
+		record{Rename, newsub, false},
+		record{Rename, filepath.Join(newsub, "file"), false},
+	)
+	env.sleep()
+	env.check()
+	if fi := w.Get(newsub); fi != before || !Watched(fi) {
+		t.Errorf("expected the moved info got %v", fi)
+	}
+	env.createWriteClose(newsub, "other")
+	env.sleep()
+	env.check()
+	if err := w.Move(dir, newdir); !os.IsNotExist(err) {
+		t.Errorf("expected a not exist error got %v", err)
+	}
+}
+
+func TestRenameOldPath(t *testing.T) {
+	if !backend.ReportsRename {
+		t.Skip("backend does not report renames")
+	}
+	env := newtestenv(t)
+	defer env.close()
+	events := Watcher{env.watcher}.Events()
+	file := env.createWriteClose(env.root, "file")
+	other := filepath.Join(env.root, "other")
+	env.sleep()
+	err := os.Rename(file, other)
+	if err != nil {
+		t.Fatal("failed to rename.", err)
+	}
+	env.expect = append(env.expect, record{Rename, other, false})
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Event != Rename {
+				continue
+			}
+			if e.Info.Path() != other || e.OldPath() != file {
+				t.Errorf("expected rename from %s to %s got %s to %s", file, other, e.OldPath(), e.Info.Path())
+			}
+		case <-timeout:
+			t.Fatal("expected a rename")
+		}
+		break
+	}
 	env.check()
 }
 
+func TestRenamePath(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	w := Watcher{env.watcher}
+	file := env.createWriteClose(env.root, "file")
+	other := filepath.Join(env.root, "other")
+	env.sleep()
+	fi := w.Get(file)
+	if fi == nil {
+		t.Fatal("expected a cached file")
+	}
+	// the path is read while the file is moved
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			fi.Path()
+			fi.Name()
+		}
+	}()
+	if err := w.Move(file, other); err != nil {
+		t.Fatal("failed to move.", err)
+	}
+	<-done
+	if fi.Path() != other {
+		t.Errorf("expected path %s got %s", other, fi.Path())
+	}
+}
+
 func TestWatchDirs(t *testing.T) {
 	// setup test environment
 	env := newtestenv(t)
 	defer env.close()
-	time.Sleep(waitfor)
+	env.sleep()
 	// create new directory
 	dir1 := env.mkdir(env.root, "dir1")
-	time.Sleep(waitfor)
+	env.sleep()
 	dir2 := env.mkdir(dir1, "dir2")
-	time.Sleep(waitfor)
+	env.sleep()
 	// remove dirs
 	env.remove(dir2)
-	time.Sleep(waitfor)
+	env.sleep()
 	env.remove(dir1)
 	// check results
-	time.Sleep(waitfor)
+	env.sleep()
+	env.check()
+}
+
+func TestWatchNestedDirs(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	env.sleep()
+	// create nested directories faster than they can be loaded
+	dirs := []string{env.root}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		dir := filepath.Join(dirs[len(dirs)-1], name)
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatal("failed to mkdir.", err)
+		}
+		dirs = append(dirs, dir)
+	}
+	for _, dir := range dirs[1:] {
+		env.expect = append(env.expect, record{Create, dir, false})
+	}
+	// a directory loaded before its child was created may report a Modify
+	dropDirModify := func() {
+		env.Lock()
+		defer env.Unlock()
+		events := env.events[:0]
+		for _, r := range env.events {
+			if r.Event != Modify || filepath.Base(r.path) == "file" {
+				events = append(events, r)
+			}
+		}
+		env.events = events
+	}
+	env.sleep()
+	dropDirModify()
+	env.check()
+	// the deepest directory is watched
+	env.createWriteClose(dirs[len(dirs)-1], "file")
+	env.sleep()
+	dropDirModify()
 	env.check()
 }
 
@@ -104,25 +242,25 @@ func TestWatchOne(t *testing.T) {
 	// create files
 	dir1 := env.mkdir(env.root, "dir1")
 	dir2 := env.mkdir(env.root, "dir2")
-	time.Sleep(waitfor)
-	env.watcher.load(dir1, true)
-	env.watcher.load(dir2, false)
-	time.Sleep(waitfor)
+	env.sleep()
+	env.watcher.load(dir1, true, nil)
+	env.watcher.load(dir2, false, nil)
+	env.sleep()
 	// unload root watch
 	env.unload(env.root, false)
-	time.Sleep(waitfor)
+	env.sleep()
 	// write to files and remove
 	file1 := env.createWriteClose(dir1, "file1")
-	time.Sleep(waitfor)
+	env.sleep()
 	file2 := env.createWriteClose(dir2, "file2")
-	time.Sleep(waitfor)
+	env.sleep()
 	env.remove(file1)
 	env.remove(file2)
-	time.Sleep(waitfor)
+	env.sleep()
 	env.remove(dir1)
 	env.remove(dir2)
 	// check results
-	time.Sleep(waitfor)
+	env.sleep()
 	env.check()
 }
 
@@ -143,9 +281,1765 @@ func TestClose(t *testing.T) {
 		t.Fatal("close should not block")
 	}
 	// the watcher must close in time
-	time.Sleep(waitfor)
+	env.sleep()
 	err = env.watcher.close()
 	if err != ErrClosed {
 		t.Fatal("expected closed watcher", err)
 	}
 }
+
+func TestCloseContext(t *testing.T) {
+	env := newtestenv(t)
+	defer os.RemoveAll(env.root)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	w := Watcher{env.watcher}
+	if err := w.CloseContext(ctx); err != nil {
+		t.Fatal("failed to close watcher", err)
+	}
+	select {
+	case <-env.watcher.done:
+	default:
+		t.Fatal("expected the watcher to be stopped")
+	}
+	if err := w.CloseContext(ctx); err != ErrClosed {
+		t.Fatal("expected closed watcher", err)
+	}
+}
+
+func TestCloseRace(t *testing.T) {
+	root, err := ioutil.TempDir("", "watchfs")
+	if err != nil {
+		t.Fatal("failed to setup test environment", err)
+	}
+	defer os.RemoveAll(root)
+	sub := filepath.Join(root, "sub")
+	for i := 0; i < 10; i++ {
+		w, err := New(&Context{Handle: func(Event, FileInfo) {}, Error: func(error) {}})
+		if err != nil {
+			t.Fatal("failed to create watcher", err)
+		}
+		if err := w.Load(root, true); err != nil {
+			t.Fatal("failed to load.", err)
+		}
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(2)
+		// churn files while the subdirectory is loaded and unloaded
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				os.MkdirAll(filepath.Join(sub, "dir"), 0700)
+				ioutil.WriteFile(filepath.Join(sub, "dir", "file"), nil, 0600)
+				os.RemoveAll(sub)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				w.Load(sub, true)
+				w.Unload(sub, true)
+			}
+		}()
+		time.Sleep(20 * time.Millisecond)
+		if err := w.Close(); err != nil {
+			t.Error("failed to close watcher", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+		close(stop)
+		wg.Wait()
+		select {
+		case <-w.done:
+		case <-time.After(time.Second):
+			t.Fatal("expected the watcher to stop")
+		}
+	}
+}
+
+func TestNewWith(t *testing.T) {
+	var roots []string
+	for i := 0; i < 2; i++ {
+		root, err := ioutil.TempDir("", "watchfs")
+		if err != nil {
+			t.Fatal("failed to setup test environment", err)
+		}
+		defer os.RemoveAll(root)
+		roots = append(roots, root)
+	}
+	if err := os.MkdirAll(filepath.Join(roots[1], "a", "b"), 0700); err != nil {
+		t.Fatal("failed to setup test environment", err)
+	}
+	env := &testenv{T: t, root: roots[0]}
+	w, err := NewWith(&Context{Handle: env.handle, Error: env.error},
+		Root{Path: roots[0], Recursive: true, Depth: -1},
+		Root{Path: roots[1], Recursive: true, Depth: 1},
+	)
+	if err != nil {
+		t.Fatal("failed to create watcher", err)
+	}
+	env.watcher = w.watcher
+	defer env.close()
+	if fi := w.Get(filepath.Join(roots[1], "a", "b")); fi == nil || Watched(fi) {
+		t.Errorf("expected the depth limited root got %v", fi)
+	}
+	env.createWriteClose(roots[0], "file")
+	env.sleep()
+	env.createWriteClose(roots[1], "file")
+	env.sleep()
+	env.check()
+	// the watcher is returned with the errors of the missing roots
+	missing := filepath.Join(roots[1], "missing")
+	other, err := NewWith(&Context{}, Root{Path: missing}, Root{Path: roots[0]})
+	if errs, ok := err.(LoadErrors); !ok || len(errs) != 1 || errs[0].Path != missing || !os.IsNotExist(errs[0].Err) {
+		t.Errorf("expected a not exist error got %v", err)
+	}
+	if other.watcher == nil || other.Closed() || other.Get(roots[0]) == nil {
+		t.Error("expected the open watcher with the loaded root")
+	}
+	if other.watcher != nil {
+		other.Close()
+	}
+}
+
+func TestClosed(t *testing.T) {
+	env := newtestenv(t)
+	defer os.RemoveAll(env.root)
+	w := Watcher{env.watcher}
+	if w.Closed() {
+		t.Fatal("expected open watcher")
+	}
+	if err := w.CloseIdempotent(); err != nil {
+		t.Fatal("failed to close watcher", err)
+	}
+	if !w.Closed() {
+		t.Fatal("expected closed watcher")
+	}
+	// the deferred close after an explicit close
+	if err := w.CloseIdempotent(); err != nil {
+		t.Error("expected no error got", err)
+	}
+	env.sleep()
+	if err := w.Close(); err != ErrClosed {
+		t.Error("expected closed watcher", err)
+	}
+}
+
+func TestWatchError(t *testing.T) {
+	requireNative(t)
+	env := newtestenv(t)
+	defer env.close()
+	path := filepath.Join(env.root, "missing")
+	nfo := &info{path: path, mode: os.ModeDir}
+	env.watcher.mutex.Lock()
+	err := env.watcher.add(nfo, env.watcher.flags)
+	env.watcher.mutex.Unlock()
+	var werr *WatchError
+	if !errors.As(err, &werr) || werr.Op != "add" || werr.Path != path {
+		t.Fatalf("expected add error for %s got %v", path, err)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the error to wrap not exist got %v", err)
+	}
+	lerr := &LoadError{path, err}
+	if !errors.As(lerr, &werr) || lerr.Error() != "cannot watch "+path+": "+werr.Err.Error() {
+		t.Errorf("expected load error to wrap the watch error got %v", lerr)
+	}
+}
+
+func TestCreateWindow(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	file := filepath.Join(env.root, "file")
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal("failed to create.", err)
+	}
+	env.writeClose(f, err)
+	f, err = os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	env.writeClose(f, err)
+	// the writes that are not seen by the create are reported
+	env.expect = append(env.expect, record{Create, file, false}, record{Modify, file, true}, record{Modify, file, true})
+	env.sleep()
+	env.check()
+	if fi := (Watcher{env.watcher}).Get(file); fi == nil || fi.Size() != 24 {
+		t.Errorf("expected the written size in the cache got %v", fi)
+	}
+	time.Sleep(createWindow)
+	env.Lock()
+	env.events, env.expect = nil, nil
+	env.Unlock()
+	f, err = os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	env.writeClose(f, err)
+	env.expect = append(env.expect, record{Modify, file, false})
+	env.sleep()
+	env.check()
+}
+
+func TestCreateWindowWrite(t *testing.T) {
+	env := newtestenvWith(t, &Context{CreateWindow: time.Minute})
+	defer env.close()
+	if err := env.watcher.load(env.root, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(env.root, "file")
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal("failed to create.", err)
+	}
+	f.Close()
+	env.expect = append(env.expect, record{Create, file, false})
+	env.sleep()
+	env.check()
+	// a real write within the window is reported
+	f, err = os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	env.writeClose(f, err)
+	env.expect = append(env.expect, record{Modify, file, false})
+	env.sleep()
+	env.check()
+}
+
+func TestCreateWindowExpires(t *testing.T) {
+	requireUnclocked(t)
+	env := newtestenvWith(t, &Context{CreateWindow: time.Minute})
+	w := env.watcher
+	c := &fakeClock{t: time.Unix(0, 0)}
+	w.setClock(c)
+	defer env.close()
+	env.load(env.root, true)
+	file := filepath.Join(env.root, "file")
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal("failed to create.", err)
+	}
+	f.Close()
+	env.expect = append(env.expect, record{Create, file, false})
+	// held returns the number of creates held for the window
+	held := func() int {
+		w.creations.mutex.Lock()
+		defer w.creations.mutex.Unlock()
+		return len(w.creations.files)
+	}
+	env.waitUntil(func() bool { return held() == 1 })
+	// the create is forgotten once its window closed
+	c.advance(time.Minute)
+	if n := held(); n != 0 {
+		t.Errorf("expected no held creates got %d", n)
+	}
+	env.check()
+}
+
+func TestWaitFor(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	w := Watcher{env.watcher}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	file := env.createWriteClose(env.root, "file")
+	if err := w.WaitFor(ctx, file, Create); err != nil {
+		t.Fatal("failed to wait for create", err)
+	}
+	if fi := w.Get(file); fi == nil {
+		t.Fatal("expected the created file cached")
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- w.WaitFor(ctx, file, Delete|Rename)
+	}()
+	env.sleep()
+	select {
+	case err := <-done:
+		t.Fatal("expected the wait to block", err)
+	default:
+	}
+	env.remove(file)
+	if err := <-done; err != nil {
+		t.Fatal("failed to wait for delete", err)
+	}
+	if fi := w.Get(file); fi != nil {
+		t.Error("expected the deleted file not cached")
+	}
+	short, stop := context.WithTimeout(ctx, waitfor)
+	defer stop()
+	if err := w.WaitFor(short, file, Modify); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded got %v", err)
+	}
+	env.sleep()
+	env.check()
+}
+
+func TestModifyParent(t *testing.T) {
+	env := newtestenvWith(t, &Context{ModifyParent: true})
+	root, w := env.root, env.watcher
+	defer env.close()
+	env.load(root, true)
+	dir := filepath.Join(root, "dir")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal("failed to create dir", err)
+	}
+	env.expect = append(env.expect,
+		record{Create, dir, false},
+		record{Modify, root, false},
+	)
+	env.sleep()
+	env.check()
+	file := filepath.Join(dir, "file")
+	env.writeClose(os.Create(file))
+	env.expect = append(env.expect,
+		record{Create, file, false},
+		record{Modify, dir, false},
+		record{Modify, file, true},
+	)
+	env.sleep()
+	env.check()
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		t.Fatal("failed to stat dir", err)
+	}
+	if nfo := (Watcher{w}).Get(dir); nfo == nil || !nfo.ModTime().Equal(fi.ModTime()) {
+		t.Error("expected the new modification time in the cache")
+	}
+}
+
+func TestWatched(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	dir := env.mkdir(env.root, "dir")
+	file := env.createWriteClose(dir, "file")
+	env.sleep()
+	env.check()
+	w := Watcher{env.watcher}
+	if fi := w.Get(dir); fi == nil || !Watched(fi) {
+		t.Fatalf("expected watched dir got %v", fi)
+	}
+	if fi := w.Get(file); fi == nil || Watched(fi) != (backend.Name == "kqueue") {
+		t.Errorf("expected file watched only by kqueue got %v", Watched(fi))
+	}
+	if err := w.Freeze(dir, true); err != nil {
+		t.Fatal("failed to freeze.", err)
+	}
+	err := w.Traverse(dir, func(fi FileInfo) error {
+		if Watched(fi) {
+			t.Errorf("expected frozen %s not watched", fi.Path())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal("failed to traverse.", err)
+	}
+}
+
+func TestWatchExts(t *testing.T) {
+	env := newtestenvWith(t, &Context{WatchExts: []string{".go", "c"}})
+	root, w := env.root, env.watcher
+	defer env.close()
+	for _, name := range []string{"main.go", "main.c", "notes.txt", "go"} {
+		env.writeClose(os.Create(filepath.Join(root, name)))
+	}
+	env.load(root, true)
+	dir := env.mkdir(root, "dir")
+	env.sleep()
+	env.check()
+	kqueue := backend.Name == "kqueue"
+	for path, watched := range map[string]bool{
+		dir:                              true,
+		filepath.Join(root, "main.go"):   kqueue,
+		filepath.Join(root, "main.c"):    kqueue,
+		filepath.Join(root, "notes.txt"): false,
+		filepath.Join(root, "go"):        false,
+	} {
+		if fi := (Watcher{w}).Get(path); fi == nil || Watched(fi) != watched {
+			t.Errorf("expected %s watched %v got %v", path, watched, fi)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	w, err := New(&Context{Timing: true})
+	if err != nil {
+		t.Fatal("failed to create watcher", err)
+	}
+	defer w.Close()
+	root, err := ioutil.TempDir("", "watchfs")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(root)
+	err = os.Mkdir(filepath.Join(root, "dir"), 0700)
+	if err != nil {
+		t.Fatal("failed to mkdir.", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(root, "dir", "file"), nil, 0600)
+	if err != nil {
+		t.Fatal("failed to create.", err)
+	}
+	err = w.Load(root, true)
+	if err != nil {
+		t.Fatal("failed to load.", err)
+	}
+	stats := w.Stats()
+	if stats.Adds == 0 || stats.LastLoadDuration == 0 {
+		t.Errorf("expected timings got %+v", stats)
+	}
+	// the directories are watched on all backends
+	if stats.Cached != 3 || stats.Watched < 2 || stats.Dropped != 0 || stats.Overflows != 0 {
+		t.Errorf("expected counters got %+v", stats)
+	}
+}
+
+func TestEffectiveContext(t *testing.T) {
+	w, err := New(&Context{Timing: true})
+	if err != nil {
+		t.Fatal("failed to create watcher", err)
+	}
+	defer w.Close()
+	ctx := w.EffectiveContext()
+	if ctx.Handle == nil || ctx.Filter == nil || ctx.Error == nil {
+		t.Error("expected default callbacks")
+	}
+	if !ctx.Timing {
+		t.Error("expected timing to be set")
+	}
+}
+
+func TestUnloadClose(t *testing.T) {
+	// setup test environment
+	src, err := ioutil.TempDir("", "watchsrc")
+	if err != nil {
+		t.Fatal("failed to setup test environment", err)
+	}
+	defer os.RemoveAll(src)
+	for _, name := range []string{"a", "b", "c"} {
+		if err := ioutil.WriteFile(filepath.Join(src, name), nil, 0600); err != nil {
+			t.Fatal("failed to setup test environment", err)
+		}
+	}
+	blocked, release := make(chan struct{}), make(chan struct{})
+	var env *testenv
+	env = newtestenvWith(t, &Context{Handle: func(e Event, fi FileInfo) {
+		env.handle(e, fi)
+		if fi.IsDir() && e == Create {
+			// hold the run loop while the children of the moved directory wait
+			close(blocked)
+			<-release
+		}
+	}})
+	defer env.close()
+	env.load(env.root, true)
+	dir := filepath.Join(env.root, "dir")
+	if err := os.Rename(src, dir); err != nil {
+		t.Fatal("failed to rename.", err)
+	}
+	env.expect = append(env.expect, record{Create, dir, false})
+	select {
+	case <-blocked:
+	case <-time.After(time.Second):
+		t.Fatal("expected the create of the moved directory")
+	}
+	// unload and close immediately
+	env.unload(env.root, true)
+	go func() {
+		env.sleep()
+		close(release)
+	}()
+	err = env.watcher.close()
+	if err != nil {
+		t.Fatal("failed to close watcher", err)
+	}
+	time.Sleep(2 * waitfor)
+	// no events must be delivered for the unloaded paths
+	env.check()
+}
+
+func TestPersistRoots(t *testing.T) {
+	env := newtestenvWith(t, &Context{PersistRoots: true})
+	root, w := env.root, env.watcher
+	defer env.close()
+	// load a missing root
+	dir := filepath.Join(root, "dir")
+	sub := filepath.Join(dir, "sub")
+	err := Watcher{w}.Load(sub, true)
+	if err != nil {
+		t.Fatal("failed to load missing root", err)
+	}
+	// create the intermediate directory and the root
+	err = os.Mkdir(dir, 0700)
+	if err != nil {
+		t.Fatal("failed to mkdir.", err)
+	}
+	env.sleep()
+	env.mkdir(sub)
+	env.sleep()
+	env.createWriteClose(sub, "file")
+	env.sleep()
+	env.check()
+}
+
+func TestUnloadPending(t *testing.T) {
+	env := newtestenvWith(t, &Context{PersistRoots: true})
+	root, w := env.root, env.watcher
+	defer env.close()
+	sub := filepath.Join(root, "dir", "sub")
+	if err := (Watcher{w}).Load(sub, true); err != nil {
+		t.Fatal("failed to load missing root", err)
+	}
+	if fi := (Watcher{w}).Get(root); fi == nil {
+		t.Fatal("expected the persisted ancestor to be watched")
+	}
+	// unloading the pending root releases the ancestor
+	if err := (Watcher{w}).Unload(sub, true); err != nil {
+		t.Fatal("failed to unload pending root", err)
+	}
+	if fi := (Watcher{w}).Get(root); fi != nil {
+		t.Errorf("expected the persisted ancestor to be unloaded got %v", fi)
+	}
+	if w.persist != 0 {
+		t.Errorf("expected no persisted ancestors got %d", w.persist)
+	}
+}
+
+func TestRetryWatch(t *testing.T) {
+	env := newtestenvWith(t, &Context{RetryWatch: true, RetryInterval: waitfor})
+	root := env.root
+	defer env.close()
+	dir := filepath.Join(root, "dir")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal("failed to mkdir.", err)
+	}
+	env.load(dir, true)
+	file := env.createWriteClose(dir, "file")
+	env.sleep()
+	env.check()
+	env.remove(dir)
+	env.sleep()
+	env.Lock()
+	env.events, env.expect = nil, nil
+	env.Unlock()
+	// replace the root with a new directory
+	tmp := filepath.Join(root, "tmp")
+	if err := os.Mkdir(tmp, 0700); err != nil {
+		t.Fatal("failed to mkdir.", err)
+	}
+	env.writeClose(os.Create(filepath.Join(tmp, "file")))
+	if err := os.Rename(tmp, dir); err != nil {
+		t.Fatal("failed to rename.", err)
+	}
+	time.Sleep(3 * waitfor)
+	env.expect = append(env.expect, record{Create, dir, false}, record{Create, file, false})
+	env.check()
+	// the new root is watched, the append is seen at once by a scan
+	time.Sleep(createWindow)
+	env.writeClose(os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600))
+	env.expect = append(env.expect, record{Modify, file, false})
+	env.sleep()
+	env.check()
+}
+
+func TestModifyPredicate(t *testing.T) {
+	env := newtestenvWith(t, &Context{
+		ModifyPredicate: func(old, new os.FileInfo) bool {
+			return old.Size() != new.Size()
+		},
+	})
+	root := env.root
+	defer env.close()
+	env.load(root, true)
+	file := filepath.Join(root, "file")
+	env.writeClose(os.Create(file))
+	env.expect = append(env.expect, record{Create, file, false}, record{Modify, file, true})
+	env.sleep()
+	// rewriting the same content in place does not change the size
+	env.writeClose(os.OpenFile(file, os.O_WRONLY, 0600))
+	env.sleep()
+	env.check()
+}
+
+func TestContentChange(t *testing.T) {
+	changes := make(chan *ContentChange, 4)
+	var env *testenv
+	env = newtestenvWith(t, &Context{
+		Handle: func(e Event, fi FileInfo) {
+			env.handle(e, fi)
+			if c, ok := fi.(*ContentChange); ok {
+				changes <- c
+			}
+		},
+	})
+	root := env.root
+	defer env.close()
+	env.load(root, true)
+	file := env.createWriteClose(root, "file")
+	env.sleep()
+	env.check()
+	env.Lock()
+	env.events, env.expect = nil, nil
+	env.Unlock()
+	// drop the change of the write that was not seen by the create
+	for len(changes) > 0 {
+		<-changes
+	}
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	env.writeClose(f, err)
+	env.expect = append(env.expect, record{Modify, file, false})
+	env.sleep()
+	env.check()
+	select {
+	case c := <-changes:
+		if c.OldSize != 12 || c.NewSize != 24 || c.OldModTime.IsZero() || c.Path() != file {
+			t.Errorf("expected an append from 12 to 24 got %+v", c)
+		}
+	default:
+		t.Error("expected a content change")
+	}
+}
+
+func TestChmod(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	file := env.createWriteClose(env.root, "file")
+	env.sleep()
+	if err := os.Chmod(file, 0600); err != nil {
+		t.Fatal(err)
+	}
+	env.expect = append(env.expect, record{Chmod, file, false})
+	env.sleep()
+	env.check()
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0)
+	env.writeClose(f, err)
+	env.expect = append(env.expect, record{Modify, file, false})
+	env.sleep()
+	env.check()
+}
+
+func TestChmodDir(t *testing.T) {
+	if backend.Name == "iocp" {
+		t.Skip("windows only changes the read-only attribute of files")
+	}
+	env := newtestenv(t)
+	defer env.close()
+	dir := env.mkdir(env.root, "dir")
+	env.sleep()
+	env.check()
+	// the watched root and a watched directory below it report one event each
+	for _, path := range []string{env.root, dir} {
+		if err := os.Chmod(path, 0750); err != nil {
+			t.Fatal(err)
+		}
+		env.expect = append(env.expect, record{Chmod, path, false})
+		env.sleep()
+		env.check()
+	}
+	if fi := (Watcher{env.watcher}).Get(env.root); fi == nil || fi.Mode().Perm() != 0750 {
+		t.Errorf("expected the new mode in the cache got %v", fi)
+	}
+}
+
+func TestEmitInitial(t *testing.T) {
+	env := newtestenvWith(t, &Context{EmitInitial: true})
+	root := env.root
+	dir := filepath.Join(root, "dir")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal("failed to mkdir.", err)
+	}
+	file, other := filepath.Join(dir, "file"), filepath.Join(root, "other")
+	env.writeClose(os.Create(file))
+	env.writeClose(os.Create(other))
+	defer env.close()
+	env.load(root, true)
+	// the initial events are handled before load returns
+	for _, path := range []string{root, dir, file, other} {
+		env.expect = append(env.expect, record{Create, path, false})
+	}
+	env.check()
+	env.mkdir(dir, "new")
+	env.sleep()
+	env.check()
+}
+
+func TestCreateOrder(t *testing.T) {
+	// setup test environment
+	env := newtestenv(t)
+	defer env.close()
+	// populate a directory outside the watched root
+	tmp, err := ioutil.TempDir("", "watchfs")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(tmp)
+	src := filepath.Join(tmp, "dir")
+	for _, path := range []string{src, filepath.Join(src, "a"), filepath.Join(src, "a", "b")} {
+		err = os.Mkdir(path, 0700)
+		if err != nil {
+			t.Fatal("failed to mkdir.", err)
+		}
+	}
+	env.writeClose(os.Create(filepath.Join(src, "file")))
+	// move it into the watched root
+	dir := filepath.Join(env.root, "dir")
+	err = os.Rename(src, dir)
+	if err != nil {
+		t.Fatal("failed to rename.", err)
+	}
+	env.expect = append(env.expect,
+		record{Create, dir, false},
+		record{Create, filepath.Join(dir, "a"), false},
+		record{Create, filepath.Join(dir, "a", "b"), false},
+		record{Create, filepath.Join(dir, "file"), false},
+	)
+	env.sleep()
+	env.check()
+}
+
+func TestIsRecursive(t *testing.T) {
+	// setup test environment
+	env := newtestenv(t)
+	defer env.close()
+	dir1 := env.mkdir(env.root, "dir1")
+	dir2 := env.mkdir(env.root, "dir2")
+	env.sleep()
+	env.load(dir2, false)
+	w := Watcher{env.watcher}
+	if !w.IsRecursive(env.root) || !w.IsRecursive(dir1) {
+		t.Error("expected root and dir1 to be recursive")
+	}
+	if w.IsRecursive(dir2) {
+		t.Error("expected dir2 not to be recursive")
+	}
+	if w.IsRecursive(filepath.Join(env.root, "none")) {
+		t.Error("expected missing path not to be recursive")
+	}
+}
+
+func TestWithHandler(t *testing.T) {
+	// setup test environment
+	env := newtestenv(t)
+	defer env.close()
+	dir1 := env.mkdir(env.root, "dir1")
+	env.mkdir(env.root, "dir2")
+	env.sleep()
+	var scoped []string
+	var mutex sync.Mutex
+	err := Watcher{env.watcher}.Load(dir1, true, WithHandler(func(e Event, fi FileInfo) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		scoped = append(scoped, fi.Path())
+	}))
+	if err != nil {
+		t.Fatal("failed to load.", err)
+	}
+	file := env.createWriteClose(dir1, "file")
+	env.createWriteClose(env.root, "dir2", "file")
+	env.sleep()
+	env.check()
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(scoped) == 0 {
+		t.Fatal("expected scoped events")
+	}
+	for _, path := range scoped {
+		if path != file {
+			t.Errorf("unexpected scoped event for %s", path)
+		}
+	}
+}
+
+func TestWithExclude(t *testing.T) {
+	env := newtestenvWith(t, &Context{})
+	root, w := env.root, env.watcher
+	defer env.close()
+	git := filepath.Join(root, ".git")
+	err := os.Mkdir(git, 0700)
+	if err != nil {
+		t.Fatal("failed to mkdir.", err)
+	}
+	fw := Watcher{w}
+	err = fw.Load(root, true, WithExclude(".git", "node_modules"))
+	if err != nil {
+		t.Fatal("failed to load.", err)
+	}
+	if fw.Get(git) != nil {
+		t.Error("expected .git to be excluded")
+	}
+	// a later created excluded directory is not watched
+	err = os.Mkdir(filepath.Join(root, "node_modules"), 0700)
+	if err != nil {
+		t.Fatal("failed to mkdir.", err)
+	}
+	env.sleep()
+	if fw.Get(filepath.Join(root, "node_modules")) != nil {
+		t.Error("expected node_modules to be excluded")
+	}
+	env.createWriteClose(root, "file")
+	env.sleep()
+	env.check()
+}
+
+func TestNestedRootOptions(t *testing.T) {
+	env := newtestenvWith(t, &Context{})
+	root := env.root
+	defer env.close()
+	nested := filepath.Join(root, "b", "c")
+	if err := os.MkdirAll(nested, 0700); err != nil {
+		t.Fatal("failed to mkdir.", err)
+	}
+	var outer []string
+	var mutex sync.Mutex
+	fw := Watcher{env.watcher}
+	err := fw.Load(root, true, WithExclude("b"), WithHandler(func(e Event, fi FileInfo) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		outer = append(outer, fi.Path())
+	}))
+	if err != nil {
+		t.Fatal("failed to load.", err)
+	}
+	// the nested root does not inherit the exclusion or handler of the outer root
+	if err := fw.Load(nested, true); err != nil {
+		t.Fatal("failed to load.", err)
+	}
+	env.mkdir(nested, "d")
+	env.sleep()
+	file := env.createWriteClose(nested, "d", "file")
+	env.sleep()
+	env.check()
+	if fw.Get(file) == nil {
+		t.Errorf("expected %s to be cached", file)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(outer) != 0 {
+		t.Errorf("expected no events for the outer handler got %v", outer)
+	}
+}
+
+func TestHandleW(t *testing.T) {
+	root, err := ioutil.TempDir("", "watchfs")
+	if err != nil {
+		t.Fatal("failed to setup test environment", err)
+	}
+	defer os.RemoveAll(root)
+	found := make(chan bool, 1)
+	w, err := New(&Context{
+		HandleW: func(w Watcher, e Event, fi FileInfo) {
+			select {
+			case found <- w.Get(fi.Path()) != nil:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal("failed to create watcher", err)
+	}
+	defer w.Close()
+	err = w.Load(root, true)
+	if err != nil {
+		t.Fatal("failed to load.", err)
+	}
+	err = os.Mkdir(filepath.Join(root, "dir"), 0700)
+	if err != nil {
+		t.Fatal("failed to mkdir.", err)
+	}
+	select {
+	case ok := <-found:
+		if !ok {
+			t.Error("expected the watcher to find the created dir")
+		}
+	case <-time.After(time.Second):
+		t.Error("expected an event")
+	}
+}
+
+func TestShortLived(t *testing.T) {
+	// setup test environment
+	env := newtestenv(t)
+	defer env.close()
+	for i := 0; i < 200; i++ {
+		path := filepath.Join(env.root, fmt.Sprintf("file%d", i%10))
+		env.writeClose(os.Create(path))
+		err := os.Remove(path)
+		if err != nil {
+			t.Fatal("failed to remove.", err)
+		}
+	}
+	time.Sleep(5 * waitfor)
+	env.Lock()
+	defer env.Unlock()
+	count := make(map[string]int)
+	for _, r := range env.events {
+		switch r.Event {
+		case Create:
+			count[r.path]++
+		case Delete:
+			count[r.path]--
+		}
+		if n := count[r.path]; n < 0 || n > 1 {
+			t.Errorf("unbalanced %s", r)
+		}
+	}
+	for path, n := range count {
+		if n != 0 {
+			t.Errorf("unbalanced events for %s", path)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Getuid() == 0 {
+		t.Skip("requires permission checks")
+	}
+	root, err := ioutil.TempDir("", "watchfs")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(root)
+	blind := filepath.Join(root, "blind")
+	err = os.Mkdir(blind, 0)
+	if err != nil {
+		t.Fatal("failed to mkdir.", err)
+	}
+	defer os.Chmod(blind, 0700)
+	errs := make(chan error, 4)
+	w, err := New(&Context{AddRetries: 1, Error: func(err error) {
+		errs <- err
+	}})
+	if err != nil {
+		t.Fatal("failed to create watcher", err)
+	}
+	defer w.Close()
+	// the load succeeds and reports the blind directory
+	if err = w.Load(root, true); err != nil {
+		t.Fatal("failed to load.", err)
+	}
+	select {
+	case err = <-errs:
+		if lerr, ok := err.(*LoadError); !ok || lerr.Path != blind {
+			t.Errorf("expected load error for %s got %v", blind, err)
+		}
+	case <-time.After(4 * retryBackoff):
+		t.Errorf("expected load error for %s", blind)
+	}
+}
+
+func TestSyncInitial(t *testing.T) {
+	env := newtestenvWith(t, &Context{
+		Debounce:      time.Minute,
+		DebounceByDir: time.Minute,
+		Throttle:      time.Minute,
+		CoalesceBulk:  true,
+		CreateOnClose: true,
+	})
+	root, w := env.root, env.watcher
+	defer env.close()
+	file := filepath.Join(root, "file")
+	env.writeClose(os.Create(file))
+	if err := (Watcher{w}).Load(root, true, WithSyncInitial()); err != nil {
+		t.Fatal("failed to load.", err)
+	}
+	// the initial events are not held back
+	env.expect = append(env.expect, record{Create, root, false}, record{Create, file, false})
+	env.check()
+}
+
+func TestWatchLimit(t *testing.T) {
+	w, err := newwatcher(&Context{AddRetries: 3})
+	if err != nil {
+		t.Fatal("failed to create watcher", err)
+	}
+	defer w.close()
+	nfo := &info{path: filepath.Join(os.TempDir(), "limited")}
+	start := time.Now()
+	errs := w.retryAdds([]failedAdd{{nfo, w.flags, ErrWatchLimit}})
+	if time.Since(start) >= retryBackoff {
+		t.Error("expected no retries at the watch limit")
+	}
+	if len(errs) != 1 || errs[0].Path != nfo.path || errs[0].Err != ErrWatchLimit {
+		t.Errorf("expected watch limit error for %s got %v", nfo.path, errs)
+	}
+}
+
+func TestWithCreatesOnly(t *testing.T) {
+	env := newtestenvWith(t, &Context{})
+	root, w := env.root, env.watcher
+	defer env.close()
+	err := Watcher{w}.Load(root, true, WithCreatesOnly())
+	if err != nil {
+		t.Fatal("failed to load.", err)
+	}
+	dir := env.mkdir(root, "dir")
+	env.sleep()
+	// changes below the new directory are not reported
+	err = os.Mkdir(filepath.Join(dir, "sub"), 0700)
+	if err != nil {
+		t.Fatal("failed to mkdir.", err)
+	}
+	file := filepath.Join(root, "file")
+	env.writeClose(os.Create(file))
+	env.expect = append(env.expect, record{Create, file, false})
+	env.sleep()
+	// modifications and deletes are not reported
+	env.writeClose(os.Create(file))
+	err = os.Remove(file)
+	if err != nil {
+		t.Fatal("failed to remove.", err)
+	}
+	env.sleep()
+	env.check()
+}
+
+func TestLoadDepth(t *testing.T) {
+	env := newtestenvWith(t, &Context{})
+	root, w := env.root, env.watcher
+	if err := os.MkdirAll(filepath.Join(root, "a", "b", "c"), 0700); err != nil {
+		t.Fatal("failed to setup test environment", err)
+	}
+	defer env.close()
+	if err := (Watcher{w}).LoadDepth(root, 1); err != nil {
+		t.Fatal("failed to load.", err)
+	}
+	check := func(path string, cached, watched bool) {
+		fi := Watcher{w}.Get(path)
+		if (fi != nil) != cached || fi != nil && Watched(fi) != watched {
+			t.Errorf("expected %s cached %v and watched %v got %v", path, cached, watched, fi)
+		}
+	}
+	a, b := filepath.Join(root, "a"), filepath.Join(root, "a", "b")
+	check(root, true, true)
+	check(a, true, true)
+	check(b, true, false)
+	check(filepath.Join(b, "c"), false, false)
+	// new directories are limited as well
+	x := env.mkdir(root, "x")
+	env.sleep()
+	y := env.mkdir(x, "y")
+	env.sleep()
+	if err := os.Mkdir(filepath.Join(y, "z"), 0700); err != nil {
+		t.Fatal("failed to mkdir.", err)
+	}
+	env.createWriteClose(a, "file")
+	env.sleep()
+	env.check()
+	check(x, true, true)
+	check(y, true, false)
+	check(filepath.Join(y, "z"), false, false)
+	// loading a limited directory explicitly adds its watch
+	if err := (Watcher{w}).Load(b, false); err != nil {
+		t.Fatal("failed to load.", err)
+	}
+	check(b, true, true)
+}
+
+func TestWithLogicalPaths(t *testing.T) {
+	requireNative(t)
+	env := newtestenv(t)
+	defer env.close()
+	link := env.root + "-link"
+	err := os.Symlink(env.root, link)
+	if err != nil {
+		t.Fatal("failed to symlink.", err)
+	}
+	defer os.Remove(link)
+	err = Watcher{env.watcher}.Load(link, true, WithLogicalPaths())
+	if err != nil {
+		t.Fatal("failed to load.", err)
+	}
+	file := filepath.Join(link, "file")
+	env.writeClose(os.Create(file))
+	env.expect = append(env.expect, record{Create, file, false}, record{Modify, file, true})
+	env.sleep()
+	env.check()
+	real, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := env.watcher
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	for _, c := range [][2]string{
+		{real, link},
+		{filepath.Join(real, "dir", "file"), filepath.Join(link, "dir", "file")},
+		{real + "x", real + "x"},
+	} {
+		if got := w.logical(c[0]); got != c[1] {
+			t.Errorf("expected %s got %s", c[1], got)
+		}
+	}
+}
+
+func TestPauseRoot(t *testing.T) {
+	env := newtestenvWith(t, &Context{})
+	root, w := env.root, env.watcher
+	defer env.close()
+	paused := filepath.Join(root, "paused")
+	live := filepath.Join(root, "live")
+	old := filepath.Join(paused, "old")
+	for _, dir := range []string{paused, live} {
+		err := os.Mkdir(dir, 0700)
+		if err != nil {
+			t.Fatal("failed to mkdir.", err)
+		}
+		err = Watcher{w}.Load(dir, true)
+		if err != nil {
+			t.Fatal("failed to load.", err)
+		}
+	}
+	env.writeClose(os.Create(old))
+	env.expect = append(env.expect, record{Create, old, false}, record{Modify, old, true})
+	env.sleep()
+	env.check()
+	Watcher{w}.PauseRoot(paused)
+	file := filepath.Join(paused, "file")
+	env.writeClose(os.Create(file))
+	err := os.Remove(old)
+	if err != nil {
+		t.Fatal("failed to remove.", err)
+	}
+	other := filepath.Join(live, "file")
+	env.writeClose(os.Create(other))
+	env.expect = append(env.expect, record{Create, other, false}, record{Modify, other, true})
+	env.sleep()
+	env.check()
+	Watcher{w}.ResumeRoot(paused)
+	env.expect = append(env.expect, record{Create, file, false}, record{Delete, old, false})
+	env.sleep()
+	env.check()
+	// unloading a paused root forgets its snapshot
+	Watcher{w}.PauseRoot(paused)
+	if err := (Watcher{w}).Unload(paused, true); err != nil {
+		t.Fatal("failed to unload.", err)
+	}
+	if len(w.paused) != 0 {
+		t.Errorf("expected no paused roots got %v", w.paused)
+	}
+	env.writeClose(os.Create(old))
+	if err := (Watcher{w}).Load(paused, true); err != nil {
+		t.Fatal("failed to load.", err)
+	}
+	Watcher{w}.ResumeRoot(paused)
+	env.sleep()
+	env.check()
+}
+
+func TestLoadWalk(t *testing.T) {
+	env := newtestenvWith(t, &Context{})
+	root, nw := env.root, env.watcher
+	defer env.close()
+	skip := filepath.Join(root, "skip")
+	keep := filepath.Join(root, "keep")
+	for _, dir := range []string{skip, keep} {
+		err := os.Mkdir(dir, 0700)
+		if err != nil {
+			t.Fatal("failed to mkdir.", err)
+		}
+		env.writeClose(os.Create(filepath.Join(dir, "file")))
+	}
+	w := Watcher{nw}
+	var visited []string
+	err := w.LoadWalk(root, true, func(path string, fi os.FileInfo) (bool, bool, error) {
+		visited = append(visited, path)
+		if fi.Name() == "skip" {
+			return false, false, nil
+		}
+		return fi.IsDir(), true, nil
+	})
+	if err != nil {
+		t.Fatal("failed to load.", err)
+	}
+	if len(visited) != 4 {
+		t.Errorf("expected 4 visited paths got %v", visited)
+	}
+	if w.Get(skip) == nil || w.Get(filepath.Join(skip, "file")) != nil {
+		t.Error("expected skipped dir to be cached but not descended")
+	}
+	if w.Get(filepath.Join(keep, "file")) == nil {
+		t.Error("expected file in kept dir to be cached")
+	}
+	abort := errors.New("abort")
+	err = w.LoadWalk(filepath.Join(root, "other"), true, nil)
+	if !os.IsNotExist(err) {
+		t.Errorf("expected not exist error got %v", err)
+	}
+	err = w.LoadWalk(skip, true, func(path string, fi os.FileInfo) (bool, bool, error) {
+		return false, false, abort
+	})
+	if err != abort {
+		t.Errorf("expected abort error got %v", err)
+	}
+}
+
+func TestRetryAdds(t *testing.T) {
+	env := newtestenvWith(t, &Context{AddRetries: 2})
+	root, w := env.root, env.watcher
+	c := &fakeClock{t: time.Unix(0, 0)}
+	w.setClock(c)
+	defer env.close()
+	dir := filepath.Join(root, "dir")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal("failed to mkdir.", err)
+	}
+	env.load(root, true)
+	w.mutex.RLock()
+	nfo := w.tree.get(dir)
+	w.mutex.RUnlock()
+	if err := w.unwatch([]*info{nfo}); err != nil {
+		t.Fatal("failed to unwatch.", err)
+	}
+	errs := w.retryAdds([]failedAdd{{nfo, w.flags, os.ErrPermission}})
+	// the retries do not block the load
+	if fi := (Watcher{w}).Get(dir); len(errs) != 0 || fi == nil || Watched(fi) {
+		t.Errorf("expected the retry in the background got %v", errs)
+	}
+	c.advance(retryBackoff)
+	if fi := (Watcher{w}).Get(dir); fi == nil || !Watched(fi) {
+		t.Errorf("expected the retried watch of %s got %v", dir, fi)
+	}
+}
+
+func TestRegainPermission(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Getuid() == 0 {
+		t.Skip("requires permission checks")
+	}
+	env := newtestenvWith(t, &Context{})
+	root, nw := env.root, env.watcher
+	defer env.close()
+	blind := filepath.Join(root, "blind")
+	err := os.Mkdir(blind, 0700)
+	if err != nil {
+		t.Fatal("failed to mkdir.", err)
+	}
+	file := filepath.Join(blind, "file")
+	env.writeClose(os.Create(file))
+	err = os.Chmod(blind, 0)
+	if err != nil {
+		t.Fatal("failed to chmod.", err)
+	}
+	defer os.Chmod(blind, 0700)
+	err = Watcher{nw}.Load(root, true)
+	if err != nil {
+		t.Fatal("failed to load.", err)
+	}
+	env.Lock()
+	if len(env.errors) == 0 {
+		t.Error("expected the blind directory reported")
+	}
+	env.errors = nil
+	env.Unlock()
+	err = os.Chmod(blind, 0700)
+	if err != nil {
+		t.Fatal("failed to chmod.", err)
+	}
+	// the permission change is reported as Chmod and the found file as Create
+	env.expect = append(env.expect, record{Chmod, blind, false}, record{Create, file, false})
+	env.sleep()
+	env.check()
+	sub := env.mkdir(blind, "sub")
+	env.createWriteClose(sub, "file")
+	env.sleep()
+	env.check()
+}
+
+func TestRescan(t *testing.T) {
+	env := newtestenvWith(t, &Context{})
+	root, nw := env.root, env.watcher
+	defer env.close()
+	sub := filepath.Join(root, "sub")
+	err := os.Mkdir(sub, 0700)
+	if err != nil {
+		t.Fatal("failed to mkdir.", err)
+	}
+	file := filepath.Join(sub, "file")
+	env.writeClose(os.Create(file))
+	err = Watcher{nw}.Load(root, false)
+	if err != nil {
+		t.Fatal("failed to load.", err)
+	}
+	// sub is cached but not watched, simulate a lost create and delete
+	gone := filepath.Join(sub, "gone")
+	nw.mutex.Lock()
+	dir := nw.tree.get(sub)
+	nw.tree.insert(&info{path: gone})
+	nw.mutex.Unlock()
+	nw.rescan(dir)
+	env.expect = append(env.expect, record{Delete, gone, false}, record{Create, file, false})
+	env.sleep()
+	env.check()
+}
+
+func TestReload(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	w := Watcher{env.watcher}
+	sub := env.mkdir(env.root, "sub")
+	env.sleep()
+	env.check()
+	w.mutex.RLock()
+	dir := w.tree.get(sub)
+	w.mutex.RUnlock()
+	// break the watch of sub and miss a create
+	if err := env.watcher.unwatch([]*info{dir}); err != nil {
+		t.Fatal("failed to unwatch.", err)
+	}
+	missed := env.createWriteClose(sub, "missed")
+	env.sleep()
+	if err := w.Reload(env.root); err != nil {
+		t.Fatal("failed to reload.", err)
+	}
+	env.sleep()
+	w.mutex.RLock()
+	again := w.tree.get(sub)
+	w.mutex.RUnlock()
+	if again != dir || again.watch == nil {
+		t.Error("expected the cached directory to be watched again")
+	}
+	if w.Get(missed) == nil {
+		t.Error("expected the missed file to be cached")
+	}
+	env.createWriteClose(sub, "new")
+	env.sleep()
+	env.check()
+	if err := w.Reload(filepath.Join(env.root, "none")); err != ErrNotWatched {
+		t.Errorf("expected ErrNotWatched got %v", err)
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+	requireNative(t)
+	env := newtestenvWith(t, &Context{})
+	root, nw := env.root, env.watcher
+	defer env.close()
+	file := filepath.Join(root, "config")
+	env.writeClose(os.Create(file))
+	err := Watcher{nw}.WatchFile(file)
+	if err != nil {
+		t.Fatal("failed to watch file.", err)
+	}
+	// siblings are not reported
+	tmp := filepath.Join(root, "config.tmp")
+	env.writeClose(os.Create(tmp))
+	// the atomic replace is reported as modify
+	err = os.Rename(tmp, file)
+	if err != nil {
+		t.Fatal("failed to rename.", err)
+	}
+	env.expect = append(env.expect, record{Modify, file, false})
+	env.sleep()
+	env.check()
+	err = os.Remove(file)
+	if err != nil {
+		t.Fatal("failed to remove.", err)
+	}
+	env.writeClose(os.Create(file))
+	env.expect = append(env.expect, record{Delete, file, false}, record{Create, file, false}, record{Modify, file, true})
+	env.sleep()
+	env.check()
+}
+
+func TestWatchFileLoaded(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	w := Watcher{env.watcher}
+	file := env.createWriteClose(env.root, "file")
+	env.sleep()
+	env.check()
+	// watching a file of a loaded root keeps reporting its siblings
+	if err := w.WatchFile(file); err != nil {
+		t.Fatal("failed to watch file.", err)
+	}
+	env.createWriteClose(env.root, "sibling")
+	env.sleep()
+	env.check()
+	// more files watched in an unloaded directory are all reported
+	dir := filepath.Join(env.root, "dir")
+	if err := w.Unload(env.root, true); err != nil {
+		t.Fatal("failed to unload.", err)
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal("failed to mkdir.", err)
+	}
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	// the files are created before the first watch, because the kernel events of
+	// creating b in the directory watched for a would report b once it is watched
+	env.writeClose(os.Create(a))
+	env.writeClose(os.Create(b))
+	for _, path := range []string{a, b} {
+		if err := w.WatchFile(path); err != nil {
+			t.Fatal("failed to watch file.", err)
+		}
+	}
+	env.writeClose(os.Create(filepath.Join(dir, "c")))
+	env.sleep()
+	for _, path := range []string{a, b} {
+		env.writeClose(os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600))
+		env.expect = append(env.expect, record{Modify, path, false})
+	}
+	env.sleep()
+	env.check()
+}
+
+func TestAtomicReplace(t *testing.T) {
+	requireNative(t)
+	env := newtestenv(t)
+	defer env.close()
+	file := env.createWriteClose(env.root, "file")
+	tmp := env.createWriteClose(env.root, "file.tmp")
+	env.sleep()
+	env.check()
+	// the replaced file keeps its cached info and is only modified
+	before := Watcher{env.watcher}.Get(file)
+	err := os.Rename(tmp, file)
+	if err != nil {
+		t.Fatal("failed to rename.", err)
+	}
+	env.expect = append(env.expect, record{Delete, tmp, false}, record{Modify, file, false})
+	env.sleep()
+	env.check()
+	if fi := (Watcher{env.watcher}).Get(file); fi != before {
+		t.Errorf("expected the cached info of the replaced file got %v", fi)
+	}
+}
+
+func TestLastEvent(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	w := Watcher{env.watcher}
+	if last, ok := w.LastEvent(env.root); !ok || !last.IsZero() {
+		t.Fatalf("expected no event yet got %v %v", last, ok)
+	}
+	start := time.Now()
+	file := env.createWriteClose(env.root, "file")
+	env.sleep()
+	env.check()
+	for _, path := range []string{env.root, file} {
+		if last, ok := w.LastEvent(path); !ok || last.Before(start) {
+			t.Errorf("expected an event for %s got %v %v", path, last, ok)
+		}
+	}
+	if _, ok := w.LastEvent(filepath.Join(env.root, "missing")); ok {
+		t.Error("expected no time for a missing file")
+	}
+}
+
+func TestDescriptors(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	dir := env.mkdir(env.root, "dir")
+	env.sleep()
+	env.check()
+	w := Watcher{env.watcher}
+	paths := make(map[string]bool)
+	for _, path := range w.Descriptors() {
+		paths[path] = true
+	}
+	if !paths[env.root] || !paths[dir] {
+		t.Fatalf("expected descriptors for root and dir got %v", paths)
+	}
+	err := w.Unload(dir, true)
+	if err != nil {
+		t.Fatal("failed to unload.", err)
+	}
+	for _, path := range w.Descriptors() {
+		if path == dir {
+			t.Error("expected unload to release the descriptor")
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	dir := env.mkdir(env.root, "dir")
+	env.createWriteClose(dir, "file")
+	sub := env.mkdir(dir, "sub")
+	env.sleep()
+	w := Watcher{env.watcher}
+	list := w.List()
+	expect := []string{env.root, dir, sub}
+	if !reflect.DeepEqual(list, expect) {
+		t.Errorf("expected %v got %v", expect, list)
+	}
+	err := w.Unload(dir, true)
+	if err != nil {
+		t.Fatal("failed to unload.", err)
+	}
+	if list = w.List(); !reflect.DeepEqual(list, expect[:1]) {
+		t.Errorf("expected %v got %v", expect[:1], list)
+	}
+}
+
+func TestTraverseContext(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	a := env.mkdir(env.root, "a")
+	ab := env.mkdir(env.root, "a-b")
+	env.sleep()
+	env.createWriteClose(a, "b")
+	env.createWriteClose(ab, "c")
+	env.sleep()
+	env.check()
+	w := Watcher{env.watcher}
+	var seen []string
+	err := w.TraverseContext(context.Background(), env.root, func(fi FileInfo) error {
+		seen = append(seen, fi.Path())
+		if fi.Path() == a {
+			return SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal("failed to traverse.", err)
+	}
+	if len(seen) != 4 || seen[0] != env.root {
+		t.Errorf("expected root, a, a-b and a-b/c got %v", seen)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	n := 0
+	err = w.TraverseContext(ctx, env.root, func(fi FileInfo) error {
+		n++
+		cancel()
+		return nil
+	})
+	if err != context.Canceled || n != 1 {
+		t.Errorf("expected cancel after one entry got %v after %d", err, n)
+	}
+	if err := w.TraverseContext(context.Background(), filepath.Join(env.root, "none"), nil); !os.IsNotExist(err) {
+		t.Errorf("expected a not exist error got %v", err)
+	}
+}
+
+func TestTraverseWatched(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	dir := env.mkdir(env.root, "dir")
+	file := env.createWriteClose(dir, "file")
+	env.sleep()
+	env.check()
+	w := Watcher{env.watcher}
+	err := w.Freeze(dir, false)
+	if err != nil {
+		t.Fatal("failed to freeze.", err)
+	}
+	got := make(map[string]bool)
+	err = w.TraverseWatched(env.root, func(fi FileInfo, watched bool) error {
+		got[fi.Path()] = watched
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{env.root: true, dir: false, file: false}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v got %v", want, got)
+	}
+	for path, watched := range want {
+		if got[path] != watched {
+			t.Errorf("expected %s watched %v got %v", path, watched, got[path])
+		}
+	}
+}
+
+func TestWithOneShot(t *testing.T) {
+	env := newtestenvWith(t, &Context{})
+	root, nw := env.root, env.watcher
+	defer env.close()
+	w := Watcher{nw}
+	err := w.Load(root, true, WithOneShot())
+	if err != nil {
+		t.Fatal("failed to load.", err)
+	}
+	file := filepath.Join(root, "lock")
+	env.writeClose(os.Create(file))
+	env.writeClose(os.Create(filepath.Join(root, "other")))
+	env.expect = append(env.expect, record{Create, file, false})
+	env.sleep()
+	env.check()
+	if w.Get(root) != nil {
+		t.Error("expected the root to be unloaded")
+	}
+}
+
+func TestLoadOnce(t *testing.T) {
+	env := newtestenvWith(t, &Context{})
+	root, nw := env.root, env.watcher
+	defer env.close()
+	w := Watcher{nw}
+	file := filepath.Join(root, "ready")
+	env.writeClose(os.Create(file))
+	if err := w.LoadOnce(file, Delete); err != nil {
+		t.Fatal("failed to load.", err)
+	}
+	// other files and events are not reported
+	env.writeClose(os.Create(filepath.Join(root, "other")))
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	env.writeClose(f, err)
+	env.sleep()
+	env.check()
+	if w.Get(root) == nil {
+		t.Fatal("expected the root to be loaded")
+	}
+	env.remove(file)
+	env.sleep()
+	env.writeClose(os.Create(file))
+	env.sleep()
+	env.check()
+	if w.Get(root) != nil {
+		t.Error("expected the root to be unloaded")
+	}
+}
+
+func TestLoadOnceDir(t *testing.T) {
+	env := newtestenvWith(t, &Context{})
+	defer env.close()
+	w := Watcher{env.watcher}
+	dir := env.mkdir(env.root, "dir")
+	env.expect = nil
+	if err := w.LoadOnce(dir, 0); err != nil {
+		t.Fatal("failed to load.", err)
+	}
+	env.watcher.mutex.RLock()
+	fi := env.watcher.tree.get(dir)
+	env.watcher.mutex.RUnlock()
+	if fi == nil || !fi.has(oneshot) {
+		t.Errorf("expected a one shot watch got %v", fi)
+	}
+	file := filepath.Join(dir, "file")
+	env.writeClose(os.Create(file))
+	env.expect = append(env.expect, record{Create, file, false})
+	env.sleep()
+	env.writeClose(os.Create(filepath.Join(dir, "other")))
+	env.sleep()
+	env.check()
+	if w.Get(dir) != nil || len(w.Descriptors()) != 0 {
+		t.Errorf("expected the directory to be unloaded got %v", w.Descriptors())
+	}
+}
+
+func TestLoadOnceLoaded(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	w := Watcher{env.watcher}
+	file := env.createWriteClose(env.root, "lock")
+	env.sleep()
+	env.check()
+	// a file of a loaded root is already reported
+	if err := w.LoadOnce(file, Delete); err != nil {
+		t.Fatal("failed to load.", err)
+	}
+	env.remove(file)
+	env.sleep()
+	env.createWriteClose(env.root, "other")
+	env.sleep()
+	env.check()
+	if w.Get(env.root) == nil {
+		t.Error("expected the root to stay loaded")
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	if backend.Name == "inotify" || backend.Name == "iocp" {
+		w, err := New(&Context{BufferSize: 16})
+		if err == nil {
+			w.Close()
+			t.Fatal("expected error for a buffer smaller than an event")
+		}
+	}
+	// the smallest valid buffer reads one event at a time
+	env := newtestenvWith(t, &Context{BufferSize: 600})
+	root := env.root
+	defer env.close()
+	env.load(root, true)
+	for _, name := range []string{"a", "b", "c"} {
+		env.mkdir(root, name)
+	}
+	env.sleep()
+	env.check()
+}
+
+func TestCount(t *testing.T) {
+	env := newtestenv(t)
+	defer env.close()
+	root, err := ioutil.TempDir("", "watchfs")
+	if err != nil {
+		t.Fatal("failed to setup test environment", err)
+	}
+	defer os.RemoveAll(root)
+	for _, dir := range []string{"a/b", "skip/c"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0700); err != nil {
+			t.Fatal("failed to setup test environment", err)
+		}
+	}
+	for _, file := range []string{"f", "a/f", "a/b/f", "skip/f"} {
+		if err := ioutil.WriteFile(filepath.Join(root, file), nil, 0600); err != nil {
+			t.Fatal("failed to setup test environment", err)
+		}
+	}
+	w := Watcher{env.watcher}
+	w.SetFilter(func(fi FileInfo) bool {
+		return filepath.Base(fi.Path()) != "skip"
+	}, false)
+	dirs, files, err := w.Count(root, true)
+	if err != nil || dirs != 3 || files != 3 {
+		t.Errorf("expected 3 dirs and 3 files got %d %d %v", dirs, files, err)
+	}
+	dirs, files, err = w.Count(root, false)
+	if err != nil || dirs != 2 || files != 1 {
+		t.Errorf("expected 2 dirs and 1 file got %d %d %v", dirs, files, err)
+	}
+	if _, _, err = w.Count(filepath.Join(root, "f"), true); err != ErrNotDir {
+		t.Errorf("expected ErrNotDir got %v", err)
+	}
+	if fi := w.Get(root); fi != nil {
+		t.Errorf("expected nothing cached got %v", fi)
+	}
+	env.sleep()
+	env.check()
+}
+
+func TestEventMask(t *testing.T) {
+	for _, mask := range []Mask{StructureChanges, ContentChanges, Attributes} {
+		env := newtestenvWith(t, &Context{EventMask: mask})
+		root, w := env.root, Watcher{env.watcher}
+		file := filepath.Join(root, "file")
+		if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+			t.Fatal("failed to create.", err)
+		}
+		env.load(root, true)
+		// each change is delivered only if selected by the mask
+		add := func(m Mask, r ...record) {
+			if mask&m != 0 {
+				env.expect = append(env.expect, r...)
+			}
+		}
+		newFile := filepath.Join(root, "new")
+		env.writeClose(os.Create(newFile))
+		add(StructureChanges, record{Create, newFile, false})
+		add(ContentChanges, record{Modify, newFile, true})
+		env.sleep()
+		env.writeClose(os.OpenFile(file, os.O_WRONLY, 0))
+		add(ContentChanges, record{Modify, file, false})
+		env.sleep()
+		if err := os.Chmod(file, 0640); err != nil {
+			t.Fatal("failed to chmod.", err)
+		}
+		add(Attributes, record{Chmod, file, false})
+		env.sleep()
+		if err := os.Remove(file); err != nil {
+			t.Fatal("failed to remove.", err)
+		}
+		add(StructureChanges, record{Delete, file, false})
+		env.sleep()
+		env.check()
+		// deletes are watched with any mask
+		if fi := w.Get(file); fi != nil {
+			t.Errorf("mask %d: expected the deleted file to be uncached got %v", mask, fi)
+		}
+		env.close()
+	}
+}
@@ -2,7 +2,7 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// +build windows
+// +build windows,!poll
 
 package fswatch
 
@@ -12,6 +12,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
 	"syscall"
 	"unsafe"
@@ -23,101 +24,245 @@ const (
 	allFlags    = createFlags | modifyFlags
 )
 
+var backend = BackendInfo{
+	Name:            "iocp",
+	ReportsRename:   true,
+	NativeRecursive: true,
+	ReportsRepeats:  true,
+}
+
 const errMoreData syscall.Errno = 234
 
+// maxPathLen is the maximum number of UTF-16 characters of a long path
+const maxPathLen = 32767
+
+// nameOffset is the offset of the file name in a FILE_NOTIFY_INFORMATION record
+const nameOffset = uint32(unsafe.Offsetof(syscall.FileNotifyInformation{}.FileName))
+
 type watch struct {
 	overlap syscall.Overlapped
 	handle  syscall.Handle
 	mask    uint32
 	info    *info
-	buf     [4096]byte
+	buf     []byte
+	// subtree is set if the watch reports the changes of all descendents
+	subtree bool
 }
 
 type watcher struct {
 	mutex   sync.RWMutex
 	port    syscall.Handle
+	flags   uint32
+	bufsize int
 	context Context
 	tree    *tree
 	signal  chan func() (done bool)
+	// direct runs the calls on the calling goroutine while NewWith loads the roots
+	direct bool
+	shared
 }
 
-func newwatcher(ctx *Context) (*watcher, error) {
+func newwatcher(ctx *Context, roots ...Root) (*watcher, error) {
+	// a record holds a name of up to 255 UTF-16 characters, or with a subtree watch
+	// a path relative to the root of up to the length of a long path
+	def, min := 4096, int(nameOffset)+255*2
+	if ctx.SubtreeWatch {
+		min = int(nameOffset) + maxPathLen*2
+		def = min
+	}
+	size, err := bufferSize(ctx, def, min)
+	if err != nil {
+		return nil, err
+	}
 	port, err := syscall.CreateIoCompletionPort(syscall.InvalidHandle, 0, 0, 1)
 	if err != nil {
 		return nil, os.NewSyscallError("CreateIoCompletionPort", err)
 	}
 	w := &watcher{
 		port:    port,
+		bufsize: size,
 		context: defaults(ctx),
 		tree:    new(tree),
 		signal:  make(chan func() bool, 1),
 	}
+	w.flags = eventFlags(w.context.EventMask)
+	w.init(&w.context)
+	// the roots are watched before the changes are handled
+	w.direct = true
+	err = w.seed(roots)
+	w.mutex.Lock()
+	w.direct = false
+	w.mutex.Unlock()
 	go w.run(port)
-	return w, nil
+	return w, err
+}
+
+// eventFlags translates the portable event mask to directory change notify filters.
+// Deletes are always reported to keep the cache consistent, the name changes
+// include creates and renames.
+func eventFlags(mask Mask) uint32 {
+	if mask == 0 {
+		return allFlags
+	}
+	flags := uint32(createFlags)
+	if mask&ContentChanges != 0 {
+		flags |= modifyFlags
+	}
+	if mask&Attributes != 0 {
+		flags |= syscall.FILE_NOTIFY_CHANGE_ATTRIBUTES
+	}
+	return flags
 }
 
 func watchFilter(nfo *info) bool {
-	return nfo.mode&os.ModeDir != 0
+	return nfo.IsDir()
 }
 
-func (w *watcher) load(path string, recursive bool) error {
+func (w *watcher) load(path string, recursive bool, opts *loadOptions) error {
 	w.mutex.RLock()
 	port := w.port
 	w.mutex.RUnlock()
 	if port == syscall.InvalidHandle {
 		return ErrClosed
 	}
-	resp := make(chan error)
 	flags := uint(explicit)
 	if recursive {
 		flags |= recurse
 	}
-	w.signal <- func() bool {
-		resp <- w.loadImpl(path, flags, 0, allFlags, allFlags)
-		return false
-	}
-	err := syscall.PostQueuedCompletionStatus(w.port, 0, 0, nil)
-	if err != nil {
-		return os.NewSyscallError("PostQueuedCompletionStatus", err)
-	}
-
-	err = <-resp
+	err := w.call(port, func() error {
+		return w.loadImpl(path, flags, w.context.initialEvent(opts), w.flags, w.flags, opts)
+	})
 	if err == SkipDir {
 		return nil
 	}
 	return err
 }
 
+// serial runs fn in the run loop and waits for it.
+// It returns ErrClosed if the watcher was closed before fn could run.
+func (w *watcher) serial(fn func()) error {
+	w.mutex.RLock()
+	port := w.port
+	w.mutex.RUnlock()
+	if port == syscall.InvalidHandle {
+		return ErrClosed
+	}
+	return w.call(port, func() error {
+		fn()
+		return nil
+	})
+}
+
 func (w *watcher) watch(nfo *info, flags uint32) error {
-	resp := make(chan error)
-	w.signal <- func() bool {
-		resp <- w.add(nfo, allFlags)
+	return w.call(w.port, func() error {
+		return w.add(nfo, flags)
+	})
+}
+
+// call runs fn in the run loop and waits for the result.
+// Calls are run in the order they were issued.
+// It returns ErrClosed if the watcher was closed before fn could run.
+func (w *watcher) call(port syscall.Handle, fn func() error) error {
+	w.mutex.RLock()
+	direct := w.direct
+	w.mutex.RUnlock()
+	if direct {
+		return fn()
+	}
+	resp := make(chan error, 1)
+	sig := func() bool {
+		resp <- fn()
 		return false
 	}
-	err := syscall.PostQueuedCompletionStatus(w.port, 0, 0, nil)
+	select {
+	case w.signal <- sig:
+	case <-w.done:
+		return ErrClosed
+	}
+	err := syscall.PostQueuedCompletionStatus(port, 0, 0, nil)
 	if err != nil {
 		return os.NewSyscallError("PostQueuedCompletionStatus", err)
 	}
-	return <-resp
+	select {
+	case err = <-resp:
+		return err
+	case <-w.done:
+	}
+	select {
+	case err = <-resp:
+		return err
+	default:
+		return ErrClosed
+	}
 }
 
+// add opens and starts the watch of nfo. A directory below a subtree watch is not
+// watched itself. It expects the watcher mutex to be held.
 func (w *watcher) add(nfo *info, flags uint32) error {
-	handle, err := syscall.CreateFile(syscall.StringToUTF16Ptr(nfo.path), syscall.FILE_LIST_DIRECTORY,
+	if w.context.SubtreeWatch && w.inSubtree(nfo.path) {
+		return nil
+	}
+	handle, err := syscall.CreateFile(syscall.StringToUTF16Ptr(longPath(nfo.path)), syscall.FILE_LIST_DIRECTORY,
 		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
 		nil, syscall.OPEN_EXISTING,
 		syscall.FILE_FLAG_BACKUP_SEMANTICS|syscall.FILE_FLAG_OVERLAPPED, 0)
 	if err != nil {
-		return os.NewSyscallError("CreateFile", err)
+		return watchError("add", nfo.path, "CreateFile", err)
 	}
 	_, err = syscall.CreateIoCompletionPort(handle, w.port, 0, 1)
 	if err != nil {
 		syscall.CloseHandle(handle)
-		return os.NewSyscallError("CreateIoCompletionPort", err)
+		return watchError("add", nfo.path, "CreateIoCompletionPort", err)
+	}
+	subtree := w.context.SubtreeWatch && nfo.has(recurse)
+	nfo.setWatch(&watch{handle: handle, mask: flags, info: nfo, buf: make([]byte, w.bufsize), subtree: subtree})
+	if subtree {
+		// the watches of cached descendents would report the same changes
+		w.tree.walk(nfo.path, func(fi FileInfo) error {
+			if fi := fi.(*info); fi != nfo && fi.watch != nil {
+				if err := w.rm(fi); err != nil {
+					w.context.Error(err)
+				}
+			}
+			return nil
+		})
 	}
-	nfo.watch = &watch{handle: handle, mask: flags, info: nfo}
 	return w.start(nfo)
 }
 
+// inSubtree returns whether a cached ancestor of path holds a subtree watch.
+// It expects the watcher mutex to be held.
+func (w *watcher) inSubtree(path string) bool {
+	for dir := filepath.Dir(path); dir != path; path, dir = dir, filepath.Dir(dir) {
+		if nfo := w.tree.get(dir); nfo != nil && nfo.watch != nil && nfo.watch.subtree {
+			return true
+		}
+	}
+	return false
+}
+
+// reaches returns whether the change of the file at path reported by the subtree watch
+// of root would be reported by a watch of its directory. Every directory between root and
+// path must be cached, not ignored, accepted by the filter and within the depth limit.
+func (w *watcher) reaches(root, path string) bool {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	dir := filepath.Dir(path)
+	if w.pathOptions(dir).unwatched(dir) {
+		return false
+	}
+	for ; len(dir) > len(root); dir = filepath.Dir(dir) {
+		nfo := w.tree.get(dir)
+		if nfo == nil || nfo.Ignored() || !w.accept(nfo) || w.pathOptions(dir).excluded(dir) {
+			return false
+		}
+	}
+	return true
+}
+
+// rearm does nothing, directory handles have no one shot watches
+func (w *watcher) rearm(nfo *info) {}
+
 func (w *watcher) unload(path string, recursive bool) error {
 	w.mutex.RLock()
 	port := w.port
@@ -129,8 +274,7 @@ func (w *watcher) unload(path string, recursive bool) error {
 	if nfo == nil || nfo.watch == nil {
 		return nil
 	}
-	resp := make(chan error)
-	w.signal <- func() bool {
+	return w.call(port, func() error {
 		w.mutex.Lock()
 		var reload []*info
 		w.tree.deleteAll(nfo.path, func(nfo *info) {
@@ -145,36 +289,75 @@ func (w *watcher) unload(path string, recursive bool) error {
 		})
 		w.mutex.Unlock()
 		for _, nfo = range reload {
-			err := w.loadImpl(nfo.path, nfo.flags&(recurse|explicit), 0, allFlags, allFlags)
+			err := w.loadImpl(nfo.path, nfo.flags&(recurse|explicit), 0, w.flags, w.flags, nfo.opts)
 			if err != nil {
 				w.context.Error(err)
 			}
 		}
-		resp <- nil
-		return false
-	}
-	err := syscall.PostQueuedCompletionStatus(port, 0, 0, nil)
-	if err != nil {
-		return os.NewSyscallError("PostQueuedCompletionStatus", err)
-	}
-	err = <-resp
-	return err
+		return nil
+	})
 }
 
 func (w *watcher) rm(nfo *info) error {
 	err := syscall.CancelIo(nfo.watch.handle)
 	if err != nil {
-		return os.NewSyscallError("CancelIo", err)
+		return watchError("rm", nfo.path, "CancelIo", err)
 	}
 	err = syscall.CloseHandle(nfo.watch.handle)
 	if err != nil {
-		return os.NewSyscallError("CloseHandle", err)
+		return watchError("rm", nfo.path, "CloseHandle", err)
 	}
 	nfo.watch.info = nil
-	nfo.watch = nil
+	nfo.setWatch(nil)
 	return nil
 }
 
+// unwatch removes the watches of all infos in list but keeps them cached
+func (w *watcher) unwatch(list []*info) error {
+	w.mutex.RLock()
+	port := w.port
+	w.mutex.RUnlock()
+	if port == syscall.InvalidHandle {
+		return ErrClosed
+	}
+	return w.call(port, func() error {
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+		var err error
+		for _, nfo := range list {
+			if nfo.watch == nil {
+				continue
+			}
+			if e := w.rm(nfo); e != nil && err == nil {
+				err = e
+			}
+		}
+		return err
+	})
+}
+
+// forget releases the watch of a deleted info.
+// It expects the watcher mutex to be held.
+func (w *watcher) forget(nfo *info) {
+	if nfo.watch != nil {
+		nfo.watch.info = nil
+		nfo.setWatch(nil)
+	}
+}
+
+// descriptors returns the paths of all watches by directory handle
+func (w *watcher) descriptors() map[int]string {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	res := make(map[int]string)
+	w.tree.each(func(nfo *info) {
+		if nfo.watch != nil {
+			res[int(nfo.watch.handle)] = nfo.path
+		}
+	})
+	return res
+}
+
 func (w *watcher) close() error {
 	w.mutex.RLock()
 	port := w.port
@@ -182,7 +365,7 @@ func (w *watcher) close() error {
 	if port == syscall.InvalidHandle {
 		return ErrClosed
 	}
-	w.signal <- func() bool {
+	sig := func() bool {
 		w.mutex.Lock()
 		defer w.mutex.Unlock()
 		w.tree.deleteAll("", func(nfo *info) {
@@ -199,6 +382,11 @@ func (w *watcher) close() error {
 		}
 		return true
 	}
+	select {
+	case w.signal <- sig:
+	case <-w.done:
+		return ErrClosed
+	}
 	err := syscall.PostQueuedCompletionStatus(port, 0, 0, nil)
 	if err != nil {
 		return os.NewSyscallError("PostQueuedCompletionStatus", err)
@@ -213,9 +401,9 @@ func (w *watcher) start(nfo *info) error {
 	watch := nfo.watch
 	err := syscall.CancelIo(watch.handle)
 	if err != nil {
-		return os.NewSyscallError("CancelIo", err)
+		return watchError("read", nfo.path, "CancelIo", err)
 	}
-	err = syscall.ReadDirectoryChanges(watch.handle, &watch.buf[0], uint32(len(watch.buf)), false, watch.mask, nil, &watch.overlap, 0)
+	err = syscall.ReadDirectoryChanges(watch.handle, &watch.buf[0], uint32(len(watch.buf)), watch.subtree, watch.mask, nil, &watch.overlap, 0)
 	if err != nil {
 		if err == syscall.ERROR_ACCESS_DENIED {
 			var list []*info
@@ -231,11 +419,11 @@ func (w *watcher) start(nfo *info) error {
 			})
 			w.mutex.Unlock()
 			for _, nfo = range list {
-				w.context.Handle(Delete, nfo)
+				w.dispatch(Delete, nfo)
 			}
 			return nil
 		}
-		return os.NewSyscallError("ReadDirectoryChanges", err)
+		return watchError("read", nfo.path, "ReadDirectoryChanges", err)
 	}
 	return nil
 }
@@ -248,6 +436,7 @@ type qitem struct {
 
 func (w *watcher) run(port syscall.Handle) {
 	runtime.LockOSThread()
+	defer close(w.done)
 	var n, key uint32
 	var overlap *syscall.Overlapped
 	var queue []qitem
@@ -266,9 +455,7 @@ func (w *watcher) run(port syscall.Handle) {
 					return
 				}
 			default:
-				for _, q := range queue {
-					w.handle(q.action, q.info, q.name)
-				}
+				w.handleAll(queue)
 				queue = queue[:0]
 			}
 			continue
@@ -293,44 +480,59 @@ func (w *watcher) run(port syscall.Handle) {
 			})
 			w.mutex.Unlock()
 			for _, nfo := range list {
-				w.context.Handle(Delete, nfo)
+				w.dispatch(Delete, nfo)
 			}
 			continue
 		default:
-			w.context.Error(os.NewSyscallError("GetQueuedCompletionStatus", err))
+			if nfo := watch.info; nfo != nil {
+				w.context.Error(watchError("read", nfo.path, "GetQueuedCompletionStatus", err))
+			} else {
+				w.context.Error(os.NewSyscallError("GetQueuedCompletionStatus", err))
+			}
 			continue
 		}
-		if n <= 0 {
-			w.context.Error(errShortRead)
+		if n < nameOffset {
+			// the kernel buffer overflowed and the changes were dropped
+			w.stats.overflowed()
+			w.context.Error(ErrOverflow)
+			w.missed(watch)
+			err = w.start(watch.info)
+			if err != nil {
+				w.context.Error(err)
+			}
+			continue
 		}
 		queued := len(queue)
-		for offset := uint32(0); offset < n-16; {
+		corrupt := false
+		for offset := uint32(0); offset+nameOffset <= n; {
 			raw := (*syscall.FileNotifyInformation)(unsafe.Pointer(&watch.buf[offset]))
-			fnb := (*[syscall.MAX_PATH]uint16)(unsafe.Pointer(&raw.FileName))[:raw.FileNameLength/2]
-			name := syscall.UTF16ToString(fnb)
-			found := false
-			for _, q := range queue {
-				if q.info == watch.info && q.name == name {
-					found = !isDelete(q.action) && !isDelete(raw.Action)
-					break
-				}
-			}
-			if !found {
-				queue = append(queue, qitem{raw.Action, watch.info, name})
+			// never trust the name length beyond the buffer, the names relative to
+			// a subtree watch may be longer than MAX_PATH
+			size := raw.FileNameLength
+			if size%2 != 0 || offset+nameOffset+size > n {
+				corrupt = true
+				break
 			}
+			fnb := unsafe.Slice(&raw.FileName, size/2)
+			name := syscall.UTF16ToString(fnb)
+			queue = append(queue, qitem{raw.Action, watch.info, name})
 			if raw.NextEntryOffset == 0 {
 				break
 			}
 			offset += raw.NextEntryOffset
 			if offset > n {
-				w.context.Error(ErrOverflow)
+				corrupt = true
+				break
 			}
 		}
-		for _, q := range queue[:queued] {
-			w.handle(q.action, q.info, q.name)
-		}
+		w.handleAll(queue[:queued])
 		copy(queue, queue[queued:])
 		queue = queue[:len(queue)-queued]
+		if corrupt {
+			w.stats.overflowed()
+			w.context.Error(ErrOverflow)
+			w.missed(watch)
+		}
 		err = w.start(watch.info)
 		if err != nil {
 			w.context.Error(err)
@@ -338,29 +540,127 @@ func (w *watcher) run(port syscall.Handle) {
 	}
 }
 
+// missed compares the cache with the disk after the changes reported by watch were lost.
+// A subtree watch compares all cached descendents, other watches the directory entries.
+func (w *watcher) missed(watch *watch) {
+	if !watch.subtree {
+		w.rescan(watch.info)
+		return
+	}
+	if err := w.reconcile(watch.info); err != nil {
+		w.context.Error(err)
+	}
+}
+
+// handleAll handles the queued items. An old name directly followed by the new name
+// of the same directory is handled as Rename. The removal of a file that is replaced
+// by a later rename, like an atomic save, is skipped, so the file is only modified.
+func (w *watcher) handleAll(queue []qitem) {
+	w.beginBatch()
+	defer w.endBatch()
+	for i := 0; i < len(queue); i++ {
+		q := queue[i]
+		if q.action == syscall.FILE_ACTION_REMOVED && w.replaces(queue[i+1:], q) {
+			continue
+		}
+		if q.action == syscall.FILE_ACTION_RENAMED_OLD_NAME && i+1 < len(queue) {
+			next := queue[i+1]
+			if next.action == syscall.FILE_ACTION_RENAMED_NEW_NAME && next.info == q.info &&
+				w.cached(q.info) && w.rename(childPath(q.info.path, q.name), childPath(q.info.path, next.name)) {
+				i++
+				continue
+			}
+		}
+		w.handle(q.action, q.info, q.name)
+	}
+}
+
+// replaces returns whether the cached file removed by q is the new name of a rename in queue
+func (w *watcher) replaces(queue []qitem, q qitem) bool {
+	if !w.cached(q.info) {
+		return false
+	}
+	for i := 0; i+1 < len(queue); i++ {
+		from, to := queue[i], queue[i+1]
+		if from.action != syscall.FILE_ACTION_RENAMED_OLD_NAME || to.action != syscall.FILE_ACTION_RENAMED_NEW_NAME ||
+			from.info != q.info || to.info != q.info || to.name != q.name {
+			continue
+		}
+		w.mutex.RLock()
+		fi := w.tree.get(childPath(q.info.path, q.name))
+		w.mutex.RUnlock()
+		return fi != nil && !fi.IsDir()
+	}
+	return false
+}
+
+// longPath returns the absolute path with the `\\?\` prefix if it is too long for the
+// windows API functions without it. UNC paths use the `\\?\UNC\` prefix.
+func longPath(path string) string {
+	// directories must leave room for an 8.3 file name
+	if len(path) < syscall.MAX_PATH-12 || !filepath.IsAbs(path) || strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+	if strings.HasPrefix(path, `\\`) {
+		return `\\?\UNC\` + path[2:]
+	}
+	return `\\?\` + path
+}
+
+// childPath returns the path of the file name reported for the directory dir.
+// A subtree watch reports names relative to dir, like `sub\file`.
+// A name reported in its 8.3 short form is replaced by its long form if the file exists,
+// so the path matches the cache and the paths reported by Load.
+func childPath(dir, name string) string {
+	path := filepath.Join(dir, name)
+	if !strings.Contains(name, "~") {
+		return path
+	}
+	short, err := syscall.UTF16FromString(longPath(path))
+	if err != nil {
+		return path
+	}
+	buf := make([]uint16, syscall.MAX_PATH)
+	for {
+		n, err := syscall.GetLongPathName(&short[0], &buf[0], uint32(len(buf)))
+		if err != nil || n == 0 {
+			return path
+		}
+		if int(n) < len(buf) {
+			return filepath.Join(filepath.Dir(path), filepath.Base(syscall.UTF16ToString(buf[:n])))
+		}
+		buf = make([]uint16, n)
+	}
+}
+
 func isDelete(action uint32) bool {
 	return action == syscall.FILE_ACTION_REMOVED || action == syscall.FILE_ACTION_RENAMED_OLD_NAME
 }
 
 func (w *watcher) handle(action uint32, nfo *info, name string) {
+	if !w.cached(nfo) {
+		return
+	}
 	path, fi := nfo.path, nfo
 	if name != "" {
-		path = filepath.Join(path, name)
+		path = childPath(path, name)
 		fi = nil
+		if filepath.Dir(path) != nfo.path && !w.reaches(nfo.path, path) {
+			// a subtree watch reports the changes below unwatched directories as well
+			return
+		}
 	}
 	if isDelete(action) {
 		var list []*info
 		w.mutex.Lock()
 		w.tree.deleteAll(path, func(fi *info) {
-			if fi.watch != nil {
-				fi.watch.info = nil
-				fi.watch = nil
-			}
+			fi.setSys(action)
+			w.forget(fi)
 			list = append(list, fi)
 		})
 		w.mutex.Unlock()
 		for _, fi = range list {
-			w.context.Handle(Delete, fi)
+			w.dispatch(Delete, fi)
 		}
 		return
 	}
@@ -370,21 +670,25 @@ func (w *watcher) handle(action uint32, nfo *info, name string) {
 		w.mutex.RUnlock()
 	}
 	if fi == nil {
-		err := w.loadImpl(path, nfo.flags&recurse, Create, allFlags, allFlags)
+		err := w.loadImpl(path, nfo.flags&recurse, Create, w.flags, w.flags, nil)
 		if err != nil && err != SkipDir {
 			if !os.IsNotExist(err) {
 				w.context.Error(err)
 			}
 		}
 	} else {
-		nfi, err := os.Lstat(path)
+		nfi, err := fi.stat()
 		if err != nil {
 			if !os.IsNotExist(err) {
 				w.context.Error(err)
 			}
 			return
 		}
-		fi.update(nfi)
-		w.context.Handle(Modify, fi)
+		if action == syscall.FILE_ACTION_RENAMED_NEW_NAME && w.selfMoved(path) {
+			// the subtree was already moved by Watcher.Move
+			return
+		}
+		fi.setSys(action)
+		w.modify(fi, nfi)
 	}
 }
@@ -0,0 +1,92 @@
+// Copyright 2013 Martin Schnabel.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !poll
+
+package fswatch
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLongPath(t *testing.T) {
+	deep := `C:\` + strings.Repeat(`dir\`, 70) + "file"
+	unc := `\\server\share\` + strings.Repeat(`dir\`, 70) + "file"
+	for _, c := range []struct {
+		path, want string
+	}{
+		{`C:\dir`, `C:\dir`},
+		{deep, `\\?\` + deep},
+		{`\\?\` + deep, `\\?\` + deep},
+		{unc, `\\?\UNC\` + unc[2:]},
+		{`dir\` + strings.Repeat("a", 300), `dir\` + strings.Repeat("a", 300)},
+	} {
+		if got := longPath(c.path); got != c.want {
+			t.Errorf("expected %q got %q", c.want, got)
+		}
+	}
+}
+
+func TestSubtreeWatch(t *testing.T) {
+	env := newtestenvWith(t, &Context{SubtreeWatch: true})
+	root, w := env.root, env.watcher
+	defer env.close()
+	deep := filepath.Join(root, "a", "b")
+	if err := os.MkdirAll(deep, 0700); err != nil {
+		t.Fatal("failed to mkdir.", err)
+	}
+	env.load(root, true)
+	// only the root holds a handle
+	if ds := (Watcher{w}).Descriptors(); len(ds) != 1 {
+		t.Errorf("expected one watch got %v", ds)
+	}
+	if fi := (Watcher{w}).Get(deep); fi == nil || Watched(fi) {
+		t.Errorf("expected the cached and unwatched %s got %v", deep, fi)
+	}
+	if !(Watcher{w}).Backend().NativeRecursive {
+		t.Error("expected a native recursive backend")
+	}
+	file := env.createWriteClose(deep, "file")
+	sub := env.mkdir(deep, "sub")
+	env.sleep()
+	renamed := filepath.Join(deep, "renamed")
+	if err := os.Rename(file, renamed); err != nil {
+		t.Fatal("failed to rename.", err)
+	}
+	env.sleep()
+	env.expect = append(env.expect, record{Rename, renamed, false})
+	if (Watcher{w}).Get(sub) == nil || (Watcher{w}).GC() != 0 {
+		t.Error("expected the subtree to stay cached")
+	}
+	env.check()
+}
+
+func TestSubtreeWatchLimits(t *testing.T) {
+	env := newtestenvWith(t, &Context{
+		SubtreeWatch: true,
+		Filter: func(fi FileInfo) bool {
+			return fi.Name() != "skip"
+		},
+	})
+	root, w := env.root, env.watcher
+	defer env.close()
+	for _, dir := range []string{"a", "skip"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0700); err != nil {
+			t.Fatal("failed to mkdir.", err)
+		}
+	}
+	if err := (Watcher{w}).LoadDepth(root, 0); err != nil {
+		t.Fatal("failed to load.", err)
+	}
+	// the changes below ignored directories and beyond the depth are not reported
+	for _, dir := range []string{"a", "skip"} {
+		env.writeClose(os.Create(filepath.Join(root, dir, "file")))
+	}
+	env.createWriteClose(root, "file")
+	env.sleep()
+	env.check()
+}